@@ -0,0 +1,189 @@
+package marb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Results tell what serving a request amounted to, beyond its status,
+// in the access log: 200s with a Range header that wasn't honored, for
+// example, are range-ignored rather than full.
+const (
+	resultFull                = "full"
+	resultNotModified         = "not-modified"
+	resultRange               = "range"
+	resultRangeIgnored        = "range-ignored"
+	resultRangeNotSatisfiable = "range-not-satisfiable"
+	resultBadRequest          = "bad-request"
+	resultNotAcceptable       = "not-acceptable"
+	resultNotFound            = "not-found"
+	resultFallback            = "fallback"
+	resultRedirect            = "redirect"
+	resultListing             = "listing"
+	resultOverLimit           = "over-limit"
+)
+
+// outcomeKey is the context key of the countingWriter of a request to
+// be logged, for the serving functions behind middleware to record its
+// result on.
+type outcomeKey struct{}
+
+// setResult records result as the outcome of r, if it's logged.
+func setResult(r *http.Request, result string) {
+	if cw, ok := r.Context().Value(outcomeKey{}).(*countingWriter); ok {
+		cw.result = result
+	}
+}
+
+// setThrottled records that the response to r was paced to rate,
+// spending paced waiting, if r is logged.
+func setThrottled(r *http.Request, rate string, paced time.Duration) {
+	if cw, ok := r.Context().Value(outcomeKey{}).(*countingWriter); ok {
+		cw.throttle, cw.paced = rate, paced
+	}
+}
+
+// withOutcome returns r carrying cw for setResult to record on, if r is
+// to be logged. Others are spared the allocations.
+func (s *Server) withOutcome(r *http.Request, cw *countingWriter) *http.Request {
+	if s.logExclude.match(r.URL.Path) || s.LogOnlySlow <= 0 && !s.logEnabled(levelInfo) {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), outcomeKey{}, cw))
+}
+
+// logResult returns the result of the response for the access log, "-"
+// when nothing recorded one, as for health checks or the admin API.
+func (c *countingWriter) logResult() string {
+	if c.result == "" {
+		return "-"
+	}
+	return c.result
+}
+
+// logThrottle returns the rate the response was throttled to and how
+// long it was paced, as fields to append to the access log line, or ""
+// if it wasn't throttled.
+func (c *countingWriter) logThrottle() string {
+	if c.throttle == "" {
+		return ""
+	}
+	return " throttle=" + c.throttle + " paced=" + c.paced.Round(time.Millisecond).String()
+}
+
+// logEncoding returns the content coding of the response body.
+func (c *countingWriter) logEncoding() string {
+	if encoding := c.Header().Get("Content-Encoding"); encoding != "" {
+		return encoding
+	}
+	return "identity"
+}
+
+// hostLog is the access log file of a virtual host. Failing to write
+// to it is reported once on the main log, and neither affects serving
+// nor the logs of other hosts.
+type hostLog struct {
+	*log.Logger
+	host string
+	path string
+
+	mu      sync.Mutex
+	f       *os.File
+	failing bool
+}
+
+func newHostLog(host string, path string) (*hostLog, error) {
+	l := &hostLog{host: host, path: path}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+	l.Logger = log.New(l, "", log.LstdFlags)
+	return l, nil
+}
+
+func (l *hostLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return 0, os.ErrClosed
+	}
+	n, err := l.f.Write(p)
+	if err != nil && !l.failing {
+		log.Printf("access log of %s: %v", l.host, err)
+	}
+	l.failing = err != nil
+	return n, err
+}
+
+// reopen opens the log file again, for it to be rotated. The previous
+// file is kept when that fails.
+func (l *hostLog) reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f, l.failing = f, false
+	return nil
+}
+
+func (l *hostLog) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+}
+
+// newHostLogs opens the access logs given as HOST=FILE.
+func newHostLogs(specs []string) (map[string]*hostLog, error) {
+	logs := make(map[string]*hostLog, len(specs))
+	for _, spec := range specs {
+		host, file, ok := strings.Cut(spec, "=")
+		if !ok || host == "" || file == "" {
+			return nil, fmt.Errorf("access log %q: expected HOST=FILE", spec)
+		}
+		host = strings.ToLower(hostname(host))
+		l, err := newHostLog(host, file)
+		if err != nil {
+			return nil, fmt.Errorf("access log of %s: %v", host, err)
+		}
+		logs[host] = l
+	}
+	return logs, nil
+}
+
+// accessLogf returns the function logging requests for the host r is
+// for, which defaults to the main log.
+func (s *Server) accessLogf(r *http.Request) func(format string, v ...interface{}) {
+	if len(s.hostLogs) == 0 {
+		return log.Printf
+	}
+	if l := s.hostLogs[strings.ToLower(hostname(r.Host))]; l != nil {
+		return l.Printf
+	}
+	return log.Printf
+}
+
+// ReopenLogs reopens the access log files of virtual hosts, typically
+// after they were rotated.
+func (s *Server) ReopenLogs() {
+	for _, l := range s.hostLogs {
+		if err := l.reopen(); err != nil {
+			log.Printf("reopening access log of %s: %v", l.host, err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package marb
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogOnlySlow(t *testing.T) {
+	s := newTestServer(t, Config{
+		LogOnlySlow: 50 * time.Millisecond,
+		LogExclude:  []string{"/quiet/*"},
+		// 3000 bytes at 10KB/s are written in three 1000 byte chunks,
+		// the last two paced 100ms apart
+		Throttle: []string{"/big.bin=10KB/s", "/quiet/*=10KB/s"},
+	}, map[string]string{
+		"index.html":    "<p>hello</p>",
+		"big.bin":       strings.Repeat("x", 3000),
+		"quiet/big.bin": strings.Repeat("x", 3000),
+	})
+	logged := captureLog(t)
+
+	for _, tt := range []struct {
+		path string
+		want string // in the logged line, or "" for none
+	}{
+		{"/big.bin", "GET /big.bin slow: 200 full, 3000 bytes in "},
+		{"/", ""},
+		{"/quiet/big.bin", ""},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			logged.Reset()
+			s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tt.path, nil))
+			line := logged.String()
+			if tt.want == "" {
+				if line != "" {
+					t.Errorf("logged %q, want nothing", line)
+				}
+				return
+			}
+			if !strings.Contains(line, tt.want) {
+				t.Errorf("logged %q, want it to contain %q", line, tt.want)
+			}
+			if !strings.Contains(line, "identity throttle=10KB/s paced=") {
+				t.Errorf("logged %q, want the throttle rate and paced time", line)
+			}
+		})
+	}
+}
+
+func TestHostLogs(t *testing.T) {
+	dir := t.TempDir()
+	logs := map[string]string{
+		"www.example.com": filepath.Join(dir, "www.log"),
+		"192.0.2.1":       filepath.Join(dir, "ipv4.log"),
+		"2001:db8::1":     filepath.Join(dir, "ipv6.log"),
+	}
+	var specs []string
+	for host, file := range logs {
+		specs = append(specs, host+"="+file)
+	}
+	s := newTestServer(t, Config{HostLogs: specs}, map[string]string{"index.html": "home"})
+	main := captureLog(t)
+
+	for _, tt := range []struct {
+		host string
+		log  string // "" for the main log
+	}{
+		{"www.example.com", "www.example.com"},
+		{"www.example.com:8080", "www.example.com"},
+		{"WWW.Example.COM:8080", "www.example.com"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.1:8080", "192.0.2.1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"[2001:DB8::1]:8080", "2001:db8::1"},
+		{"example.com", ""},
+	} {
+		r := httptest.NewRequest("GET", "/?host="+tt.host, nil)
+		r.Host = tt.host
+		s.ServeHTTP(httptest.NewRecorder(), r)
+
+		want := "GET /?host=" + tt.host + " "
+		for host, file := range logs {
+			logged, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Contains(string(logged), want); got != (host == tt.log) {
+				t.Errorf("Host %q logged to the log of %s: %v, want %v", tt.host, host, got, !got)
+			}
+		}
+		if got := strings.Contains(main.String(), want); got != (tt.log == "") {
+			t.Errorf("Host %q logged to the main log: %v, want %v", tt.host, got, !got)
+		}
+	}
+}
+
+func TestLogExclude(t *testing.T) {
+	s := newTestServer(t, Config{LogExclude: []string{"/favicon.ico", "/status/*"}, Throttle: []string{"/big.bin=1MB/s"}}, map[string]string{
+		"index.html":  "home",
+		"favicon.ico": "icon",
+		"status/ping": "pong",
+		"big.bin":     "bytes",
+	})
+	logged := captureLog(t)
+
+	for _, tt := range []struct {
+		path string
+		want string // the logged line, "" for none
+	}{
+		{"/", "192.0.2.1:1234 GET / 200 4 full identity\n"},
+		{"/big.bin", "192.0.2.1:1234 GET /big.bin 200 5 full identity throttle=1MB/s paced=0s\n"},
+		{"/favicon.ico", ""},
+		{"/status/ping", ""},
+	} {
+		logged.Reset()
+		s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tt.path, nil))
+		if got := logged.String(); got != tt.want {
+			t.Errorf("%s: logged %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
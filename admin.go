@@ -0,0 +1,152 @@
+package marb
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AdminHandler returns the handler for the admin API, meant to be
+// served on a separate, private listener. When AdminToken or
+// AdminTokens are set, requests must carry one of them as a bearer
+// token, CORS preflights aside, as described by isPreflight.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/info", s.serveInfo)
+	mux.HandleFunc("/config", s.serveConfig)
+	mux.HandleFunc("/reloads", s.serveReloads)
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	mux.HandleFunc("/loglevel", s.serveSetting("log level", s.runtime.logLevel, parseLogLevel))
+	mux.HandleFunc("/debug-headers", s.serveSetting("debug headers", s.runtime.debugHeaders, parseSwitch))
+	mux.HandleFunc("/maintenance", s.serveSetting("maintenance mode", s.runtime.maintenance, parseSwitch))
+	mux.HandleFunc("/drain", s.serveDrain(true))
+	mux.HandleFunc("/undrain", s.serveDrain(false))
+	mux.HandleFunc("/_deploy", s.serveDeploy)
+	mux.HandleFunc("/_sri", s.serveSRI)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPreflight(r) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		id, ok := s.adminAuthorized(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="marb"`)
+			adminError(w, r, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminIDKey{}, id)))
+	})
+}
+
+// defaultAdminID names the holder of AdminToken, and anonymousAdminID
+// anyone when no token is required.
+const (
+	defaultAdminID   = "admin"
+	anonymousAdminID = "anonymous"
+)
+
+type adminIDKey struct{}
+
+// adminID returns the ID of the token the admin request r was
+// authorized with, for logging who changed what.
+func adminID(r *http.Request) string {
+	id, _ := r.Context().Value(adminIDKey{}).(string)
+	return id
+}
+
+// parseAdminTokens parses the ID=TOKEN admin tokens.
+func parseAdminTokens(cfg Config) (map[string]string, error) {
+	tokens := make(map[string]string)
+	if cfg.AdminToken != "" {
+		tokens[defaultAdminID] = cfg.AdminToken
+	}
+	for _, spec := range cfg.AdminTokens {
+		id, token, ok := strings.Cut(spec, "=")
+		if !ok || id == "" || token == "" {
+			return nil, errors.New("admin tokens must be given as ID=TOKEN")
+		}
+		if _, dup := tokens[id]; dup {
+			return nil, fmt.Errorf("duplicate admin token ID %q", id)
+		}
+		tokens[id] = token
+	}
+	return tokens, nil
+}
+
+// adminAuthorized reports whether r carries a valid admin token, and
+// the ID of that token.
+func (s *Server) adminAuthorized(r *http.Request) (string, bool) {
+	if len(s.adminTokens) == 0 {
+		return anonymousAdminID, true
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	for id, valid := range s.adminTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(valid)) == 1 {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+func adminError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	body, _ := json.Marshal(map[string]string{"error": msg})
+	writeDynamic(w, r, status, "application/json", body)
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		adminError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeDynamic(w, r, http.StatusOK, "application/json", append(body, '\n'))
+}
+
+type serverInfo struct {
+	Root     string       `json:"root"`
+	Files    int          `json:"files"`
+	Bytes    int64        `json:"bytes"`
+	Reload   reloadStatus `json:"reload"`
+	Purge    *purgeStatus `json:"purge,omitempty"`
+	Drain    settingInfo  `json:"drain"`
+	Warnings []Warning    `json:"warnings"`
+}
+
+func (s *Server) serveReloads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		adminError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, r, s.reloadReports())
+}
+
+func (s *Server) serveInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		adminError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	info := serverInfo{Root: s.Root, Reload: s.reloadStatus(), Drain: s.runtime.draining.info()}
+	if s.purger != nil {
+		status := s.purger.currentStatus()
+		info.Purge = &status
+	}
+	snap := s.current()
+	for _, f := range snap.paths() {
+		info.Files++
+		info.Bytes += f.residentSize()
+	}
+	info.Warnings = snap.warnings
+	if info.Warnings == nil {
+		info.Warnings = []Warning{}
+	}
+	writeJSON(w, r, info)
+}
@@ -0,0 +1,172 @@
+package marb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dirEntry describes a file or subdirectory in a directory listing,
+// both the HTML and JSON ones.
+type dirEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+	IsDir   bool      `json:"isDir"`
+	SHA256  string    `json:"sha256,omitempty"` // hex digest of the contents of files
+}
+
+// hiddenName reports whether a file or directory is left out of
+// listings, as dot files are.
+func hiddenName(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// buildListings lists the contents of every directory of snap, for
+// those without an index, sorted by name. A directory is as recent as
+// its most recent file. Hidden files and directories, and whatever is
+// in the latter, are left out.
+func buildListings(snap *siteSnapshot) error {
+	entries := make(map[string]map[string]*dirEntry)
+	add := func(dir string, e dirEntry) {
+		if entries[dir] == nil {
+			entries[dir] = make(map[string]*dirEntry)
+		}
+		if prev := entries[dir][e.Name]; prev != nil {
+			switch {
+			case prev.IsDir && !e.IsDir:
+				// a file and a directory by the same name, the file
+				// being the one served
+				entries[dir][e.Name] = &e
+			case prev.IsDir && e.IsDir && e.ModTime.After(prev.ModTime):
+				prev.ModTime = e.ModTime
+			}
+			return
+		}
+		entries[dir][e.Name] = &e
+	}
+
+	for p, f := range snap.paths() {
+		if hiddenPath(p) {
+			continue
+		}
+		contents, err := f.identity()
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(contents)
+		add(f.dir, dirEntry{Name: f.name, Size: int64(f.size), ModTime: f.lastModified, SHA256: hex.EncodeToString(sum[:])})
+		for dir := f.dir; dir != "/"; dir = path.Dir(dir) {
+			add(path.Dir(dir), dirEntry{Name: path.Base(dir), ModTime: f.lastModified, IsDir: true})
+		}
+	}
+
+	snap.dirs = make(map[string][]dirEntry, len(entries))
+	for dir, byName := range entries {
+		list := make([]dirEntry, 0, len(byName))
+		for _, e := range byName {
+			list = append(list, *e)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		snap.dirs[dir] = list
+	}
+	return nil
+}
+
+// hiddenPath reports whether any segment of p is hidden.
+func hiddenPath(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if hiddenName(segment) {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsJSON reports whether a listing is asked for as JSON, with a
+// format=json query parameter or by an Accept header preferring it.
+func wantsJSON(r *http.Request) bool {
+	switch r.URL.Query().Get("format") {
+	case "json":
+		return true
+	case "html":
+		return false
+	}
+	return prefersJSON(r.Header.Get("Accept"))
+}
+
+// prefersJSON reports whether the Accept header ranks application/json
+// above text/html.
+func prefersJSON(accept string) bool {
+	quality := func(mediaType string) float64 {
+		best, bestSpecificity := 0.0, -1
+		for rest := accept; rest != ""; {
+			var part string
+			part, rest, _ = strings.Cut(rest, ",")
+			token, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			token = strings.ToLower(strings.TrimSpace(token))
+
+			specificity := -1
+			switch {
+			case token == mediaType:
+				specificity = 2
+			case token == mediaType[:strings.Index(mediaType, "/")]+"/*":
+				specificity = 1
+			case token == "*/*":
+				specificity = 0
+			}
+			if specificity <= bestSpecificity {
+				continue
+			}
+
+			q := 1.0
+			if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+				if parsed, err := strconv.ParseFloat(params[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+			best, bestSpecificity = q, specificity
+		}
+		return best
+	}
+
+	return quality("application/json") > quality("text/html")
+}
+
+// serveListing lists a directory, as JSON to clients asking for it and
+// as HTML to the others, both made from the same entries.
+func (s *Server) serveListing(w http.ResponseWriter, r *http.Request, dir string, entries []dirEntry) {
+	w.Header().Add("Vary", "Accept")
+
+	if wantsJSON(r) {
+		body, _ := json.Marshal(entries)
+		writeDynamic(w, r, http.StatusOK, "application/json", append(body, '\n'))
+		return
+	}
+
+	var b strings.Builder
+	title := html.EscapeString("Index of " + dir)
+	fmt.Fprintf(&b, "<!doctype html>\n<meta charset=\"utf-8\">\n<title>%s</title>\n<h1>%s</h1>\n<pre>\n", title, title)
+	if dir != "/" {
+		b.WriteString("<a href=\"../\">../</a>\n")
+	}
+	for _, e := range entries {
+		name := e.Name
+		if e.IsDir {
+			name += "/"
+		}
+		href := (&url.URL{Path: name}).String()
+		fmt.Fprintf(&b, "<a href=\"%s\">%s</a>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	b.WriteString("</pre>\n")
+	writeDynamic(w, r, http.StatusOK, "text/html; charset=utf-8", []byte(b.String()))
+}
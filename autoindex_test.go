@@ -0,0 +1,69 @@
+package marb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestListingJSON(t *testing.T) {
+	s := newTestServer(t, Config{AutoIndex: true}, map[string]string{
+		"files/b.txt":       "bee",
+		"files/a.txt":       "a",
+		"files/sub/c.txt":   "c",
+		"files/.secret":     "hidden",
+		"files/.git/config": "hidden too",
+	})
+
+	for _, tt := range []struct {
+		uri    string
+		accept string
+		json   bool
+	}{
+		{"/files/", "", false},
+		{"/files/", "text/html,application/xhtml+xml,*/*;q=0.8", false},
+		{"/files/", "application/json", true},
+		{"/files/", "application/json;q=0.9, text/html;q=0.5", true},
+		{"/files/", "text/*;q=0.9, application/*;q=0.5", false},
+		{"/files/?format=json", "text/html", true},
+		{"/files/?format=html", "application/json", false},
+	} {
+		r := httptest.NewRequest("GET", tt.uri, nil)
+		r.Header.Set("Accept", tt.accept)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+
+		contentType := rec.Header().Get("Content-Type")
+		if rec.Code != http.StatusOK || (contentType == "application/json") != tt.json || rec.Header().Get("Vary") != "Accept" {
+			t.Errorf("%s with Accept %q: got %d as %q varying on %q, want JSON %v", tt.uri, tt.accept, rec.Code, contentType, rec.Header().Get("Vary"), tt.json)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/files/?format=json", nil)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+	var entries []dirEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+		if e.Name == "b.txt" {
+			sum := sha256.Sum256([]byte("bee"))
+			if e.Size != 3 || e.IsDir || e.SHA256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("b.txt listed as %+v", e)
+			}
+		}
+		if e.Name == "sub" && (!e.IsDir || e.SHA256 != "") {
+			t.Errorf("sub listed as %+v", e)
+		}
+	}
+	if got := strings.Join(names, ","); got != "a.txt,b.txt,sub" {
+		t.Errorf("listed %s, want a.txt,b.txt,sub", got)
+	}
+}
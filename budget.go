@@ -0,0 +1,53 @@
+package marb
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Actions taken when the files loaded exceed MaxTotalSize.
+const (
+	maxTotalSizeFail = "fail"
+	maxTotalSizeWarn = "warn"
+)
+
+// maxTotalSizeOffenders is how many of the largest files are named when
+// the budget is exceeded.
+const maxTotalSizeOffenders = 5
+
+// residentSize is the memory taken by the contents of f, whichever of
+// the identity and compressed versions are kept.
+func (f *siteFile) residentSize() int64 {
+	return int64(len(f.contents) + len(f.gzContents) + len(f.brContents))
+}
+
+// overBudget describes how the files loaded exceed MaxTotalSize, naming
+// the largest ones, or returns "" if they don't. When complete isn't
+// set, loading was cut short and the total is only a lower bound.
+func (s *Server) overBudget(files []*siteFile, complete bool) string {
+	var total int64
+	var loaded []*siteFile
+	for _, f := range files {
+		if f != nil {
+			total += f.residentSize()
+			loaded = append(loaded, f)
+		}
+	}
+	if total <= s.maxTotalSize {
+		return ""
+	}
+
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].residentSize() > loaded[j].residentSize() })
+	var largest []string
+	for i := 0; i < len(loaded) && i < maxTotalSizeOffenders; i++ {
+		largest = append(largest, fmt.Sprintf("%s (%s)", path.Join(loaded[i].dir, loaded[i].name), formatSize(loaded[i].residentSize())))
+	}
+	atLeast := ""
+	if !complete {
+		atLeast = "at least "
+	}
+	return fmt.Sprintf("files take %s%s in memory, over the %s budget, largest: %s",
+		atLeast, formatSize(total), formatSize(s.maxTotalSize), strings.Join(largest, ", "))
+}
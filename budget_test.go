@@ -0,0 +1,58 @@
+package marb
+
+import (
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// noise returns n bytes gzip can't shrink, so that files take exactly
+// their size in memory.
+func noise(n int) string {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return string(b)
+}
+
+func TestMaxTotalSize(t *testing.T) {
+	files := map[string]string{"big.bin": noise(6000), "small.bin": noise(1000)}
+
+	_, err := New(Config{Root: writeSite(t, files), MaxTotalSize: "5KB"})
+	if err == nil || !strings.Contains(err.Error(), "budget") || !strings.Contains(err.Error(), "big.bin") {
+		t.Errorf("over budget: got %v, want an error naming big.bin", err)
+	}
+	if _, err := New(Config{Root: writeSite(t, files), MaxTotalSize: "5KB", MaxTotalSizeAction: "shrug"}); err == nil {
+		t.Error("unknown action accepted")
+	}
+
+	captureLog(t)
+	s := newTestServer(t, Config{MaxTotalSize: "5KB", MaxTotalSizeAction: "warn"}, files)
+	var warned bool
+	for _, w := range s.Warnings() {
+		warned = warned || w.Code == warnOverBudget
+	}
+	if !warned {
+		t.Errorf("warn: no %s warning in %v", warnOverBudget, s.Warnings())
+	}
+	if rec := get(s, "/big.bin"); rec.Code != http.StatusOK {
+		t.Errorf("warn: /big.bin got %d, want it served all the same", rec.Code)
+	}
+
+	// reloads going over budget keep the files already served
+	s = newTestServer(t, Config{MaxTotalSize: "5KB"}, map[string]string{"small.bin": noise(1000)})
+	if err := os.WriteFile(filepath.Join(s.Root, "big.bin"), []byte(noise(6000)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Error("reload over budget succeeded")
+	}
+	if rec := get(s, "/small.bin"); rec.Code != http.StatusOK {
+		t.Errorf("after a failed reload: /small.bin got %d", rec.Code)
+	}
+	if rec := get(s, "/big.bin"); rec.Code != http.StatusNotFound {
+		t.Errorf("after a failed reload: /big.bin got %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,223 @@
+package marb
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stripValidatorsOption ends cache rules whose responses must carry
+// no validators.
+const stripValidatorsOption = "strip-validators"
+
+// cacheRule sets the Cache-Control header of the responses for paths
+// matching pattern. It's written as PATTERN=VALUE, optionally followed
+// by "; strip-validators" to also drop Last-Modified and ETag, and with
+// them conditional requests.
+type cacheRule struct {
+	pattern         string
+	value           string
+	stripValidators bool
+}
+
+func parseCacheRule(rule string) (cacheRule, error) {
+	pattern, value, ok := strings.Cut(rule, "=")
+	if !ok || pattern == "" {
+		return cacheRule{}, fmt.Errorf("cache rule %q: expected PATTERN=VALUE", rule)
+	}
+
+	c := cacheRule{pattern: normalizePattern(strings.TrimSpace(pattern))}
+	if _, err := path.Match(c.pattern, ""); err != nil {
+		return cacheRule{}, fmt.Errorf("cache rule %q: %v", rule, err)
+	}
+	if v, option, ok := strings.Cut(value, ";"); ok {
+		if strings.TrimSpace(option) != stripValidatorsOption {
+			return cacheRule{}, fmt.Errorf("cache rule %q: unknown option %q", rule, strings.TrimSpace(option))
+		}
+		value, c.stripValidators = v, true
+	}
+	var err error
+	if c.value, err = parseCacheControl(value); err != nil {
+		return cacheRule{}, fmt.Errorf("cache rule %q: %v", rule, err)
+	}
+	return c, nil
+}
+
+// cacheDirectives are the Cache-Control response directives marb knows
+// about, and whether they take a number of seconds. Others are taken
+// as extensions, sent as given as long as they're well-formed.
+var cacheDirectives = map[string]bool{
+	"max-age":                true,
+	"s-maxage":               true,
+	"stale-while-revalidate": true,
+	"stale-if-error":         true,
+	"public":                 false,
+	"private":                false,
+	"no-cache":               false,
+	"no-store":               false,
+	"no-transform":           false,
+	"must-revalidate":        false,
+	"proxy-revalidate":       false,
+	"must-understand":        false,
+	"immutable":              false,
+}
+
+// parseCacheControl checks a Cache-Control value and returns it in
+// canonical form. Lifetimes are given in seconds or as durations like
+// "10m", and are sent in seconds:
+//
+//	public, max-age=5m, s-maxage=1h, stale-while-revalidate=30
+//
+// becomes "public, max-age=300, s-maxage=3600, stale-while-revalidate=30".
+func parseCacheControl(value string) (string, error) {
+	var directives []string
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		name, arg, hasArg := strings.Cut(part, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		arg = strings.TrimSpace(arg)
+
+		numeric, known := cacheDirectives[name]
+		switch {
+		case !isToken(name) || hasArg && !isToken(arg) && !isQuotedString(arg):
+			return "", fmt.Errorf("malformed Cache-Control directive %q", part)
+		case seen[name]:
+			return "", fmt.Errorf("repeated Cache-Control directive %q", name)
+		case numeric:
+			seconds, err := parseSeconds(arg)
+			if err != nil {
+				return "", fmt.Errorf("%s: %v", name, err)
+			}
+			part = name + "=" + strconv.FormatInt(seconds, 10)
+		case !known:
+			// an extension, like stale-while-revalidate once was
+			part = name
+			if hasArg {
+				part += "=" + arg
+			}
+		case hasArg && !((name == "private" || name == "no-cache") && isQuotedString(arg)):
+			// only private and no-cache take an argument, a quoted list of fields
+			return "", fmt.Errorf("%s takes no argument", name)
+		case hasArg:
+			part = name + "=" + arg
+		default:
+			part = name
+		}
+		seen[name] = true
+		directives = append(directives, part)
+	}
+
+	if len(directives) == 0 {
+		return "", errors.New("empty Cache-Control value")
+	}
+	return strings.Join(directives, ", "), nil
+}
+
+// isQuotedString reports whether s is a double-quoted string, escapes
+// included.
+func isQuotedString(s string) bool {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return false
+	}
+	i := 1
+	for ; i < len(s)-1; i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return false
+		}
+	}
+	// an escape right before the last quote leaves the string open
+	return i == len(s)-1
+}
+
+// parseSeconds parses a non-negative number of seconds, or a duration
+// in whole seconds.
+func parseSeconds(s string) (int64, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && n >= 0 {
+		return n, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 || d%time.Second != 0 {
+		return 0, fmt.Errorf("invalid number of seconds %q", s)
+	}
+	return int64(d / time.Second), nil
+}
+
+type cacheRules []cacheRule
+
+// match returns the rule for urlPath, if any, the most specific one
+// when several match, as described by mostSpecific.
+func (rules cacheRules) match(urlPath string) *cacheRule {
+	i := mostSpecific(len(rules), func(i int) string { return rules[i].pattern }, urlPath)
+	if i < 0 {
+		return nil
+	}
+	return &rules[i]
+}
+
+// setCacheControl sets Cache-Control for a response serving urlPath: a
+// matching rule takes precedence over fingerprinted assets being
+// immutable, which takes precedence over the default CacheControl.
+func (s *Server) setCacheControl(h http.Header, urlPath string, snap *siteSnapshot) {
+	if rule := s.cacheRules.match(urlPath); rule != nil {
+		h.Set("Cache-Control", rule.value)
+	} else if snap.immutable[rootedPath(urlPath)] {
+		h.Set("Cache-Control", immutableCacheControl)
+	} else if s.CacheControl != "" {
+		h.Set("Cache-Control", s.CacheControl)
+	}
+}
+
+// noTransform reports whether the Cache-Control header set in h asks
+// for the representation not to be transformed, which marb takes as
+// not compressing it either.
+func noTransform(h http.Header) bool {
+	cacheControl := h.Get("Cache-Control")
+	if !strings.Contains(cacheControl, "no-transform") {
+		return false
+	}
+	for _, directive := range strings.Split(cacheControl, ",") {
+		if strings.TrimSpace(directive) == "no-transform" {
+			return true
+		}
+	}
+	return false
+}
+
+// stripValidators reports whether the response to r must carry no
+// validators.
+func (s *Server) stripValidators(r *http.Request) bool {
+	rule := s.cacheRules.match(r.URL.Path)
+	return rule != nil && rule.stripValidators
+}
+
+// setHeaders sets the headers describing f in the response to r.
+func (s *Server) setHeaders(h http.Header, r *http.Request, f *siteFile, encoding string) {
+	f.SetHeaders(h, encoding)
+	if s.stripValidators(r) {
+		h.Del("Last-Modified")
+		h.Del("ETag")
+	}
+	if s.SRIHeader && f.sri != "" {
+		h.Set("X-SRI", f.sri)
+	}
+	if f.preload != "" {
+		h.Set("Link", f.preload)
+	}
+	s.setCSP(h, f)
+	s.setIsolationHeaders(h, r, isHTML(f), !isHTML(f))
+	s.setReportingHeaders(h, r)
+	if s.timingAllowOrigin != nil {
+		h["Timing-Allow-Origin"] = s.timingAllowOrigin
+	}
+	f.setMetaHeaders(h)
+}
@@ -0,0 +1,196 @@
+package marb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNoTransform(t *testing.T) {
+	page := strings.Repeat("<p>The same paragraph, over and over.</p>\n", 50)
+	s := newTestServer(t, Config{CacheRules: []string{"/raw/*=public, max-age=60, no-transform"}}, map[string]string{
+		"page.html":                    page,
+		"raw/page.html":                page,
+		"meta.html":                    page,
+		"meta.html.marbmeta":           `{"cacheControl": "no-transform"}`,
+		"no-transformer.html":          page,
+		"no-transformer.html.marbmeta": `{"cacheControl": "public, x-no-transformer"}`,
+	})
+
+	for _, tt := range []struct {
+		path     string
+		encoding string
+	}{
+		{"/page.html", "gzip"},
+		{"/raw/page.html", ""},
+		{"/meta.html", ""},
+		{"/no-transformer.html", "gzip"},
+	} {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+		if got := rec.Header().Get("Content-Encoding"); got != tt.encoding {
+			t.Errorf("%s: Content-Encoding %q, want %q", tt.path, got, tt.encoding)
+		}
+		if tt.encoding == "" && rec.Body.String() != page {
+			t.Errorf("%s: body isn't the identity bytes", tt.path)
+		}
+	}
+}
+
+func TestNoTransformDirective(t *testing.T) {
+	for value, want := range map[string]bool{
+		"no-transform":                    true,
+		"public, no-transform, max-age=1": true,
+		"public,no-transform":             true,
+		"x-no-transform":                  false,
+		"no-transformation":               false,
+		"":                                false,
+	} {
+		if got := noTransform(http.Header{"Cache-Control": {value}}); got != want {
+			t.Errorf("noTransform(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
+
+func TestParseCacheControlExtensions(t *testing.T) {
+	for _, tt := range []struct {
+		value, want string
+	}{
+		{"public, max-age=60, stale-while-revalidate=30", "public, max-age=60, stale-while-revalidate=30"},
+		{"Max-Age=1m, Stale-If-Error=86400", "max-age=60, stale-if-error=86400"},
+		{`private="Set-Cookie", x-ext="a \"quoted\" value"`, `private="Set-Cookie", x-ext="a \"quoted\" value"`},
+		{"immutable, x-flag", "immutable, x-flag"},
+		{"x-ext=a b", ""},
+		{`x-ext="unterminated`, ""},
+		{`x-ext="escaped end\"`, ""},
+		{"x(ext)=1", ""},
+		{"x-ext=1, x-ext=2", ""},
+		{"public=yes", ""},
+		{"max-age=soon", ""},
+	} {
+		got, err := parseCacheControl(tt.value)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%q: accepted as %q", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %q, %v, want %q", tt.value, got, err, tt.want)
+		}
+	}
+
+	// extensions reach the header as given
+	s := newTestServer(t, Config{CacheRules: []string{"/*=max-age=60, stale-while-revalidate=600"}}, map[string]string{"index.html": "home"})
+	if got := get(s, "/").Header().Get("Cache-Control"); got != "max-age=60, stale-while-revalidate=600" {
+		t.Errorf("Cache-Control %q", got)
+	}
+}
+
+func TestTimingAllowOrigin(t *testing.T) {
+	if rec := get(newTestServer(t, Config{}, smallSite), "/"); rec.Header()["Timing-Allow-Origin"] != nil {
+		t.Errorf("Timing-Allow-Origin %q sent unasked", rec.Header()["Timing-Allow-Origin"])
+	}
+
+	s := newTestServer(t, Config{TimingAllowOrigin: []string{"https://rum.example.com", "http://localhost:8080"}}, smallSite)
+	if got := get(s, "/").Header().Get("Timing-Allow-Origin"); got != "https://rum.example.com, http://localhost:8080" {
+		t.Errorf("Timing-Allow-Origin %q", got)
+	}
+
+	for _, origins := range [][]string{{"*"}, {"https://a.example", "*"}} {
+		s, err := New(Config{Root: writeSite(t, smallSite), TimingAllowOrigin: origins})
+		if err != nil {
+			t.Errorf("%q: %v", origins, err)
+			continue
+		}
+		s.Close()
+	}
+	for _, origin := range []string{"example.com", "https://example.com/", "https://example.com/path", "https://example.com?q", "https://"} {
+		if _, err := New(Config{Root: writeSite(t, smallSite), TimingAllowOrigin: []string{origin}}); err == nil {
+			t.Errorf("%q accepted as an origin", origin)
+		}
+	}
+}
+
+func TestCacheRules(t *testing.T) {
+	files := map[string]string{
+		"index.html":           "home",
+		"docs/a/b":             "deep",
+		"docs/guide.pdf":       "%PDF",
+		"docs/guide.html":      "guide",
+		"manifest.json":        `{"app.js": "assets/app.abc123.js"}`,
+		"assets/app.abc123.js": "console.log(1)",
+		"assets/other.js":      "console.log(2)",
+	}
+
+	for _, tt := range []struct {
+		name  string
+		rules []string
+		path  string
+		want  string
+	}{
+		{"none matching", []string{"/docs/*=max-age=1"}, "/", "no-cache"},
+		{"literal beats wildcards", []string{"/*/*/*=max-age=1", "/docs=max-age=2"}, "/docs/a/b", "max-age=2"},
+		{"literal beats wildcards given last", []string{"/docs=max-age=2", "/*/*/*=max-age=1"}, "/docs/a/b", "max-age=2"},
+		{"extension beats directory", []string{"/docs/*=max-age=1", "/docs/*.pdf=max-age=2"}, "/docs/guide.pdf", "max-age=2"},
+		{"less specific still applies elsewhere", []string{"/docs/*=max-age=1", "/docs/*.pdf=max-age=2"}, "/docs/guide.html", "max-age=1"},
+		{"character classes not counting", []string{"/docs/guide.[p][d][f]=max-age=1", "/docs/guide.p*=max-age=2"}, "/docs/guide.pdf", "max-age=2"},
+		{"tie goes to the first", []string{"/docs/*=max-age=1", "/*/*.pdf=max-age=2"}, "/docs/guide.pdf", "max-age=1"},
+		{"tie goes to the first reversed", []string{"/*/*.pdf=max-age=2", "/docs/*=max-age=1"}, "/docs/guide.pdf", "max-age=2"},
+		{"immutable asset by default", []string{"/docs/*=max-age=1"}, "/assets/app.abc123.js", immutableCacheControl},
+		{"rule overriding an immutable asset", []string{"/assets/*=no-store"}, "/assets/app.abc123.js", "no-store"},
+		{"rule for other assets", []string{"/assets/other.js=no-store"}, "/assets/app.abc123.js", immutableCacheControl},
+	} {
+		s := newTestServer(t, Config{CacheControl: "no-cache", CacheRules: tt.rules, AssetManifest: "manifest.json"}, files)
+		if got := get(s, tt.path).Header().Get("Cache-Control"); got != tt.want {
+			t.Errorf("%s: %q for %s: Cache-Control %q, want %q", tt.name, tt.rules, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCacheRuleStripValidators(t *testing.T) {
+	s := newTestServer(t, Config{CacheRules: []string{
+		"/once/*=private, no-cache; strip-validators",
+		"/once/kept.txt=no-cache",
+	}}, map[string]string{
+		"once/token.txt": "secret",
+		"once/kept.txt":  "kept",
+	})
+
+	kept := get(s, "/once/kept.txt")
+	lastModified := kept.Header().Get("Last-Modified")
+	if lastModified == "" {
+		t.Fatalf("validators of a more specific rule without strip-validators: %v", kept.Header())
+	}
+
+	rec := get(s, "/once/token.txt")
+	if rec.Header().Get("Cache-Control") != "private, no-cache" {
+		t.Errorf("Cache-Control %q", rec.Header().Get("Cache-Control"))
+	}
+	if v := rec.Header().Get("Last-Modified"); v != "" {
+		t.Errorf("Last-Modified %q sent", v)
+	}
+	if v := rec.Header().Get("ETag"); v != "" {
+		t.Errorf("ETag %q sent", v)
+	}
+
+	// without validators, a conditional request gets the full body
+	r := httptest.NewRequest("GET", "/once/token.txt", nil)
+	r.Header.Set("If-Modified-Since", lastModified)
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK || rec.Body.String() != "secret" {
+		t.Errorf("If-Modified-Since: %d %q, want 200 with the body", rec.Code, rec.Body)
+	}
+
+	r = httptest.NewRequest("GET", "/once/kept.txt", nil)
+	r.Header.Set("If-Modified-Since", lastModified)
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since on a path keeping its validators: %d, want 304", rec.Code)
+	}
+}
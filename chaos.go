@@ -0,0 +1,144 @@
+package marb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chaosHeader marks responses whose behaviour was injected, so that
+// they're never mistaken for real failures.
+const chaosHeader = "X-Marb-Chaos"
+
+// chaosRule injects latency, failures or slow bodies into responses
+// for paths matching pattern. It's written as
+//
+//	PATTERN=delay=200ms&jitter=100ms&fail=0.1&status=503&rate=50KB/s
+//
+// where every option is optional: delay is waited before responding,
+// plus a random extra up to jitter; fail is the probability of
+// answering status (500 by default) instead; rate limits how fast the
+// body is written.
+type chaosRule struct {
+	pattern string
+	spec    string
+	delay   time.Duration
+	jitter  time.Duration
+	fail    float64
+	status  int
+	rate    int64 // bytes per second, 0 if unlimited
+}
+
+func parseChaosRule(rule string) (*chaosRule, error) {
+	pattern, spec, ok := strings.Cut(rule, "=")
+	if !ok || pattern == "" {
+		return nil, fmt.Errorf("chaos rule %q: expected PATTERN=OPTIONS", rule)
+	}
+	c := &chaosRule{pattern: normalizePattern(pattern), spec: spec, status: http.StatusInternalServerError}
+	if _, err := path.Match(c.pattern, ""); err != nil {
+		return nil, fmt.Errorf("chaos rule %q: %v", rule, err)
+	}
+
+	options, err := url.ParseQuery(spec)
+	if err != nil {
+		return nil, fmt.Errorf("chaos rule %q: %v", rule, err)
+	}
+	for key, values := range options {
+		value := values[len(values)-1]
+		switch key {
+		case "delay":
+			c.delay, err = time.ParseDuration(value)
+		case "jitter":
+			c.jitter, err = time.ParseDuration(value)
+		case "fail":
+			c.fail, err = strconv.ParseFloat(value, 64)
+			if err == nil && (c.fail < 0 || c.fail > 1) {
+				err = errors.New("fail must be a probability between 0 and 1")
+			}
+		case "status":
+			c.status, err = strconv.Atoi(value)
+			if err == nil && (c.status < 400 || c.status > 599) {
+				err = errors.New("status must be an error status")
+			}
+		case "rate":
+			c.rate, err = parseRate(value)
+		default:
+			err = fmt.Errorf("unknown option %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("chaos rule %q: %v", rule, err)
+		}
+	}
+	return c, nil
+}
+
+// newChaos returns middleware applying rules, or nil if there are
+// none. Rules are refused unless enable is set too, so that a stray
+// configuration can't break production.
+func newChaos(rules []string, enable bool) (func(http.Handler) http.Handler, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	if !enable {
+		return nil, errors.New("chaos rules are configured but chaos isn't enabled")
+	}
+
+	var parsed []*chaosRule
+	for _, rule := range rules {
+		c, err := parseChaosRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("CHAOS ENABLED: injecting %q on %s", c.spec, c.pattern)
+		parsed = append(parsed, c)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if i := mostSpecific(len(parsed), func(i int) string { return parsed[i].pattern }, r.URL.Path); i >= 0 {
+				parsed[i].serve(w, r, next)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+func (c *chaosRule) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	var injected []string
+
+	delay := c.delay
+	if c.jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(c.jitter)))
+	}
+	if delay > 0 {
+		injected = append(injected, "delay="+delay.String())
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if c.fail > 0 && rand.Float64() < c.fail {
+		w.Header().Set(chaosHeader, strings.Join(append(injected, "status="+strconv.Itoa(c.status)), "; "))
+		http.Error(w, "injected failure", c.status)
+		return
+	}
+
+	if c.rate > 0 {
+		injected = append(injected, "rate="+strconv.FormatInt(c.rate, 10)+"B/s")
+		w = newThrottledWriter(w, c.rate, nil)
+	}
+	if len(injected) > 0 {
+		w.Header().Set(chaosHeader, strings.Join(injected, "; "))
+	}
+	next.ServeHTTP(w, r)
+}
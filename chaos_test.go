@@ -0,0 +1,109 @@
+package marb
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChaosRefusedUnlessEnabled(t *testing.T) {
+	_, err := New(Config{Root: writeSite(t, smallSite), Chaos: []string{"/*=fail=1"}})
+	if err == nil || !strings.Contains(err.Error(), "chaos isn't enabled") {
+		t.Errorf("chaos rules without ChaosEnable: %v", err)
+	}
+
+	// enabling it alone changes nothing
+	if rec := get(newTestServer(t, Config{ChaosEnable: true}, smallSite), "/"); rec.Code != http.StatusOK || rec.Header()[chaosHeader] != nil {
+		t.Errorf("ChaosEnable without rules: %d with %s %q", rec.Code, chaosHeader, rec.Header()[chaosHeader])
+	}
+}
+
+func TestParseChaosRule(t *testing.T) {
+	c, err := parseChaosRule("assets/*=delay=200ms&jitter=100ms&fail=0.25&status=503&rate=50KB/s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := chaosRule{pattern: "/assets/*", spec: "delay=200ms&jitter=100ms&fail=0.25&status=503&rate=50KB/s", delay: 200 * time.Millisecond, jitter: 100 * time.Millisecond, fail: 0.25, status: 503, rate: 50e3}
+	if *c != want {
+		t.Errorf("got %+v, want %+v", *c, want)
+	}
+	if c, err := parseChaosRule("/*=fail=1"); err != nil || c.status != http.StatusInternalServerError {
+		t.Errorf("default status: %+v, %v", c, err)
+	}
+
+	for _, rule := range []string{
+		"/*",
+		"=fail=1",
+		"/[=fail=1",
+		"/*=fail=2",
+		"/*=fail=-0.1",
+		"/*=fail=often",
+		"/*=status=200",
+		"/*=status=600",
+		"/*=delay=soon",
+		"/*=jitter=1",
+		"/*=rate=fast",
+		"/*=color=red",
+		"/*=fail=%zz",
+	} {
+		if _, err := parseChaosRule(rule); err == nil {
+			t.Errorf("%q accepted", rule)
+		}
+	}
+}
+
+func TestChaos(t *testing.T) {
+	log := captureLog(t)
+	s := newTestServer(t, Config{ChaosEnable: true, Chaos: []string{
+		"/assets/*=fail=1&status=503",
+		"/assets/ok.js=rate=1MB/s",
+		"/slow/*=delay=20ms&fail=1",
+		"/late/*=delay=20ms&jitter=10ms",
+	}}, map[string]string{
+		"index.html":    "home",
+		"assets/app.js": "app",
+		"assets/ok.js":  "ok",
+		"slow/page":     "slow",
+		"late/page":     "late",
+	})
+	if !strings.Contains(log.String(), `CHAOS ENABLED: injecting "fail=1&status=503" on /assets/*`) {
+		t.Errorf("rules not logged:\n%s", log)
+	}
+
+	for _, tt := range []struct {
+		path   string
+		status int
+		chaos  string // prefix of the header
+		body   string
+		delay  time.Duration
+	}{
+		{"/", http.StatusOK, "", "home", 0},
+		{"/assets/app.js", http.StatusServiceUnavailable, "status=503", "injected failure\n", 0},
+		// the more specific rule applies
+		{"/assets/ok.js", http.StatusOK, "rate=1000000B/s", "ok", 0},
+		{"/slow/page", http.StatusInternalServerError, "delay=20ms; status=500", "injected failure\n", 20 * time.Millisecond},
+		{"/late/page", http.StatusOK, "delay=", "late", 20 * time.Millisecond},
+	} {
+		start := time.Now()
+		rec := get(s, tt.path)
+		elapsed := time.Since(start)
+		if rec.Code != tt.status || rec.Body.String() != tt.body {
+			t.Errorf("%s: got %d %q, want %d %q", tt.path, rec.Code, rec.Body, tt.status, tt.body)
+		}
+		if got := rec.Header().Get(chaosHeader); !strings.HasPrefix(got, tt.chaos) || tt.chaos == "" && got != "" {
+			t.Errorf("%s: %s %q, want %q", tt.path, chaosHeader, got, tt.chaos)
+		}
+		if elapsed < tt.delay {
+			t.Errorf("%s: answered after %v, want at least %v", tt.path, elapsed, tt.delay)
+		}
+	}
+
+	// the jitter is added to the delay
+	for i := 0; i < 5; i++ {
+		delay, err := time.ParseDuration(strings.TrimPrefix(get(s, "/late/page").Header().Get(chaosHeader), "delay="))
+		if err != nil || delay < 20*time.Millisecond || delay >= 30*time.Millisecond {
+			t.Errorf("delay %v, %v, want between 20ms and 30ms", delay, err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package marb
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// checksumHashes are the algorithms of checksum sidecars, named after
+// their extension.
+var checksumHashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// checksums computes the digests of the file at name, with the
+// algorithms of ChecksumEndpoints, if it matches ChecksumPaths.
+func (s *Server) checksums(name string, contents []byte) map[string]string {
+	if len(s.ChecksumEndpoints) == 0 || len(s.checksumPaths) > 0 && !s.checksumPaths.match(name) {
+		return nil
+	}
+	sums := make(map[string]string, len(s.ChecksumEndpoints))
+	for _, algorithm := range s.ChecksumEndpoints {
+		h := checksumHashes[algorithm]()
+		h.Write(contents)
+		sums[algorithm] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums
+}
+
+// serveChecksum answers requests for the checksum sidecar of a file,
+// which doesn't exist itself, reporting whether it did. The sidecar
+// holds a line in the format of sha256sum and the like, and is cached
+// like its file.
+func (s *Server) serveChecksum(w http.ResponseWriter, r *http.Request, snap *siteSnapshot) bool {
+	ext := path.Ext(r.URL.Path)
+	if ext == "" {
+		return false
+	}
+	basePath := strings.TrimSuffix(r.URL.Path, ext)
+	base := s.resolveFile(snap, basePath)
+	if base == nil || base.checksums[ext[1:]] == "" {
+		return false
+	}
+
+	s.setCacheControl(w.Header(), basePath, snap)
+	if !s.stripValidators(r) {
+		w.Header().Set("Last-Modified", base.lastModified.Format(http.TimeFormat))
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	body := base.checksums[ext[1:]] + "  " + base.name + "\n"
+	writeDynamic(w, r, http.StatusOK, "text/plain; charset=utf-8", []byte(body))
+	return true
+}
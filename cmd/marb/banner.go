@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/0eg/marb"
+)
+
+// features names the optional behaviors turned on by cfg and opts, for
+// the startup banner.
+func features(cfg marb.Config, opts options) []string {
+	var on []string
+	for _, f := range []struct {
+		name string
+		on   bool
+	}{
+		{"tls", opts.TLSCert != ""},
+		{"http3", opts.HTTP3},
+		{"admin", opts.AdminBind != ""},
+		{"force-https", cfg.ForceHTTPS},
+		{"compact", cfg.Compact},
+		{"autoindex", cfg.AutoIndex},
+		{"watch", cfg.Watch},
+		{"livereload", cfg.LiveReload},
+		{"sync", cfg.SyncInterval > 0},
+		{"webhook", cfg.WebhookPath != ""},
+		{"search", cfg.SearchPath != ""},
+		{"routes", cfg.RoutesPath != ""},
+		{"asset-manifest", cfg.AssetManifest != ""},
+		{"csp", cfg.CSP != ""},
+		{"sri", cfg.SRI || cfg.SRIHeader},
+		{"fallback-proxy", cfg.FallbackProxy != ""},
+		{"purge", cfg.PurgeURL != ""},
+		{"statsd", cfg.StatsdAddr != ""},
+		{"nel", cfg.NELReportURL != ""},
+		{"throttle", len(cfg.Throttle) > 0},
+		{"chaos", cfg.ChaosEnable},
+		{"maintenance", cfg.Maintenance},
+	} {
+		if f.on {
+			on = append(on, f.name)
+		}
+	}
+	return on
+}
+
+// logBanner logs what the server is about to serve and how, once its
+// files are loaded, followed by the warnings found loading them.
+func logBanner(cfg marb.Config, opts options, stats marb.ReloadStats, warnings []marb.Warning) {
+	log.Printf("listening on %s", opts.Bind)
+	if opts.AdminBind != "" {
+		log.Printf("admin API on %s", opts.AdminBind)
+	}
+	log.Printf("root: %s", cfg.Root)
+	log.Printf("files: %d, %d bytes resident", stats.Files, stats.Bytes)
+	if on := features(cfg, opts); len(on) > 0 {
+		log.Printf("features: %s", strings.Join(on, ", "))
+	} else {
+		log.Printf("features: none")
+	}
+	if len(warnings) == 0 {
+		log.Printf("warnings: none")
+		return
+	}
+	log.Printf("warnings: %d", len(warnings))
+	for i, w := range warnings {
+		log.Printf("  %d. [%s] %s", i+1, w.Code, w.Message)
+	}
+}
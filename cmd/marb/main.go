@@ -0,0 +1,499 @@
+// Command marb serves a static site from memory.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/0eg/marb"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+)
+
+// listFlag is a comma separated list of values, which can also be given
+// by repeating the flag.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// repeatedFlag collects the values of a flag given several times, for
+// values that may contain commas.
+type repeatedFlag []string
+
+func (r *repeatedFlag) String() string {
+	return strings.Join(*r, " ")
+}
+
+func (r *repeatedFlag) Set(value string) error {
+	*r = append(*r, value)
+	return nil
+}
+
+// fdReserve accounts for stdio, the listener and whatever else the
+// process keeps open regardless of load.
+const fdReserve = 16
+
+// checkFileLimit warns when the open file limit looks too low to hold
+// the expected connections while a reload is running.
+func checkFileLimit(conns int, workers int) {
+	limit, ok := fileLimit()
+	if !ok {
+		return
+	}
+
+	want := uint64(conns + workers + fdReserve)
+	if limit < want {
+		log.Printf("warning: open file limit is %d, but up to %d descriptors may be needed (%d connections + %d loader workers); consider ulimit -n %d", limit, want, conns, workers, want)
+	}
+}
+
+// options are the settings of the command that aren't part of the
+// server configuration.
+type options struct {
+	Bind                 string
+	AdminBind            string
+	TLSCert              string
+	TLSKey               string
+	TLSPlaintextRedirect bool
+	HTTP3                bool
+	ExpectedConns        int
+	ShutdownTimeout      time.Duration
+	H1IdleTimeout        time.Duration
+	H2IdleTimeout        time.Duration
+	Predrain             time.Duration
+	DumpConfig           bool
+	Check                bool
+	FailOnWarning        bool
+}
+
+// fieldFlags defines flags setting the fields of the configuration and
+// options, remembering which field each one sets to tell where values
+// came from.
+type fieldFlags map[string]string // flag name to field name
+
+func (ff fieldFlags) string(p *string, field, name, value, usage string) {
+	flag.StringVar(p, name, value, usage)
+	ff[name] = field
+}
+
+func (ff fieldFlags) bool(p *bool, field, name string, value bool, usage string) {
+	flag.BoolVar(p, name, value, usage)
+	ff[name] = field
+}
+
+func (ff fieldFlags) int(p *int, field, name string, value int, usage string) {
+	flag.IntVar(p, name, value, usage)
+	ff[name] = field
+}
+
+func (ff fieldFlags) int64(p *int64, field, name string, value int64, usage string) {
+	flag.Int64Var(p, name, value, usage)
+	ff[name] = field
+}
+
+func (ff fieldFlags) float64(p *float64, field, name string, value float64, usage string) {
+	flag.Float64Var(p, name, value, usage)
+	ff[name] = field
+}
+
+func (ff fieldFlags) duration(p *time.Duration, field, name string, value time.Duration, usage string) {
+	flag.DurationVar(p, name, value, usage)
+	ff[name] = field
+}
+
+func (ff fieldFlags) list(p *[]string, field, name, usage string) {
+	flag.Var((*listFlag)(p), name, usage)
+	ff[name] = field
+}
+
+func (ff fieldFlags) repeated(p *[]string, field, name, usage string) {
+	flag.Var((*repeatedFlag)(p), name, usage)
+	ff[name] = field
+}
+
+// defineFlags binds the command line flags to cfg and opts.
+func defineFlags(cfg *marb.Config, opts *options) fieldFlags {
+	ff := make(fieldFlags)
+
+	ff.string(&opts.Bind, "Bind", "bind", "0.0.0.0:7890", "the address to bind to")
+	ff.string(&cfg.Root, "Root", "root", "/var/www/", "the root directory to serve files from, or a single file to serve")
+	ff.string(&cfg.NotFound, "NotFound", "404", "", "fallback file on error 404, relative to the root")
+	ff.string(&cfg.RootFallback, "RootFallback", "root-fallback", "", "file served at / when the root has no index, relative to the root, or \"welcome\" for a built-in page")
+	ff.string(&cfg.Index, "Index", "index", "index.html", "index file name")
+	ff.string(&cfg.IndexMode, "IndexMode", "index-mode", "redirect", "redirect requests naming an index file to its directory, or serve them")
+	ff.bool(&cfg.ForceHTTPS, "ForceHTTPS", "https", false, "force HTTPS, based on X-Forwarded-Proto header")
+	ff.int(&cfg.HTTPSPort, "HTTPSPort", "https-port", 443, "port HTTPS is served on, which redirects to HTTPS use in place of the port of the request unless -name is set")
+	ff.string(&cfg.Name, "Name", "name", "", "server name, used for HTTPS redirects (e.g example.com)")
+	ff.string(&cfg.AddrHeader, "AddrHeader", "addrHeader", "", "HTTP header which contains the client address")
+	ff.bool(&cfg.NoCanonicalSlashes, "NoCanonicalSlashes", "no-canonical-slashes", false, "serve paths with repeated slashes or dot segments as is, rather than redirecting them to their clean form")
+	ff.bool(&cfg.CanonicalSlashes, "CanonicalSlashes", "canonical-slashes", false, "deprecated, paths are canonicalized by default")
+	ff.int(&cfg.IndexRedirectCode, "IndexRedirectCode", "index-redirect-code", 301, "status of redirects from index files to their directory and from directories to their trailing slash: 301, 302, 303, 307 or 308")
+	ff.int(&cfg.HTTPSRedirectCode, "HTTPSRedirectCode", "https-redirect-code", 301, "status of redirects to HTTPS: 301, 302, 303, 307 or 308")
+	ff.int(&cfg.CanonicalRedirectCode, "CanonicalRedirectCode", "canonical-redirect-code", 301, "status of redirects to canonical paths: 301, 302, 303, 307 or 308")
+	ff.bool(&cfg.SingleFileAtName, "SingleFileAtName", "single-file-at-name", false, "when the root is a single file, serve it at its name and redirect / there rather than the other way around")
+	ff.bool(&cfg.Compact, "Compact", "compact", false, "keep only the gzipped version of compressible files to save memory")
+	ff.bool(&cfg.Brotli, "Brotli", "brotli", false, "also compress files with Brotli at load time, sending that version to clients preferring it")
+	ff.bool(&cfg.NoRangeDecompress, "NoRangeDecompress", "no-range-decompress", false, "in compact mode, ignore Range on gzipped files instead of decompressing them")
+	ff.bool(&cfg.AutoIndex, "AutoIndex", "autoindex", false, "list the contents of directories without an index")
+	ff.string(&cfg.NotFoundCacheControl, "NotFoundCacheControl", "404-cache-control", "", "Cache-Control header of 404 responses, and of files given an error status by their metadata (e.g public, max-age=60)")
+	ff.duration(&cfg.NotFoundMaxAge, "NotFoundMaxAge", "404-max-age", 0, "let caches keep 404 responses, and files given an error status by their metadata, this long, as with -404-cache-control \"public, max-age=...\"")
+	ff.duration(&cfg.ModTimeSkew, "ModTimeSkew", "modtime-skew", 0, "only answer 304 to If-Modified-Since dates at least this much later than the modification time, for clients with early clocks")
+	ff.string(&cfg.CacheControl, "CacheControl", "cache-control", "", "default Cache-Control header of files")
+	ff.string(&cfg.AssetManifest, "AssetManifest", "asset-manifest", "", "JSON manifest mapping logical asset names to fingerprinted ones, or Vite manifest, relative to the root")
+	ff.bool(&cfg.AssetPreload, "AssetPreload", "asset-preload", false, "send HTML entries of a Vite -asset-manifest with a Link header preloading their scripts and stylesheets")
+	ff.bool(&cfg.ServeAssetManifest, "ServeAssetManifest", "serve-asset-manifest", false, "serve the -asset-manifest file, which is hidden otherwise")
+	ff.string(&cfg.DefaultMIME, "DefaultMIME", "default-mime", "", "content type of files whose type neither their extension nor their contents tell (e.g text/plain; charset=utf-8)")
+	ff.bool(&cfg.StrictMIME, "StrictMIME", "strict-mime", false, "fail loading when the content type of files is sniffed from their contents, listing them")
+	ff.list(&cfg.StrictMIMEAllow, "StrictMIMEAllow", "strict-mime-allow", "comma separated extensions whose files may have a sniffed content type with -strict-mime (e.g .bin,.dat)")
+	ff.int64(&cfg.TarDownloadMaxSize, "TarDownloadMaxSize", "tar-download-max-size", 1<<30, "largest total size of the files of a directory downloaded as an archive, in bytes")
+	ff.string(&cfg.EncodingHintHeader, "EncodingHintHeader", "encoding-hint-header", "", "header that proxies stripping Accept-Encoding set instead, read in addition to it (e.g X-Accept-Encoding)")
+	ff.bool(&cfg.StrictEncoding, "StrictEncoding", "strict-encoding", false, "answer 406 to requests whose Accept-Encoding refuses every encoding a file is available in, identity included")
+	ff.bool(&cfg.NoSuggestions, "NoSuggestions", "no-suggestions", false, "don't suggest existing paths close to missing ones on 404s")
+	ff.string(&cfg.CSP, "CSP", "csp", "", "Content-Security-Policy of HTML files, __CSP_NONCE__ being replaced with a fresh nonce per request in it and in the files")
+	ff.bool(&cfg.SRI, "SRI", "sri", false, "compute the Subresource Integrity value of files, listed by the admin API on /_sri")
+	ff.bool(&cfg.SRIHeader, "SRIHeader", "sri-header", false, "send the Subresource Integrity value of files in the X-SRI header, implies -sri")
+	ff.bool(&cfg.Watch, "Watch", "watch", false, "development mode: reload the root whenever files change, until a tarball is deployed through the admin API")
+	ff.duration(&cfg.WatchInterval, "WatchInterval", "watch-interval", time.Second, "how often -watch looks for changes")
+	ff.bool(&cfg.LiveReload, "LiveReload", "livereload", false, "with -watch, make HTML pages reload themselves on changes")
+	ff.string(&cfg.MaxTotalSize, "MaxTotalSize", "max-total-size", "", "most memory the files may take, gzipped versions included, beyond which loading fails (e.g 1GB)")
+	ff.string(&cfg.MaxTotalSizeAction, "MaxTotalSizeAction", "max-total-size-action", "fail", "what exceeding -max-total-size does, fail or warn")
+	ff.bool(&cfg.NoSecretScan, "NoSecretScan", "no-secret-scan", false, "don't warn about files that look like they hold secrets, like .env files or private keys")
+	ff.bool(&cfg.StrictSecretScan, "StrictSecretScan", "strict-secret-scan", false, "refuse to serve files that look like they hold secrets instead of warning about them")
+	ff.bool(&cfg.Strict, "Strict", "strict", false, "fail loading on problems otherwise worked around, like corrupt .gz sidecars")
+	ff.int(&cfg.MaxPathDepth, "MaxPathDepth", "max-path-depth", 0, "most levels of directories files are loaded from and looked up in, 0 meaning no limit")
+	ff.int(&cfg.LoadWorkers, "LoadWorkers", "load-workers", 0, "number of files read concurrently while loading, 0 means one per CPU")
+	ff.int(&opts.ExpectedConns, "ExpectedConns", "expected-conns", 256, "expected concurrent connections, used to sanity check the open file limit")
+	ff.string(&cfg.RoutesPath, "RoutesPath", "routes-path", "", "path serving a JSON array of all the paths of the site, for prefetching (e.g /_routes.json)")
+	ff.bool(&cfg.RoutesAuth, "RoutesAuth", "routes-auth", false, "require an admin token for -routes-path")
+	ff.string(&cfg.SearchPath, "SearchPath", "search-path", "", "path answering ?q=words with the HTML pages holding them, in JSON, from an index built at load time (e.g /_search)")
+	ff.list(&cfg.HealthcheckPaths, "HealthcheckPaths", "healthcheck-path", "comma separated paths /readyz checks are served from memory, can be repeated (e.g /index.html)")
+	ff.int(&cfg.ReadyzMinFiles, "ReadyzMinFiles", "readyz-min-files", 0, "number of files below which /readyz fails")
+	ff.duration(&opts.ShutdownTimeout, "ShutdownTimeout", "shutdown-timeout", 30*time.Second, "how long in-flight requests may take to finish on SIGTERM or SIGINT")
+	ff.duration(&opts.H1IdleTimeout, "H1IdleTimeout", "h1-idle-timeout", time.Minute, "how long an idle HTTP/1.1 keep-alive connection is kept open, 0 for as long as the client wants")
+	ff.duration(&opts.H2IdleTimeout, "H2IdleTimeout", "h2-idle-timeout", 5*time.Minute, "how long an HTTP/2 connection without streams is kept open, 0 for as long as -h1-idle-timeout")
+	ff.duration(&opts.Predrain, "Predrain", "predrain", 0, "how long health checks fail on SIGTERM or SIGINT before connections stop being accepted (e.g 10s)")
+	ff.bool(&opts.DumpConfig, "DumpConfig", "dump-config", false, "print the effective configuration as JSON, with where each value came from, and exit")
+	ff.bool(&opts.Check, "Check", "check", false, "load the root, print the warnings found and exit, with status 1 if loading fails")
+	ff.bool(&opts.FailOnWarning, "FailOnWarning", "fail-on-warning", false, "exit with status 1 when loading the root at startup, or with -check, finds any warning")
+
+	ff.string(&cfg.WebhookPath, "WebhookPath", "webhook-path", "", "path of the deploy webhook triggering a reload (e.g /_hooks/deploy)")
+	ff.string(&cfg.WebhookSecret, "WebhookSecret", "webhook-secret", "", "shared secret for webhook signatures, defaults to $MARB_WEBHOOK_SECRET")
+	ff.int64(&cfg.WebhookMaxBody, "WebhookMaxBody", "webhook-max-body", 1<<20, "maximum webhook request body size, in bytes")
+	ff.duration(&cfg.WebhookInterval, "WebhookInterval", "webhook-interval", 10*time.Second, "minimum average interval between webhook requests")
+	ff.duration(&cfg.WebhookWindow, "WebhookWindow", "webhook-window", 10*time.Minute, "how long webhook deliveries are remembered for replay protection")
+	ff.duration(&cfg.ReloadDebounce, "ReloadDebounce", "reload-debounce", 0, "wait this long for reload triggers firing together to share one reload")
+	ff.bool(&cfg.DeployIDHeader, "DeployIDHeader", "deploy-id-header", false, "send the generation of the files served, counting successful reloads, in an X-Deploy-Id header")
+	ff.int(&cfg.ReloadHistory, "ReloadHistory", "reload-history", 20, "number of past reloads reported by the admin API on /reloads")
+	ff.int(&cfg.ReloadReportPaths, "ReloadReportPaths", "reload-report-paths", 100, "maximum number of added, changed and removed paths listed by each reload report")
+	ff.duration(&cfg.SyncInterval, "SyncInterval", "sync-interval", 0, "reload the root periodically, e.g 5m for buckets, or the tarball deployed through the admin API instead once there is one; 0 disables it")
+
+	ff.string(&opts.AdminBind, "AdminBind", "admin-bind", "", "the address to bind the admin API to (e.g 127.0.0.1:7891), disabled if empty")
+	ff.string(&cfg.AdminToken, "AdminToken", "admin-token", "", "bearer token required by the admin API, defaults to $MARB_ADMIN_TOKEN")
+	ff.int64(&cfg.MaxDecompressedSize, "MaxDecompressedSize", "max-decompressed-size", 1<<30, "largest size of a deployed tarball once decompressed, per entry and in total, in bytes")
+	ff.string(&cfg.LogLevel, "LogLevel", "log-level", "info", "log level: debug, info or error, at which requests aren't logged")
+	ff.bool(&cfg.DebugHeaders, "DebugHeaders", "debug-headers", false, "tell which file answered in X-Marb-File and X-Marb-Encoding response headers")
+	ff.bool(&cfg.Maintenance, "Maintenance", "maintenance", false, "answer 503 to every request")
+	ff.bool(&cfg.LoadInBackground, "LoadInBackground", "load-in-background", false, "start listening before the files are loaded, answering 503 until they are")
+	ff.duration(&cfg.LoadingRetryAfter, "LoadingRetryAfter", "loading-retry-after", 5*time.Second, "Retry-After of the 503s answered while loading in the background")
+	ff.string(&cfg.MaintenanceRetryAfter, "MaintenanceRetryAfter", "maintenance-retry-after", "", "tell clients to come back after this `duration` or RFC1123 date in maintenance mode")
+	ff.int64(&cfg.DeployMaxSize, "DeployMaxSize", "deploy-max-size", 256<<20, "largest tarball accepted by the admin API deploy endpoint, which requires an admin token, in bytes; the deployed tarball replaces the root for later reloads, -sync-interval and -watch included, until restart")
+
+	ff.string(&cfg.SecurityExpires, "SecurityExpires", "security-expires", "", "expiry of the generated security.txt, as an RFC 3339 time or a duration from load time (e.g 2160h)")
+
+	ff.string(&cfg.FallbackProxy, "FallbackProxy", "fallback-proxy", "", "origin to forward requests for missing paths to (e.g https://legacy.internal)")
+	ff.duration(&cfg.FallbackTimeout, "FallbackTimeout", "fallback-timeout", 30*time.Second, "connect and response header timeout of the fallback proxy")
+	ff.int(&cfg.FallbackMaxFailures, "FallbackMaxFailures", "fallback-max-failures", 5, "consecutive fallback proxy failures after which local 404s are served instead")
+	ff.duration(&cfg.FallbackCooldown, "FallbackCooldown", "fallback-cooldown", 30*time.Second, "how long the fallback origin is left alone after it failed")
+	ff.int(&cfg.StreamBufferSize, "StreamBufferSize", "stream-buffer-size", 32<<10, "size in bytes of the buffer responses of the fallback proxy are streamed through")
+
+	ff.string(&cfg.StatsdAddr, "StatsdAddr", "statsd-addr", "", "host:port of a StatsD agent to send request metrics to over UDP (e.g 127.0.0.1:8125)")
+	ff.string(&cfg.StatsdPrefix, "StatsdPrefix", "statsd-prefix", "marb.", "prefix of the StatsD metric names")
+	ff.list(&cfg.StatsdTags, "StatsdTags", "statsd-tags", "comma separated DogStatsD tags of the StatsD metrics (e.g env:prod,site:docs)")
+	ff.string(&cfg.PurgeURL, "PurgeURL", "purge-url", "", "CDN API endpoint asked to purge the URLs changed by reloads")
+	ff.string(&cfg.PurgeToken, "PurgeToken", "purge-token", "", "CDN API token, defaults to $MARB_PURGE_TOKEN")
+	ff.string(&cfg.PurgeStyle, "PurgeStyle", "purge-style", "cloudflare", "CDN API style, cloudflare or fastly")
+	ff.string(&cfg.PurgeBaseURL, "PurgeBaseURL", "purge-base-url", "", "public URL of the site, prefixed to purged paths (e.g https://example.com)")
+	ff.int(&cfg.PurgeBatch, "PurgeBatch", "purge-batch", 30, "maximum number of URLs per purge request")
+
+	ff.string(&cfg.NELReportURL, "NELReportURL", "nel-report-url", "", "https URL browsers are asked to report network errors to with NEL")
+	ff.duration(&cfg.NELMaxAge, "NELMaxAge", "nel-max-age", 24*time.Hour, "how long browsers keep the NEL policy")
+	ff.bool(&cfg.NELIncludeSubdomains, "NELIncludeSubdomains", "nel-include-subdomains", false, "apply the NEL policy to subdomains too")
+	ff.float64(&cfg.NELSuccessFraction, "NELSuccessFraction", "nel-success-fraction", 0, "fraction of successful requests reported with NEL")
+	ff.float64(&cfg.NELFailureFraction, "NELFailureFraction", "nel-failure-fraction", 1, "fraction of failed requests reported with NEL")
+
+	ff.string(&opts.TLSCert, "TLSCert", "tls-cert", "", "TLS certificate file, serving HTTPS if set along with -tls-key")
+	ff.string(&opts.TLSKey, "TLSKey", "tls-key", "", "TLS private key file")
+	ff.bool(&opts.TLSPlaintextRedirect, "TLSPlaintextRedirect", "tls-plaintext-redirect", false, "redirect plain HTTP requests sent to the TLS port to HTTPS instead of refusing them")
+	ff.bool(&opts.HTTP3, "HTTP3", "http3", false, "also serve HTTP/3 over QUIC on the UDP port of -bind, advertised with Alt-Svc; requires -tls-cert")
+
+	ff.duration(&cfg.ConcurrencyWait, "ConcurrencyWait", "limit-concurrency-wait", 0, "how long requests over a -limit-concurrency limit wait for their turn before getting a 503")
+	ff.string(&cfg.ThrottleGlobal, "ThrottleGlobal", "throttle-global", "", "rate shared by all the responses throttled by -throttle-path, e.g 10MB/s")
+
+	ff.bool(&cfg.ChaosEnable, "ChaosEnable", "chaos-enable", false, "allow the -chaos rules to take effect; never set this in production")
+
+	ff.bool(&cfg.RejectSuspiciousPaths, "RejectSuspiciousPaths", "reject-suspicious-paths", false, "answer 400 to requests for paths holding null bytes, backslashes or other control characters")
+	ff.string(&cfg.MinHTTPVersion, "MinHTTPVersion", "min-http-version", "", "answer 505 to requests made with an older version of HTTP, health checks included (e.g 1.1)")
+	ff.int64(&cfg.MaxIgnoredBody, "MaxIgnoredBody", "max-ignored-body", 4<<10, "largest body accepted, and dropped, on GET, HEAD and OPTIONS requests")
+
+	ff.list(&cfg.HTTPSExempt, "HTTPSExempt", "https-exempt", "comma separated glob patterns of paths served over HTTP even when forcing HTTPS (e.g /healthz)")
+	ff.duration(&cfg.LogOnlySlow, "LogOnlySlow", "log-only-slow", 0, "only log requests taking this long or more, with timing details (e.g 1s)")
+	ff.list(&cfg.LogExclude, "LogExclude", "log-exclude", "comma separated glob patterns of paths served without being logged (e.g /favicon.ico)")
+	ff.list(&cfg.HostLogs, "HostLogs", "host-log", "comma separated HOST=FILE access logs of virtual hosts, reopened on SIGUSR1; other hosts are logged to stderr")
+	ff.list(&cfg.AdminTokens, "AdminTokens", "admin-tokens", "comma separated ID=TOKEN admin tokens, the ID telling who made changes")
+	ff.list(&cfg.SecurityContacts, "SecurityContacts", "security-contact", "comma separated contacts of the generated /.well-known/security.txt, used when the site has none")
+	ff.list(&cfg.FallbackHeaders, "FallbackHeaders", "fallback-headers", "comma separated request headers forwarded by the fallback proxy, all if empty")
+	ff.list(&cfg.FallbackExclude, "FallbackExclude", "fallback-exclude", "comma separated glob patterns of paths never forwarded to the fallback proxy")
+	ff.list(&cfg.ChecksumEndpoints, "ChecksumEndpoints", "checksum-endpoints", "comma separated algorithms, sha256 or sha512, of the checksum files like /file.sha256 synthesized for files")
+	ff.list(&cfg.ChecksumPaths, "ChecksumPaths", "checksum-path", "comma separated glob patterns of the files -checksum-endpoints applies to, all if empty (e.g /releases/*)")
+	ff.list(&cfg.CrossOriginIsolation, "CrossOriginIsolation", "cross-origin-isolation", "comma separated glob patterns of paths served cross-origin isolated, with COOP and COEP on HTML and CORP on the rest (e.g / for the whole site)")
+	ff.list(&cfg.TimingAllowOrigin, "TimingAllowOrigin", "timing-allow-origin", "comma separated origins allowed to read the resource timing details of files, or * for any, sent as Timing-Allow-Origin")
+	ff.list(&cfg.CORPCrossOrigin, "CORPCrossOrigin", "corp-cross-origin", "comma separated glob patterns of isolated paths that other sites may embed, sent with Cross-Origin-Resource-Policy: cross-origin")
+	ff.list(&cfg.TarDownloads, "TarDownloads", "tar-download", "comma separated glob patterns of directories that can be downloaded as a tar archive with ?download=tar or ?download=tar.gz (e.g /photos/*)")
+	ff.list(&cfg.ConcurrencyLimits, "ConcurrencyLimits", "limit-concurrency", "comma separated PATTERN=N rules capping the requests served at once for matching paths, e.g /downloads/*=8")
+	ff.list(&cfg.Throttle, "Throttle", "throttle-path", "comma separated PATTERN=RATE rules pacing responses, e.g /downloads/*=2MB/s")
+	ff.repeated(&cfg.CacheRules, "CacheRules", "cache-rule", "PATTERN=VALUE Cache-Control rule, optionally followed by \"; strip-validators\", can be repeated (e.g '/account/*=no-store')")
+	ff.list(&cfg.Chaos, "Chaos", "chaos", "comma separated fault injection rules for testing, like /assets/*=delay=200ms&jitter=100ms&fail=0.1&status=503&rate=50KB/s")
+
+	return ff
+}
+
+// envDefaults are the environment variables secrets are read from when
+// not given as flags, by field name.
+var envDefaults = []struct{ field, env string }{
+	{"WebhookSecret", "MARB_WEBHOOK_SECRET"},
+	{"AdminToken", "MARB_ADMIN_TOKEN"},
+	{"PurgeToken", "MARB_PURGE_TOKEN"},
+}
+
+// dumpConfig prints the effective configuration along with the options
+// of the command.
+func dumpConfig(cfg marb.Config, opts options) error {
+	dump := cfg.Dump()
+	v := reflect.ValueOf(opts)
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		source := cfg.Sources[name]
+		if source == "" {
+			source = marb.SourceDefault
+		}
+		dump[name] = marb.ConfigValue{Value: v.Field(i).Interface(), Source: source}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(dump)
+}
+
+// advertiseHTTP3 advertises h3 to HTTP/1.1 and HTTP/2 clients of next
+// with Alt-Svc, once its UDP listener is up.
+func advertiseHTTP3(h3 *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h3.SetQUICHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newHTTPServer returns the server of the main listener. OPTIONS * is
+// answered by marb, with the methods it allows. HTTP/2 multiplexes
+// requests over one connection per client, which can stay idle longer
+// than the many HTTP/1.1 ones.
+func newHTTPServer(handler http.Handler, opts options) (*http.Server, error) {
+	httpServer := &http.Server{Handler: handler, DisableGeneralOptionsHandler: true, IdleTimeout: opts.H1IdleTimeout}
+	if err := http2.ConfigureServer(httpServer, &http2.Server{IdleTimeout: opts.H2IdleTimeout}); err != nil {
+		return nil, err
+	}
+	return httpServer, nil
+}
+
+func main() {
+	var (
+		cfg  marb.Config
+		opts options
+	)
+	fields := defineFlags(&cfg, &opts)
+	flag.Parse()
+
+	cfg.Sources = make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		cfg.Sources[fields[f.Name]] = marb.SourceFlag
+	})
+	for _, d := range envDefaults {
+		field := reflect.ValueOf(&cfg).Elem().FieldByName(d.field)
+		if value := os.Getenv(d.env); field.String() == "" && value != "" {
+			field.SetString(value)
+			cfg.Sources[d.field] = marb.SourceEnv
+		}
+	}
+
+	if opts.DumpConfig {
+		if err := dumpConfig(cfg, opts); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	checkFileLimit(opts.ExpectedConns, cfg.Workers())
+
+	if opts.Check {
+		cfg.LoadInBackground = false
+	}
+	// the startup banner waits for the files, which may be loaded in
+	// the background
+	loaded := make(chan marb.ReloadStats, 1)
+	cfg.OnReload = func(stats marb.ReloadStats) {
+		select {
+		case loaded <- stats:
+		default:
+		}
+	}
+	srv, err := marb.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if opts.Check {
+		warnings := srv.Warnings()
+		for _, w := range warnings {
+			fmt.Println("warning:", w)
+		}
+		fmt.Printf("%s: ok, %d warnings\n", cfg.Root, len(warnings))
+		if opts.FailOnWarning && len(warnings) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			srv.Reload()
+		}
+	}()
+
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			srv.ReopenLogs()
+		}
+	}()
+
+	if opts.AdminBind != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(opts.AdminBind, srv.AdminHandler()))
+		}()
+	}
+
+	if opts.HTTP3 && (opts.TLSCert == "" || opts.TLSKey == "") {
+		log.Fatal("-http3 requires -tls-cert and -tls-key")
+	}
+
+	l, err := net.Listen("tcp", opts.Bind)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var handler http.Handler = srv
+	var h3 *http3.Server
+	if opts.TLSCert != "" || opts.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TLSCert, opts.TLSKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsConfig := &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+		}
+		l = marb.NewTLSListener(l, tlsConfig, opts.TLSPlaintextRedirect)
+
+		if opts.HTTP3 {
+			h3 = &http3.Server{
+				Addr:      opts.Bind,
+				Handler:   srv,
+				TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+			}
+			go func() {
+				if err := h3.ListenAndServe(); err != http.ErrServerClosed {
+					log.Fatal(err)
+				}
+			}()
+			handler = advertiseHTTP3(h3, srv)
+		}
+	}
+
+	// Files loaded in the foreground are checked before any request is
+	// served.
+	banner := func() {
+		stats := <-loaded
+		warnings := srv.Warnings()
+		logBanner(cfg, opts, stats, warnings)
+		if opts.FailOnWarning && len(warnings) > 0 {
+			log.Fatalf("exiting on %d warnings, as -fail-on-warning is set", len(warnings))
+		}
+	}
+	if cfg.LoadInBackground {
+		go banner()
+	} else {
+		banner()
+	}
+
+	// On SIGTERM or SIGINT, fail health checks while still serving for
+	// the predrain window, then stop accepting connections and let
+	// in-flight requests finish before exiting. A second signal exits
+	// right away, which helps with live reload streams in development.
+	httpServer, err := newHTTPServer(handler, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	done := make(chan struct{})
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-term
+		go func() {
+			<-term
+			log.Fatal("interrupted while shutting down")
+		}()
+		srv.StartShutdown()
+		if opts.Predrain > 0 {
+			log.Printf("shutting down in %s", opts.Predrain)
+			time.Sleep(opts.Predrain)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), opts.ShutdownTimeout)
+		defer cancel()
+		if h3 != nil {
+			go h3.Shutdown(ctx)
+		}
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+		close(done)
+	}()
+
+	if err := httpServer.Serve(l); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+	srv.Close()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func selfSigned(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestAdvertiseHTTP3(t *testing.T) {
+	site := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})
+	h3 := &http3.Server{
+		Addr:      "127.0.0.1:0",
+		Handler:   site,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{selfSigned(t)}}),
+	}
+	handler := advertiseHTTP3(h3, site)
+
+	// nothing is advertised before QUIC is listened for
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Alt-Svc") != "" {
+		t.Fatalf("before listening: got %d with Alt-Svc %q", rec.Code, rec.Header().Get("Alt-Svc"))
+	}
+
+	go h3.ListenAndServe()
+	t.Cleanup(func() { h3.Close() })
+
+	var altSvc string
+	for deadline := time.Now().Add(5 * time.Second); altSvc == "" && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		altSvc = rec.Header().Get("Alt-Svc")
+	}
+	port, ok := strings.CutPrefix(altSvc, `h3=":`)
+	if !ok {
+		t.Fatalf("Alt-Svc %q, want h3 advertised", altSvc)
+	}
+	port, _, _ = strings.Cut(port, `"`)
+
+	tr := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer tr.Close()
+	resp, err := (&http.Client{Transport: tr, Timeout: 5 * time.Second}).Get("https://127.0.0.1:" + port + "/")
+	if err != nil {
+		t.Fatalf("HTTP/3 request to the advertised port: %v", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "HTTP/3.0" {
+		t.Errorf("served over %q, want HTTP/3.0", body)
+	}
+}
+
+func TestIdleTimeouts(t *testing.T) {
+	site := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})
+	short, long := 100*time.Millisecond, time.Minute
+
+	for _, tt := range []struct {
+		h1, h2 time.Duration
+		proto  string
+		reused bool
+	}{
+		{short, long, "HTTP/1.1", false},
+		{short, long, "HTTP/2.0", true},
+		{long, short, "HTTP/1.1", true},
+		{long, short, "HTTP/2.0", false},
+	} {
+		httpServer, err := newHTTPServer(site, options{H1IdleTimeout: tt.h1, H2IdleTimeout: tt.h2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := httptest.NewUnstartedServer(site)
+		ts.Config = httpServer
+		ts.EnableHTTP2 = tt.proto == "HTTP/2.0"
+		ts.StartTLS()
+
+		var reused bool
+		get := func() string {
+			trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused }}
+			r, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), "GET", ts.URL, nil)
+			resp, err := ts.Client().Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			return string(body)
+		}
+		proto := get()
+		time.Sleep(3 * short)
+		get()
+		ts.Close()
+
+		if proto != tt.proto {
+			t.Fatalf("served over %s, want %s", proto, tt.proto)
+		}
+		if reused != tt.reused {
+			t.Errorf("%s, HTTP/1.1 idle timeout %v, HTTP/2 one %v: connection reused %v after %v idle, want %v", proto, tt.h1, tt.h2, reused, 3*short, tt.reused)
+		}
+	}
+}
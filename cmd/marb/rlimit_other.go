@@ -0,0 +1,7 @@
+//go:build !(aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris)
+
+package main
+
+func fileLimit() (uint64, bool) {
+	return 0, false
+}
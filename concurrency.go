@@ -0,0 +1,105 @@
+package marb
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// concurrencyRule caps how many requests for paths matching pattern are
+// served at once, written as PATTERN=N, e.g. "/downloads/*=8".
+type concurrencyRule struct {
+	pattern  string
+	slots    chan struct{} // one taken by each request being served
+	rejected int64
+}
+
+type concurrencyLimits struct {
+	rules []*concurrencyRule
+	wait  time.Duration
+}
+
+// newConcurrencyLimits returns the limits applying rules, requests
+// over a limit waiting up to wait for a slot, or nil if there are no
+// rules.
+func newConcurrencyLimits(rules []string, wait time.Duration) (*concurrencyLimits, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	if wait < 0 {
+		return nil, fmt.Errorf("negative concurrency limit wait %v", wait)
+	}
+
+	c := &concurrencyLimits{wait: wait}
+	for _, rule := range rules {
+		pattern, spec, ok := strings.Cut(rule, "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("concurrency limit %q: expected PATTERN=N", rule)
+		}
+		pattern = normalizePattern(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("concurrency limit %q: %v", rule, err)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(spec))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("concurrency limit %q: invalid number of requests %q", rule, spec)
+		}
+		c.rules = append(c.rules, &concurrencyRule{pattern: pattern, slots: make(chan struct{}, n)})
+	}
+	return c, nil
+}
+
+// acquire takes a slot of rule for r, waiting up to c.wait for one,
+// and reports whether it got one.
+func (c *concurrencyLimits) acquire(rule *concurrencyRule, r *http.Request) bool {
+	select {
+	case rule.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if c.wait > 0 {
+		timer := time.NewTimer(c.wait)
+		defer timer.Stop()
+		select {
+		case rule.slots <- struct{}{}:
+			return true
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+	}
+	atomic.AddInt64(&rule.rejected, 1)
+	return false
+}
+
+// wrap serves the requests for next matching a rule within its limit,
+// the most specific matching rule applying, answering 503 to those that
+// don't get a slot in time. Other requests aren't held up.
+func (c *concurrencyLimits) wrap(next http.Handler) http.Handler {
+	retryAfter := strconv.FormatInt(int64((c.wait+time.Second-1)/time.Second), 10)
+	if c.wait < time.Second {
+		retryAfter = "1"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := mostSpecific(len(c.rules), func(i int) string { return c.rules[i].pattern }, r.URL.Path)
+		if i < 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rule := c.rules[i]
+		if !c.acquire(rule, r) {
+			setResult(r, resultOverLimit)
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header()["X-Content-Type-Options"] = nosniff
+			w.Header().Set("Retry-After", retryAfter)
+			writeDynamic(w, r, http.StatusServiceUnavailable, "text/plain; charset=utf-8", []byte("too many concurrent requests, try again shortly\n"))
+			return
+		}
+		defer func() { <-rule.slots }()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,144 @@
+package marb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingHandler answers 200 once release is closed, telling on
+// started when it starts.
+func blockingHandler(started chan<- string, release <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- r.URL.Path
+		<-release
+		w.Write([]byte("ok"))
+	})
+}
+
+func TestConcurrencyLimits(t *testing.T) {
+	c, err := newConcurrencyLimits([]string{"/downloads/*=1", "/downloads/big/*=2"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan string, 4), make(chan struct{})
+	h := c.wrap(blockingHandler(started, release))
+
+	done := make(chan *httptest.ResponseRecorder, 4)
+	serve := func(p string) {
+		go func() { done <- get(h, p) }()
+		<-started
+	}
+	serve("/downloads/a.zip")
+	// the more specific rule applies, with its own slots
+	serve("/downloads/big/a.iso")
+	serve("/downloads/big/b.iso")
+
+	rec := get(h, "/downloads/b.zip")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("over the limit: got %d, want 503", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After %q, want 1", got)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control %q, want no-store", got)
+	}
+	if !strings.Contains(rec.Body.String(), "too many concurrent requests") {
+		t.Errorf("body %q", rec.Body)
+	}
+	if rec := get(h, "/downloads/big/c.iso"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("over the more specific limit: got %d, want 503", rec.Code)
+	}
+
+	// other paths aren't held up
+	go func() { done <- get(h, "/index.html") }()
+	<-started
+	close(release)
+	for i := 0; i < 4; i++ {
+		if rec := <-done; rec.Code != http.StatusOK {
+			t.Errorf("request within the limits: got %d, want 200", rec.Code)
+		}
+	}
+
+	if rec := get(h, "/downloads/b.zip"); rec.Code != http.StatusOK {
+		t.Errorf("once the slot is freed: got %d, want 200", rec.Code)
+	}
+	if c.rules[0].rejected != 1 || c.rules[1].rejected != 1 {
+		t.Errorf("rejected %d and %d, want 1 each", c.rules[0].rejected, c.rules[1].rejected)
+	}
+}
+
+func TestConcurrencyWait(t *testing.T) {
+	c, err := newConcurrencyLimits([]string{"/downloads/*=1"}, 1500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan string, 2), make(chan struct{})
+	h := c.wrap(blockingHandler(started, release))
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- get(h, "/downloads/a.zip") }()
+	<-started
+
+	// the second waits for the first to be done, and then gets its slot
+	second := make(chan *httptest.ResponseRecorder)
+	go func() { second <- get(h, "/downloads/b.zip") }()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if rec := <-first; rec.Code != http.StatusOK {
+		t.Errorf("first: got %d, want 200", rec.Code)
+	}
+	<-started
+	if rec := <-second; rec.Code != http.StatusOK {
+		t.Errorf("waiting: got %d, want 200", rec.Code)
+	}
+
+	// or gives up after the wait, Retry-After rounding it up
+	c.rules[0].slots <- struct{}{}
+	start := time.Now()
+	rec := get(h, "/downloads/c.zip")
+	if rec.Code != http.StatusServiceUnavailable || time.Since(start) < 1500*time.Millisecond {
+		t.Errorf("got %d after %v, want 503 after the wait", rec.Code, time.Since(start))
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After %q, want 2", got)
+	}
+
+	if _, err := newConcurrencyLimits([]string{"/downloads/*=1"}, -time.Second); err == nil {
+		t.Error("negative wait accepted")
+	}
+	for _, rule := range []string{"/downloads/*", "=1", "/downloads/*=0", "/downloads/*=many", "/downloads/[=1"} {
+		if _, err := newConcurrencyLimits([]string{rule}, 0); err == nil {
+			t.Errorf("%q accepted", rule)
+		}
+	}
+}
+
+func TestConcurrencyMetrics(t *testing.T) {
+	s := newTestServer(t, Config{ConcurrencyLimits: []string{"/downloads/*=2"}}, map[string]string{
+		"downloads/a.zip": "zip",
+	})
+	// two requests in flight
+	rule := s.concurrency.rules[0]
+	rule.slots <- struct{}{}
+	rule.slots <- struct{}{}
+	if rec := get(s, "/downloads/a.zip"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d, want 503", rec.Code)
+	}
+
+	body := get(s.AdminHandler(), "/metrics").Body.String()
+	for _, want := range []string{
+		"# TYPE marb_concurrency_limit gauge\n",
+		`marb_concurrency_limit{pattern="/downloads/*"} 2` + "\n",
+		`marb_concurrency_in_flight{pattern="/downloads/*"} 2` + "\n",
+		"# TYPE marb_concurrency_rejected_total counter\n",
+		`marb_concurrency_rejected_total{pattern="/downloads/*"} 1` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+}
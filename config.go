@@ -0,0 +1,98 @@
+package marb
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Sources of configuration values, as reported by Config.Dump.
+const (
+	SourceDefault = "default"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+	SourceRuntime = "runtime"
+)
+
+// ConfigValue is a configuration value along with where it came from.
+type ConfigValue struct {
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+// secretFields are the fields redacted from configuration dumps.
+var secretFields = map[string]bool{
+	"WebhookSecret": true,
+	"AdminToken":    true,
+	"AdminTokens":   true,
+	"PurgeToken":    true,
+}
+
+const redacted = "REDACTED"
+
+// Dump returns the configuration keyed by field name, with the source
+// of each value taken from Sources. Secrets are redacted, durations
+// spelled out, and functions left out.
+func (c Config) Dump() map[string]ConfigValue {
+	dump := make(map[string]ConfigValue)
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Name == "Sources" || field.Name == "Shared" || field.Type.Kind() == reflect.Func ||
+			field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Func {
+			continue
+		}
+
+		value := v.Field(i).Interface()
+		switch x := value.(type) {
+		case time.Duration:
+			value = x.String()
+		case string:
+			if secretFields[field.Name] && x != "" {
+				value = redacted
+			}
+		case []string:
+			if secretFields[field.Name] {
+				value = redactTokens(x)
+			}
+		}
+		dump[field.Name] = ConfigValue{Value: value, Source: c.source(field.Name)}
+	}
+	return dump
+}
+
+func (c Config) source(field string) string {
+	if source := c.Sources[field]; source != "" {
+		return source
+	}
+	return SourceDefault
+}
+
+// redactTokens redacts ID=TOKEN specs, keeping the IDs.
+func redactTokens(specs []string) []string {
+	out := make([]string, len(specs))
+	for i, spec := range specs {
+		if id, _, ok := strings.Cut(spec, "="); ok {
+			out[i] = id + "=" + redacted
+		} else {
+			out[i] = redacted
+		}
+	}
+	return out
+}
+
+// configDump is the effective configuration of the server, defaults
+// filled in and runtime changes included.
+func (s *Server) configDump() map[string]ConfigValue {
+	dump := s.Config.Dump()
+	if s.runtime.logLevel.info().ChangedBy != "" {
+		dump["LogLevel"] = ConfigValue{Value: formatLevel(s.runtime.logLevel.get()), Source: SourceRuntime}
+	}
+	if s.runtime.debugHeaders.info().ChangedBy != "" {
+		dump["DebugHeaders"] = ConfigValue{Value: s.runtime.debugHeaders.get() != 0, Source: SourceRuntime}
+	}
+	if s.runtime.maintenance.info().ChangedBy != "" {
+		dump["Maintenance"] = ConfigValue{Value: s.runtime.maintenance.get() != 0, Source: SourceRuntime}
+	}
+	return dump
+}
@@ -0,0 +1,58 @@
+package marb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// cspNoncePlaceholder is replaced with a fresh nonce on every request,
+// in the CSP policy and in HTML files holding it, as in
+// <script nonce="__CSP_NONCE__">.
+const cspNoncePlaceholder = "__CSP_NONCE__"
+
+func newNonce() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return base64.StdEncoding.EncodeToString(b[:])
+}
+
+func isHTML(f *siteFile) bool {
+	return strings.HasPrefix(f.mimeType, "text/html")
+}
+
+// setCSP sets the Content-Security-Policy header of HTML files, with a
+// nonce of its own when the policy asks for one.
+func (s *Server) setCSP(h http.Header, f *siteFile) {
+	if s.CSP != "" && isHTML(f) {
+		h.Set("Content-Security-Policy", strings.ReplaceAll(s.CSP, cspNoncePlaceholder, newNonce()))
+	}
+}
+
+// serveNonced serves an HTML file holding the nonce placeholder, with
+// the same fresh nonce in its body and in the Content-Security-Policy
+// header. The body being different every time, it's compressed on the
+// fly, and never stored or validated: a 304 would pair the nonce of a
+// new header with that of an old body.
+func (s *Server) serveNonced(w http.ResponseWriter, r *http.Request, f *siteFile) {
+	contents, err := f.identity()
+	if err != nil {
+		log.Printf("%s: could not decompress: %v", path.Join(f.dir, f.name), err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	setResult(r, resultFull)
+	nonce := newNonce()
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Security-Policy", strings.ReplaceAll(s.CSP, cspNoncePlaceholder, nonce))
+	s.setReportingHeaders(h, r)
+	s.setIsolationHeaders(h, r, true, false)
+	s.debugf("%s %s: serving %s with a nonce", r.Method, r.URL.Path, path.Join(f.dir, f.name))
+	writeDynamic(w, r, http.StatusOK, f.mimeType, bytes.ReplaceAll(contents, []byte(cspNoncePlaceholder), []byte(nonce)))
+}
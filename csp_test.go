@@ -0,0 +1,59 @@
+package marb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSPNonce(t *testing.T) {
+	s := newTestServer(t, Config{CSP: "script-src 'nonce-__CSP_NONCE__'"}, map[string]string{
+		"index.html": `<script nonce="__CSP_NONCE__">hi()</script>`,
+		"plain.html": "<p>no scripts</p>",
+		"app.js":     "hi()",
+	})
+
+	nonce := func(policy string) string {
+		n, ok := strings.CutPrefix(policy, "script-src 'nonce-")
+		if !ok || !strings.HasSuffix(n, "'") {
+			t.Fatalf("Content-Security-Policy %q has no nonce", policy)
+		}
+		return strings.TrimSuffix(n, "'")
+	}
+
+	seen := map[string]bool{}
+	for range 2 {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("got %d, want 200 whatever the validators", rec.Code)
+		}
+		n := nonce(rec.Header().Get("Content-Security-Policy"))
+		if want := `<script nonce="` + n + `">hi()</script>`; rec.Body.String() != want {
+			t.Errorf("body %q, want %q", rec.Body, want)
+		}
+		if seen[n] {
+			t.Errorf("nonce %q reused", n)
+		}
+		seen[n] = true
+		if rec.Header().Get("Cache-Control") != "no-store" || rec.Header().Get("ETag") != "" || rec.Header().Get("Last-Modified") != "" {
+			t.Errorf("nonced page may be stored or validated: %v", rec.Header())
+		}
+	}
+
+	// HTML without the placeholder still gets a policy of its own
+	rec := get(s, "/plain.html")
+	if seen[nonce(rec.Header().Get("Content-Security-Policy"))] {
+		t.Errorf("/plain.html reuses a nonce")
+	}
+	if rec.Body.String() != "<p>no scripts</p>" {
+		t.Errorf("/plain.html: body %q", rec.Body)
+	}
+	if rec := get(s, "/app.js"); rec.Header().Get("Content-Security-Policy") != "" {
+		t.Errorf("/app.js: Content-Security-Policy %q, want none", rec.Header().Get("Content-Security-Policy"))
+	}
+}
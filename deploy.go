@@ -0,0 +1,173 @@
+package marb
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	defaultDeployMaxSize       = 256 << 20
+	defaultMaxDecompressedSize = 1 << 30
+)
+
+// tarSource serves the files of a tarball, read in memory at once.
+type tarSource struct {
+	files    []*sourceFile
+	contents map[string][]byte
+}
+
+// newTarSource reads the tarball, gzipped or not, from r. Entry names
+// are taken relative to the root of the site and must stay within it.
+// Symbolic links are followed as long as they point to a regular file
+// of the tarball; any other kind of entry besides directories is
+// refused.
+//
+// Archives whose entries, or all of them together, are larger than
+// maxSize once decompressed are refused before being read in.
+func newTarSource(r io.Reader, maxSize int64) (*tarSource, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+
+	t := &tarSource{contents: make(map[string][]byte)}
+	links := make(map[string]string)
+	var total int64
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name, err := tarEntryName(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg:
+			if total += hdr.Size; hdr.Size > maxSize || total > maxSize {
+				return nil, fmt.Errorf("%s: archive expands beyond the %d bytes limit", name, maxSize)
+			}
+			contents, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			t.contents[name] = contents
+			t.files = append(t.files, &sourceFile{name: name, size: hdr.Size, modTime: hdr.ModTime})
+		case tar.TypeSymlink:
+			target := hdr.Linkname
+			if !strings.HasPrefix(target, "/") {
+				target = path.Join(strings.TrimPrefix(path.Dir(name), "/"), target)
+			}
+			if target, err = tarEntryName(target); err != nil {
+				return nil, fmt.Errorf("%s: symlink escapes the root", name)
+			}
+			links[name] = target
+		default:
+			return nil, fmt.Errorf("%s: unsupported entry type %q", name, hdr.Typeflag)
+		}
+	}
+
+	for name, target := range links {
+		contents, ok := t.contents[target]
+		if !ok {
+			return nil, fmt.Errorf("%s: symlink target %s is not a regular file of the archive", name, target)
+		}
+		t.contents[name] = contents
+		t.files = append(t.files, &sourceFile{name: name, size: int64(len(contents))})
+	}
+	return t, nil
+}
+
+// tarEntryName returns the site path of a tarball entry, refusing
+// those outside the root.
+func tarEntryName(name string) (string, error) {
+	name = strings.TrimPrefix(name, "./")
+	if name == "" || name == "." {
+		return "/", nil
+	}
+	if strings.HasPrefix(name, "/") || name == ".." || strings.HasPrefix(name, "../") || strings.Contains(name, "/../") {
+		return "", fmt.Errorf("%s: path outside the root", name)
+	}
+	return path.Clean("/" + name), nil
+}
+
+func (t *tarSource) list() ([]*sourceFile, error) {
+	return t.files, nil
+}
+
+func (t *tarSource) read(f *sourceFile) ([]byte, string, error) {
+	return t.contents[f.name], "", nil
+}
+
+// validateDeploy refuses sites without a root index.
+func (s *Server) validateDeploy(snap *siteSnapshot) error {
+	if f := snap.files["/"]; f == nil || !f.isIndex {
+		return errors.New("the archive has no index at its root")
+	}
+	return nil
+}
+
+// serveDeploy loads the tarball sent with a PUT request and swaps it in
+// if it looks right. Later reloads read the deployed tarball again.
+// Since a deploy replaces the whole site, it's refused unless the admin
+// API requires a token, whatever the listener it's on.
+func (s *Server) serveDeploy(w http.ResponseWriter, r *http.Request) {
+	if len(s.adminTokens) == 0 {
+		adminError(w, r, http.StatusForbidden, "deploying requires an admin token")
+		return
+	}
+	if r.Method != http.MethodPut {
+		w.Header().Set("Allow", "PUT")
+		adminError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	maxSize := s.DeployMaxSize
+	if maxSize <= 0 {
+		maxSize = defaultDeployMaxSize
+	}
+	body := http.MaxBytesReader(w, r.Body, maxSize)
+
+	maxDecompressed := s.MaxDecompressedSize
+	if maxDecompressed <= 0 {
+		maxDecompressed = defaultMaxDecompressedSize
+	}
+	src, err := newTarSource(body, maxDecompressed)
+	if err != nil {
+		status := http.StatusBadRequest
+		if strings.Contains(err.Error(), "request body too large") {
+			status = http.StatusRequestEntityTooLarge
+		}
+		adminError(w, r, status, "invalid archive: "+err.Error())
+		return
+	}
+
+	diff, err := s.swap("deploy", "uploaded archive", src, s.validateDeploy)
+	if err != nil {
+		adminError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, r, diff)
+}
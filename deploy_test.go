@@ -0,0 +1,162 @@
+package marb
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// tarball returns an uncompressed tarball of files, keyed by name.
+func tarball(t *testing.T, files map[string]string) io.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, contents := range files {
+		hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(contents)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, contents); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func deploy(s *Server, token string, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("PUT", "/_deploy", body)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestDeploy(t *testing.T) {
+	s := newTestServer(t, Config{AdminToken: "secret"}, map[string]string{"index.html": "old"})
+
+	if rec := deploy(s, "", tarball(t, map[string]string{"index.html": "new"})); rec.Code != http.StatusUnauthorized {
+		t.Errorf("deploy without a token: got %d, want 401", rec.Code)
+	}
+	if rec := deploy(s, "secret", tarball(t, map[string]string{"about.html": "no index"})); rec.Code != http.StatusBadRequest {
+		t.Errorf("deploy without an index: got %d, want 400", rec.Code)
+	}
+	if body := get(s, "/").Body.String(); body != "old" {
+		t.Errorf("after a refused deploy, / is %q, want the old index", body)
+	}
+
+	// requests served during the swap get either site, whole
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if rec := get(s, "/"); rec.Code != http.StatusOK || rec.Body.String() != "old" && rec.Body.String() != "new" {
+					t.Errorf("during the swap: got %d %q", rec.Code, rec.Body)
+					return
+				}
+			}
+		}()
+	}
+	rec := deploy(s, "secret", tarball(t, map[string]string{"./index.html": "new", "./css/site.css": "body{}"}))
+	close(stop)
+	wg.Wait()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("deploy: got %d %s", rec.Code, rec.Body)
+	}
+
+	if body := get(s, "/").Body.String(); body != "new" {
+		t.Errorf("after the deploy, / is %q, want the new index", body)
+	}
+	if rec := get(s, "/css/site.css"); rec.Code != http.StatusOK {
+		t.Errorf("deployed /css/site.css: got %d", rec.Code)
+	}
+
+	// later reloads read the tarball rather than the root
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if body := get(s, "/").Body.String(); body != "new" {
+		t.Errorf("after reloading, / is %q, want the deployed index", body)
+	}
+}
+
+func TestDeployRequiresToken(t *testing.T) {
+	s := newTestServer(t, Config{}, map[string]string{"index.html": "old"})
+
+	rec := deploy(s, "", tarball(t, map[string]string{"index.html": "new"}))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("deploy without admin tokens: got %d, want 403", rec.Code)
+	}
+	if body := get(s, "/").Body.String(); body != "old" {
+		t.Errorf("after a forbidden deploy, / is %q, want the old index", body)
+	}
+	if rec := get(s.AdminHandler(), "/info"); rec.Code != http.StatusOK {
+		t.Errorf("/info without admin tokens: got %d, want 200", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "admin token") {
+		t.Errorf("forbidden deploy body %q doesn't tell why", rec.Body)
+	}
+}
+
+func TestTarSourceLimits(t *testing.T) {
+	entry := func(name, contents string) *tar.Header {
+		return &tar.Header{Name: name, Mode: 0o644, Size: int64(len(contents)), Typeflag: tar.TypeReg}
+	}
+	for _, tt := range []struct {
+		name    string
+		entries []*tar.Header
+		ok      bool
+	}{
+		{"within the limit", []*tar.Header{entry("index.html", "0123456789"), entry("a.txt", "0123456789")}, true},
+		{"an entry over the limit", []*tar.Header{entry("big.bin", strings.Repeat("x", 33))}, false},
+		{"entries adding up over the limit", []*tar.Header{entry("a.bin", strings.Repeat("x", 20)), entry("b.bin", strings.Repeat("x", 20))}, false},
+		{"a path outside the root", []*tar.Header{entry("../etc/passwd", "x")}, false},
+		{"an absolute path", []*tar.Header{entry("/etc/passwd", "x")}, false},
+		{"a symlink within", []*tar.Header{entry("a.txt", "x"), {Name: "b.txt", Typeflag: tar.TypeSymlink, Linkname: "a.txt"}}, true},
+		{"a symlink escaping", []*tar.Header{{Name: "b.txt", Typeflag: tar.TypeSymlink, Linkname: "../../etc/passwd"}}, false},
+		{"a symlink to nothing", []*tar.Header{{Name: "b.txt", Typeflag: tar.TypeSymlink, Linkname: "a.txt"}}, false},
+		{"a device", []*tar.Header{{Name: "null", Typeflag: tar.TypeChar}}, false},
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range tt.entries {
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				tw.Write(bytes.Repeat([]byte{'x'}, int(hdr.Size)))
+			}
+		}
+		tw.Close()
+
+		_, err := newTarSource(&buf, 32)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v, want success %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestDeployMaxDecompressedSize(t *testing.T) {
+	s := newTestServer(t, Config{AdminToken: "secret", MaxDecompressedSize: 1 << 10}, map[string]string{"index.html": "old"})
+	rec := deploy(s, "secret", tarball(t, map[string]string{"index.html": "new", "big.bin": strings.Repeat("x", 2<<10)}))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "limit") {
+		t.Errorf("deploying an archive expanding beyond the limit: got %d %s, want 400", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,35 @@
+package marb
+
+import (
+	"path"
+	"strings"
+)
+
+// pathDepth returns the number of segments of p, "/a/b.html" and
+// "/a/b/" having 2.
+func pathDepth(p string) int {
+	return strings.Count(strings.Trim(path.Clean("/"+p), "/"), "/") + 1
+}
+
+// tooDeep reports whether p is deeper than MaxPathDepth.
+func (s *Server) tooDeep(p string) bool {
+	return s.MaxPathDepth > 0 && pathDepth(p) > s.MaxPathDepth
+}
+
+// skipDeep drops the files deeper than MaxPathDepth from list,
+// returning their names apart.
+func (s *Server) skipDeep(list []*sourceFile) ([]*sourceFile, []string) {
+	if s.MaxPathDepth <= 0 {
+		return list, nil
+	}
+	kept := list[:0]
+	var deep []string
+	for _, sf := range list {
+		if s.tooDeep(sf.name) {
+			deep = append(deep, sf.name)
+		} else {
+			kept = append(kept, sf)
+		}
+	}
+	return kept, deep
+}
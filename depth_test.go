@@ -0,0 +1,52 @@
+package marb
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPathDepth(t *testing.T) {
+	for p, want := range map[string]int{
+		"/":          1,
+		"/a.html":    1,
+		"/a/b.html":  2,
+		"/a/b/":      2,
+		"a/b/c.html": 3,
+		"/a//b/../c": 2,
+	} {
+		if got := pathDepth(p); got != want {
+			t.Errorf("pathDepth(%q) = %d, want %d", p, got, want)
+		}
+	}
+}
+
+func TestMaxPathDepth(t *testing.T) {
+	captureLog(t)
+	s := newTestServer(t, Config{MaxPathDepth: 2}, map[string]string{
+		"index.html":     "home",
+		"a/index.html":   "a",
+		"a/b/index.html": "too deep",
+		"a/b/c.txt":      "too deep",
+	})
+
+	for path, status := range map[string]int{
+		"/":            http.StatusOK,
+		"/a/":          http.StatusOK,
+		"/a/b/":        http.StatusNotFound,
+		"/a/b/c.txt":   http.StatusNotFound,
+		"/x/y/z/w.txt": http.StatusNotFound,
+	} {
+		if rec := get(s, path); rec.Code != status {
+			t.Errorf("%s: got %d, want %d", path, rec.Code, status)
+		}
+	}
+
+	var warned bool
+	for _, w := range s.Warnings() {
+		warned = warned || w.Code == warnTooDeep && strings.Contains(w.Message, "skipped 2 files")
+	}
+	if !warned {
+		t.Errorf("no warning about the skipped files in %v", s.Warnings())
+	}
+}
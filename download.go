@@ -0,0 +1,118 @@
+package marb
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// defaultTarDownloadMaxSize is the default of TarDownloadMaxSize.
+const defaultTarDownloadMaxSize = 1 << 30
+
+// serveTarDownload answers GET /dir/?download=tar, or tar.gz, with an
+// archive of the files under a directory matching TarDownloads,
+// reporting whether it did. The archive is written file by file as
+// it's sent, paths relative to the directory and modification times
+// kept, hidden files left out like in listings.
+func (s *Server) serveTarDownload(w http.ResponseWriter, r *http.Request, snap *siteSnapshot) bool {
+	if len(s.tarDownloads) == 0 || !strings.HasSuffix(r.URL.Path, "/") {
+		return false
+	}
+	format := r.URL.Query().Get("download")
+	if format == "" {
+		return false
+	}
+	dir := rootedPath(r.URL.Path)
+	if !s.tarDownloads.match(dir) {
+		return false
+	}
+	if format != "tar" && format != "tar.gz" {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		writeDynamic(w, r, http.StatusBadRequest, "text/plain; charset=utf-8", []byte("download must be tar or tar.gz\n"))
+		return true
+	}
+
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	var names []string
+	var total int64
+	files := snap.paths()
+	for p, f := range files {
+		if strings.HasPrefix(p, prefix) && !hiddenPath(p) {
+			names = append(names, p)
+			total += int64(f.size)
+		}
+	}
+	if len(names) == 0 {
+		s.serve404(w, r, snap)
+		return true
+	}
+	if total > s.TarDownloadMaxSize {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		writeDynamic(w, r, http.StatusRequestEntityTooLarge, "text/plain; charset=utf-8", []byte("directory too large to download\n"))
+		return true
+	}
+	sort.Strings(names)
+
+	name := path.Base(dir)
+	if dir == "/" {
+		name = "site"
+	}
+	h := w.Header()
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + format}))
+	h.Set("Cache-Control", "no-store")
+	if format == "tar.gz" {
+		h.Set("Content-Type", "application/gzip")
+	} else {
+		h.Set("Content-Type", "application/x-tar")
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return true
+	}
+
+	var out io.Writer = w
+	if format == "tar.gz" {
+		zw := gzip.NewWriter(w)
+		defer zw.Close()
+		out = zw
+	}
+	tw := tar.NewWriter(out)
+	defer tw.Close()
+	for _, p := range names {
+		if err := writeTarEntry(tw, strings.TrimPrefix(p, prefix), files[p]); err != nil {
+			// Headers are gone already; cutting the archive short is
+			// the only way left to tell.
+			log.Printf("tar download of %s: %v", dir, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	return true
+}
+
+func writeTarEntry(tw *tar.Writer, name string, f *siteFile) error {
+	contents, err := f.identity()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(contents)),
+		Mode:     0644,
+		ModTime:  f.lastModified,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(contents); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package marb
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// untar returns the regular files of a tar archive by name, along with
+// their modification times.
+func untar(t *testing.T, r io.Reader) (map[string]string, map[string]time.Time) {
+	t.Helper()
+	files, mtimes := make(map[string]string), make(map[string]time.Time)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, mtimes
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			t.Errorf("%s: type %c, want a regular file", hdr.Name, hdr.Typeflag)
+		}
+		files[hdr.Name], mtimes[hdr.Name] = string(contents), hdr.ModTime
+	}
+}
+
+func TestTarDownload(t *testing.T) {
+	root := writeSite(t, map[string]string{
+		"index.html":        "home",
+		"docs/index.html":   "docs",
+		"docs/guide/a.txt":  "first chapter",
+		"docs/guide/b.txt":  "second chapter",
+		"docs/.secret":      "hidden",
+		"docs/.git/config":  "[core]",
+		"other/notes.txt":   "notes",
+		"docs/big/blob.bin": string(bytes.Repeat([]byte{'x'}, 990)),
+	})
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(root, "docs", "guide", "a.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(Config{Root: root, TarDownloads: []string{"/docs"}, TarDownloadMaxSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	want := map[string]string{
+		"a.txt": "first chapter",
+		"b.txt": "second chapter",
+	}
+	for _, tt := range []struct {
+		format, contentType string
+		gzipped             bool
+	}{
+		{"tar", "application/x-tar", false},
+		{"tar.gz", "application/gzip", true},
+	} {
+		rec := get(s, "/docs/guide/?download="+tt.format)
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != tt.contentType {
+			t.Fatalf("%s: got %d as %q, want 200 as %q", tt.format, rec.Code, rec.Header().Get("Content-Type"), tt.contentType)
+		}
+		if got, want := rec.Header().Get("Content-Disposition"), "attachment; filename=guide."+tt.format; got != want {
+			t.Errorf("%s: Content-Disposition %q, want %q", tt.format, got, want)
+		}
+		if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("%s: Cache-Control %q, want no-store", tt.format, got)
+		}
+
+		var body io.Reader = rec.Body
+		if tt.gzipped {
+			zr, err := gzip.NewReader(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = zr
+		}
+		files, mtimes := untar(t, body)
+		if !reflect.DeepEqual(files, want) {
+			t.Errorf("%s: files %q, want %q", tt.format, files, want)
+		}
+		if !mtimes["a.txt"].Equal(mtime) {
+			t.Errorf("%s: modification time %v, want %v", tt.format, mtimes["a.txt"], mtime)
+		}
+	}
+
+	// within the size cap on its own
+	rec := get(s, "/docs/big/?download=tar")
+	files, _ := untar(t, rec.Body)
+	if len(files) != 1 || files["blob.bin"] == "" {
+		t.Errorf("/docs/big/: files %q", reflect.ValueOf(files).MapKeys())
+	}
+
+	// the whole directory is over the size cap
+	if rec := get(s, "/docs/?download=tar"); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("over the size cap: got %d, want 413", rec.Code)
+	}
+
+	rec = serveRequest(s, "HEAD", "/docs/guide/?download=tar", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-tar" || rec.Body.Len() > 0 {
+		t.Errorf("HEAD: got %d as %q with a %d bytes body", rec.Code, rec.Header().Get("Content-Type"), rec.Body.Len())
+	}
+	if rec := get(s, "/docs/guide/?download=zip"); rec.Code != http.StatusBadRequest {
+		t.Errorf("zip: got %d, want 400", rec.Code)
+	}
+	if rec := get(s, "/other/?download=tar"); rec.Header().Get("Content-Type") == "application/x-tar" {
+		t.Error("directory not matching TarDownloads downloaded")
+	}
+}
+
+func TestTarDownloadHiddenFiles(t *testing.T) {
+	s := newTestServer(t, Config{TarDownloads: []string{"/docs"}}, map[string]string{
+		"docs/a.txt":        "a",
+		"docs/.secret":      "hidden",
+		"docs/.git/config":  "[core]",
+		"docs/sub/.env":     "KEY=value",
+		"docs/sub/page.txt": "page",
+	})
+	files, _ := untar(t, get(s, "/docs/?download=tar").Body)
+	if want := map[string]string{"a.txt": "a", "sub/page.txt": "page"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("files %q, want %q", files, want)
+	}
+}
@@ -0,0 +1,95 @@
+package marb_test
+
+import (
+	"fmt"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/0eg/marb"
+)
+
+func Example() {
+	root, err := os.MkdirTemp("", "site")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.WriteFile(filepath.Join(root, "index.html"), []byte("<h1>Hello</h1>\n"), 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	s, err := marb.New(marb.Config{Root: root, CacheControl: "public, max-age=300"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+
+	// s is an http.Handler, to pass to http.ListenAndServe
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	fmt.Println(rec.Code, rec.Header().Get("Content-Type"), rec.Header().Get("Cache-Control"))
+	fmt.Print(rec.Body)
+	// Output:
+	// 200 text/html; charset=utf-8 public, max-age=300
+	// <h1>Hello</h1>
+}
+
+// writeFiles writes files, keyed by name, to a new directory.
+func writeFiles(files map[string]string) string {
+	root, err := os.MkdirTemp("", "site")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(contents), 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return root
+}
+
+func ExampleShared() {
+	// two sites holding the same script
+	script := "console.log('hello')\n"
+	blog := writeFiles(map[string]string{"index.html": "<h1>Blog</h1>\n", "app.js": script})
+	defer os.RemoveAll(blog)
+	shop := writeFiles(map[string]string{"index.html": "<h1>Shop</h1>\n", "app.js": script})
+	defer os.RemoveAll(shop)
+
+	shared := marb.NewShared()
+	blogServer, err := marb.New(marb.Config{Root: blog, Shared: shared, CacheControl: "public, max-age=60"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer blogServer.Close()
+	shopServer, err := marb.New(marb.Config{Root: shop, Shared: shared, CacheControl: "no-cache"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shopServer.Close()
+
+	// the script is kept once, while each server keeps its own options
+	stats := shared.Stats()
+	fmt.Println("saved:", stats.Saved > 0, stats.Saved == int64(len(script)))
+	for _, s := range []*marb.Server{blogServer, shopServer} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", "/app.js", nil))
+		fmt.Println(rec.Code, rec.Header().Get("Cache-Control"))
+	}
+
+	// once the shop drops the script, only the blog holds it
+	if err := os.Remove(filepath.Join(shop, "app.js")); err != nil {
+		log.Fatal(err)
+	}
+	if err := shopServer.Reload(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("saved after the reload:", shared.Stats().Saved)
+	// Output:
+	// saved: true true
+	// 200 public, max-age=60
+	// 200 no-cache
+	// saved after the reload: 0
+}
@@ -0,0 +1,369 @@
+package marb
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcsSource reads a site from the objects of a Google Cloud Storage
+// bucket under a prefix, through the JSON API. Access tokens come from
+// the application default credentials, see newGCPTokenSource.
+type gcsSource struct {
+	bucket   string
+	prefix   string
+	endpoint string
+	tokens   *gcpTokenSource
+	client   *http.Client
+}
+
+func newGCSSource(u *url.URL) (*gcsSource, error) {
+	src := &gcsSource{
+		bucket:   u.Host,
+		prefix:   strings.TrimPrefix(u.Path, "/"),
+		endpoint: "https://storage.googleapis.com",
+		client:   remoteClient,
+	}
+	if src.prefix != "" && !strings.HasSuffix(src.prefix, "/") {
+		src.prefix += "/"
+	}
+
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		src.endpoint = strings.TrimSuffix(host, "/")
+		return src, nil
+	}
+
+	var err error
+	src.tokens, err = newGCPTokenSource()
+	return src, err
+}
+
+func (src *gcsSource) get(u string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if src.tokens != nil {
+		token, err := src.tokens.get()
+		if err != nil {
+			return nil, nil, err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
+	return doRequest(src.client, req)
+}
+
+type gcsListResult struct {
+	NextPageToken string `json:"nextPageToken"`
+	Items         []struct {
+		Name        string    `json:"name"`
+		Size        string    `json:"size"`
+		Updated     time.Time `json:"updated"`
+		ContentType string    `json:"contentType"`
+		Etag        string    `json:"etag"`
+	} `json:"items"`
+}
+
+func (src *gcsSource) list() ([]*sourceFile, error) {
+	var files []*sourceFile
+	query := url.Values{
+		"prefix": {src.prefix},
+		"fields": {"nextPageToken,items(name,size,updated,contentType,etag)"},
+	}
+
+	for {
+		var result gcsListResult
+		u := src.endpoint + "/storage/v1/b/" + url.PathEscape(src.bucket) + "/o?" + query.Encode()
+		err := withRetry("gs://"+src.bucket+"/"+src.prefix, func() error {
+			_, body, err := src.get(u)
+			if err != nil {
+				return err
+			}
+			result = gcsListResult{}
+			return json.Unmarshal(body, &result)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range result.Items {
+			if strings.HasSuffix(obj.Name, "/") {
+				// folder placeholder
+				continue
+			}
+			size, err := strconv.ParseInt(obj.Size, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("gs://%s/%s: invalid size %q", src.bucket, obj.Name, obj.Size)
+			}
+			files = append(files, &sourceFile{
+				name:        "/" + strings.TrimPrefix(obj.Name, src.prefix),
+				size:        size,
+				modTime:     obj.Updated,
+				etag:        obj.Etag,
+				contentType: obj.ContentType,
+				location:    obj.Name,
+			})
+		}
+
+		if result.NextPageToken == "" {
+			return files, nil
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+}
+
+func (src *gcsSource) read(sf *sourceFile) ([]byte, string, error) {
+	u := src.endpoint + "/storage/v1/b/" + url.PathEscape(src.bucket) + "/o/" + url.PathEscape(sf.location) + "?alt=media"
+
+	var contents []byte
+	err := withRetry("gs://"+src.bucket+"/"+sf.location, func() error {
+		_, body, err := src.get(u)
+		contents = body
+		return err
+	})
+	return contents, sf.contentType, err
+}
+
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_only"
+
+// gcpTokenSource hands out OAuth2 access tokens, fetching a new one
+// shortly before the current one expires.
+type gcpTokenSource struct {
+	fetch func() (string, time.Duration, error)
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// newGCPTokenSource follows the application default credentials: the
+// file named by GOOGLE_APPLICATION_CREDENTIALS, then the one written by
+// gcloud, then the metadata server of the instance. Without any,
+// requests are sent anonymously, which works for public buckets.
+func newGCPTokenSource() (*gcpTokenSource, error) {
+	name := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if name == "" {
+		if dir, err := os.UserConfigDir(); err == nil {
+			if wellKnown := filepath.Join(dir, "gcloud", "application_default_credentials.json"); fileExists(wellKnown) {
+				name = wellKnown
+			}
+		}
+	}
+
+	if name != "" {
+		contents, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+
+		var creds gcpCredentialsFile
+		if err := json.Unmarshal(contents, &creds); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+
+		switch creds.Type {
+		case "service_account":
+			key, err := parseRSAKey(creds.PrivateKey)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			return &gcpTokenSource{fetch: func() (string, time.Duration, error) {
+				return serviceAccountToken(&creds, key)
+			}}, nil
+		case "authorized_user":
+			return &gcpTokenSource{fetch: func() (string, time.Duration, error) {
+				return refreshToken(&creds)
+			}}, nil
+		default:
+			return nil, fmt.Errorf("%s: unsupported credentials type %q", name, creds.Type)
+		}
+	}
+
+	return &gcpTokenSource{fetch: metadataToken}, nil
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// gcpTokenRefresh is how long before expiring tokens are fetched again.
+const gcpTokenRefresh = 5 * time.Minute
+
+// errNoGCPCredentials is returned by metadataToken off Google Cloud.
+var errNoGCPCredentials = errors.New("no Google Cloud credentials found")
+
+func (ts *gcpTokenSource) get() (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.fetch == nil || ts.token != "" && time.Until(ts.expires) > gcpTokenRefresh {
+		return ts.token, nil
+	}
+
+	token, ttl, err := ts.fetch()
+	if err == errNoGCPCredentials {
+		log.Printf("gcs: %v, sending anonymous requests", err)
+		ts.fetch = nil
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	ts.token, ts.expires = token, time.Now().Add(ttl)
+	return token, nil
+}
+
+type gcpCredentialsFile struct {
+	Type string `json:"type"`
+
+	// service_account
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+
+	// authorized_user
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func parseRSAKey(pemKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, errors.New("invalid private key")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return key, nil
+}
+
+type oauthToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+func postTokenRequest(tokenURI string, form url.Values) (string, time.Duration, error) {
+	var token oauthToken
+	err := withRetry("oauth token", func() error {
+		req, err := http.NewRequest(http.MethodPost, tokenURI, strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		_, body, err := doRequest(remoteClient, req)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(body, &token)
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
+
+// serviceAccountToken exchanges a JWT signed with the service account
+// key for an access token.
+func serviceAccountToken(creds *gcpCredentialsFile, key *rsa.PrivateKey) (string, time.Duration, error) {
+	tokenURI := creds.TokenURI
+	if tokenURI == "" {
+		tokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   creds.ClientEmail,
+		"scope": gcsScope,
+		"aud":   tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	hashed := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", 0, err
+	}
+
+	return postTokenRequest(tokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + enc.EncodeToString(sig)},
+	})
+}
+
+// refreshToken trades the refresh token of gcloud user credentials for
+// an access token.
+func refreshToken(creds *gcpCredentialsFile) (string, time.Duration, error) {
+	return postTokenRequest("https://oauth2.googleapis.com/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {creds.ClientID},
+		"client_secret": {creds.ClientSecret},
+		"refresh_token": {creds.RefreshToken},
+	})
+}
+
+// metadataToken gets a token for the service account of the instance.
+func metadataToken() (string, time.Duration, error) {
+	host := os.Getenv("GCE_METADATA_HOST")
+	if host == "" {
+		host = "metadata.google.internal"
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token?scopes="+url.QueryEscape(gcsScope), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	_, body, err := doRequest(metadataClient, req)
+	var se *statusError
+	if err != nil && !errors.As(err, &se) {
+		// not running on Google Cloud
+		return "", 0, errNoGCPCredentials
+	} else if err != nil {
+		return "", 0, err
+	}
+
+	var token oauthToken
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", 0, err
+	}
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
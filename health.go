@@ -0,0 +1,124 @@
+package marb
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// Health check paths, answered on the main listener ahead of the site,
+// maintenance mode and HTTPS redirects.
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// checkHealthPaths warns about the files of snap served at the health
+// check paths, which can't be reached since health checks are answered
+// first.
+func checkHealthPaths(snap *siteSnapshot) {
+	for _, p := range []string{healthzPath, readyzPath} {
+		if snap.files[p] != nil {
+			snap.warn(warnHealthShadowed, "%s is answered by the health check, shadowing the file of the site", p)
+		}
+	}
+}
+
+// serveHealth answers health checks, reporting whether r was one.
+// /healthz tells the process is up, until it shuts down, while /readyz
+// fails when draining so that load balancers take the server out of
+// rotation, files still being served to whoever asks meanwhile, and
+// when the files loaded don't look right.
+func (s *Server) serveHealth(w http.ResponseWriter, r *http.Request) bool {
+	status, body := http.StatusOK, "ok\n"
+	switch r.URL.Path {
+	case healthzPath:
+		if atomic.LoadInt32(&s.shuttingDown) != 0 {
+			status, body = http.StatusServiceUnavailable, "shutting down\n"
+		}
+	case readyzPath:
+		if s.Draining() {
+			status, body = http.StatusServiceUnavailable, "draining\n"
+		} else if problems := s.readinessProblems(s.current()); len(problems) > 0 {
+			body, _ := json.Marshal(struct {
+				Status   string   `json:"status"`
+				Problems []string `json:"problems"`
+			}{"unready", problems})
+			w.Header().Set("Cache-Control", "no-store")
+			writeDynamic(w, r, http.StatusServiceUnavailable, "application/json", append(body, '\n'))
+			return true
+		}
+	default:
+		return false
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeDynamic(w, r, status, "text/plain; charset=utf-8", []byte(body))
+	return true
+}
+
+// readinessProblems checks that snap can actually be served: that it
+// holds at least ReadyzMinFiles files, and that each of HealthcheckPaths
+// resolves to a file with contents and headers. It only looks things up
+// in memory, so it's cheap enough for every probe.
+func (s *Server) readinessProblems(snap *siteSnapshot) []string {
+	if snap.loading {
+		return []string{"files still loading"}
+	}
+	var problems []string
+	if snap.count < s.ReadyzMinFiles {
+		problems = append(problems, fmt.Sprintf("%d files loaded, expected at least %d", snap.count, s.ReadyzMinFiles))
+	}
+	for _, p := range s.HealthcheckPaths {
+		f := s.resolveFile(snap, p)
+		switch {
+		case f == nil:
+			problems = append(problems, p+": not found")
+		case f.size == 0:
+			problems = append(problems, p+": empty")
+		case len(f.body(f.encoding())) == 0:
+			problems = append(problems, p+": contents missing from memory")
+		case f.mimeType == "" || f.headers.contentLength == nil:
+			problems = append(problems, p+": headers missing")
+		}
+	}
+	return problems
+}
+
+// SetDraining drains the server, making /readyz fail, or undrains it.
+// by tells who did it, for the log and the admin API. The state is kept
+// across reloads, but not restarts.
+func (s *Server) SetDraining(on bool, by string) {
+	s.runtime.draining.set(boolSwitch(on), by)
+	log.Printf("%s set drain to %s", by, formatSwitch(boolSwitch(on)))
+}
+
+// StartShutdown drains the server and makes /healthz fail too, for
+// orchestrators to stop sending traffic before it goes away. Files keep
+// being served until the listeners are closed.
+func (s *Server) StartShutdown() {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	s.SetDraining(true, "shutdown")
+}
+
+// Draining reports whether the server is drained.
+func (s *Server) Draining() bool {
+	return s.runtime.draining.get() != 0
+}
+
+// serveDrain drains or undrains the server on POST requests to the
+// admin API.
+func (s *Server) serveDrain(on bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			adminError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		by := adminID(r)
+		s.runtime.draining.set(boolSwitch(on), by)
+		log.Printf("admin: %s set drain to %s", by, formatSwitch(boolSwitch(on)))
+		writeJSON(w, r, s.runtime.draining.info())
+	}
+}
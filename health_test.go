@@ -0,0 +1,55 @@
+package marb
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHealthShadowedWarning(t *testing.T) {
+	s := newTestServer(t, Config{}, map[string]string{
+		"index.html": "home",
+		"healthz":    "site file",
+		"readyz.txt": "not shadowed",
+	})
+
+	var shadowed []string
+	for _, w := range s.Warnings() {
+		if w.Code == warnHealthShadowed {
+			shadowed = append(shadowed, w.Message)
+		}
+	}
+	if len(shadowed) != 1 {
+		t.Fatalf("health-shadowed warnings: %q, want one about /healthz", shadowed)
+	}
+
+	if rec := get(s, "/healthz"); rec.Code != http.StatusOK || rec.Body.String() != "ok\n" {
+		t.Errorf("/healthz: got %d %q, want the health check", rec.Code, rec.Body)
+	}
+	if rec := get(s, "/readyz.txt"); rec.Body.String() != "not shadowed" {
+		t.Errorf("/readyz.txt: got %d %q, want the site file", rec.Code, rec.Body)
+	}
+}
+
+func TestStartShutdown(t *testing.T) {
+	captureLog(t)
+	s := newTestServer(t, Config{}, map[string]string{"index.html": "home"})
+
+	check := func(when string, healthz, readyz int) {
+		t.Helper()
+		if rec := get(s, "/healthz"); rec.Code != healthz {
+			t.Errorf("%s: /healthz got %d, want %d", when, rec.Code, healthz)
+		}
+		if rec := get(s, "/readyz"); rec.Code != readyz {
+			t.Errorf("%s: /readyz got %d, want %d", when, rec.Code, readyz)
+		}
+		if rec := get(s, "/"); rec.Code != http.StatusOK || rec.Body.String() != "home" {
+			t.Errorf("%s: / got %d %q, want the site", when, rec.Code, rec.Body)
+		}
+	}
+	check("serving", http.StatusOK, http.StatusOK)
+	s.SetDraining(true, "test")
+	check("drained", http.StatusOK, http.StatusServiceUnavailable)
+	s.SetDraining(false, "test")
+	s.StartShutdown()
+	check("shutting down", http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+}
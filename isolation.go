@@ -0,0 +1,26 @@
+package marb
+
+import "net/http"
+
+// setIsolationHeaders sets the headers making pages under
+// CrossOriginIsolation cross-origin isolated: COOP and COEP on the
+// documents, and CORP on the resources they load, same-origin unless
+// the path matches CORPCrossOrigin. Error pages, which stand in for
+// either, get all three, so that a missing resource shows up as a 404
+// rather than as a blocked response.
+func (s *Server) setIsolationHeaders(h http.Header, r *http.Request, document, resource bool) {
+	if !s.crossOriginIsolation.match(r.URL.Path) {
+		return
+	}
+	if document {
+		h.Set("Cross-Origin-Opener-Policy", "same-origin")
+		h.Set("Cross-Origin-Embedder-Policy", "require-corp")
+	}
+	if resource {
+		if s.corpCrossOrigin.match(r.URL.Path) {
+			h.Set("Cross-Origin-Resource-Policy", "cross-origin")
+		} else {
+			h.Set("Cross-Origin-Resource-Policy", "same-origin")
+		}
+	}
+}
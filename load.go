@@ -0,0 +1,558 @@
+package marb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// sourceFile describes a file of the site as listed by its source.
+type sourceFile struct {
+	name     string // slash separated path relative to the root, with a leading slash
+	size     int64
+	modTime  time.Time
+	etag     string
+	location string // where the source reads the file from
+
+	// contentType is the content type on record at listing time, for
+	// sources that have it then.
+	contentType string
+}
+
+// source lists and reads the files of a site.
+type source interface {
+	list() ([]*sourceFile, error)
+
+	// read returns the contents of f, along with the content type the
+	// source has on record for it, if any.
+	read(f *sourceFile) ([]byte, string, error)
+}
+
+func newSource(root string) (source, error) {
+	if !strings.HasPrefix(root, "s3://") && !strings.HasPrefix(root, "gs://") {
+		return &fsSource{root: root}, nil
+	}
+
+	u, err := url.Parse(root)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s: missing bucket name", root)
+	}
+
+	if u.Scheme == "s3" {
+		return newS3Source(u)
+	}
+	return newGCSSource(u)
+}
+
+const (
+	openRetries   = 5
+	openRetryBase = 50 * time.Millisecond
+)
+
+func isFdExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// openFile opens name for reading, backing off and retrying a few times
+// when the process or the system has run out of file descriptors.
+func openFile(name string) (*os.File, error) {
+	delay := openRetryBase
+	for attempt := 0; ; attempt++ {
+		f, err := os.Open(name)
+		if err == nil || attempt == openRetries || !isFdExhausted(err) {
+			return f, err
+		}
+		log.Printf("%s: %v, retrying in %v", name, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func readDir(name string) ([]os.DirEntry, error) {
+	f, err := openFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries, err := f.ReadDir(-1)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, err
+}
+
+// fsSource reads a site from a local directory. Symbolic links to files
+// are followed, as long as they don't lead out of the root: those are
+// skipped with a warning, or fail the listing when strict is set.
+type fsSource struct {
+	root   string
+	strict bool
+}
+
+// isFile reports whether the root is a single file rather than a
+// directory.
+func (src *fsSource) isFile() bool {
+	fi, err := os.Stat(src.root)
+	return err == nil && !fi.IsDir()
+}
+
+func (src *fsSource) list() ([]*sourceFile, error) {
+	// the root itself may well be reached through links
+	root, err := filepath.EvalSymlinks(src.root)
+	if err != nil {
+		return nil, err
+	}
+	var files []*sourceFile
+	if err := src.walk(src.root, root, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// within reports whether the file at target is root or below it.
+func within(root, target string) bool {
+	rel, err := filepath.Rel(root, target)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+func (src *fsSource) walk(curPath string, root string, files *[]*sourceFile) error {
+	fi, err := os.Lstat(curPath)
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+		target, err := filepath.EvalSymlinks(curPath)
+		if err != nil {
+			return err
+		}
+		if curPath != src.root && !within(root, target) {
+			if src.strict {
+				return fmt.Errorf("%s: symbolic link to %s, outside the root", curPath, target)
+			}
+			log.Printf("warning: %s: symbolic link to %s, outside the root, skipped", curPath, target)
+			return nil
+		}
+		fi, err = os.Stat(curPath)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && curPath != src.root {
+			return fmt.Errorf("%s: directory symbolic links are not allowed", curPath)
+		}
+	}
+
+	if !fi.IsDir() {
+		name := strings.TrimPrefix(strings.TrimPrefix(curPath, path.Clean(src.root)), "/")
+		if name == "" {
+			// the root is a single file
+			name = path.Base(curPath)
+		}
+		*files = append(*files, &sourceFile{
+			name:     "/" + name,
+			size:     fi.Size(),
+			modTime:  fi.ModTime(),
+			location: curPath,
+		})
+		return nil
+	}
+
+	f, err := readDir(curPath)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range f {
+		if err = src.walk(path.Join(curPath, p.Name()), root, files); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (src *fsSource) read(sf *sourceFile) ([]byte, string, error) {
+	f, err := openFile(sf.location)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	contents := make([]byte, sf.size)
+	if _, err = io.ReadFull(f, contents); err != nil {
+		return nil, "", err
+	}
+	return contents, "", nil
+}
+
+// genericContentTypes are what object stores report for objects
+// uploaded without a content type, which is as good as none.
+var genericContentTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+}
+
+// extensionTypes pin the content type of extensions browsers are strict
+// about, whatever the system MIME tables say: for one,
+// WebAssembly.instantiateStreaming refuses anything but application/wasm.
+var extensionTypes = map[string]string{
+	".wasm": "application/wasm",
+}
+
+func typeByExtension(name string) string {
+	ext := path.Ext(name)
+	if t, ok := extensionTypes[strings.ToLower(ext)]; ok {
+		return t
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// newSiteFile makes a file out of its contents. Its type is contentType
+// unless that's generic, else guessed from its extension or contents,
+// defaultType being the last resort. It's gzipped, and compressed with
+// Brotli if brotli is set, each version only kept if it's smaller.
+func newSiteFile(name string, contents []byte, contentType, defaultType string, compact, brotli bool) *siteFile {
+	file := &siteFile{
+		name:     path.Base(name),
+		dir:      path.Dir(name),
+		contents: contents,
+		mimeType: contentType,
+		size:     len(contents),
+	}
+
+	if genericContentTypes[file.mimeType] {
+		file.mimeType = typeByExtension(name)
+	}
+	if file.mimeType == "" {
+		file.mimeType = http.DetectContentType(file.contents)
+		file.sniffed = true
+		if file.mimeType == "application/octet-stream" && defaultType != "" {
+			file.mimeType = defaultType
+			file.sniffed = false
+		}
+	}
+
+	if brotli {
+		if compressed, ok := compressContents(file.contents, "br"); ok {
+			file.brContents = compressed
+		}
+	}
+	gzipped, ok := compressContents(file.contents, "gzip")
+	if ok {
+		file.gzContents = gzipped
+		if compact {
+			file.contents = nil
+		}
+	}
+
+	return file
+}
+
+// indexOverrideName is the per-directory file whose contents name the
+// index document for that directory, overriding the global one.
+const indexOverrideName = ".index"
+
+func parseIndexOverride(name string, contents []byte) (string, error) {
+	index := strings.TrimSpace(string(contents))
+	if index == "" || strings.ContainsRune(index, '/') {
+		return "", fmt.Errorf("%s: invalid index name %q", name, index)
+	}
+	return index, nil
+}
+
+// checkSniffed fails with StrictMIME when files have a sniffed type,
+// listing them for the operator to add mappings.
+func (s *Server) checkSniffed(files []*siteFile) error {
+	if !s.StrictMIME {
+		return nil
+	}
+	var sniffed []string
+	for _, f := range files {
+		if f == nil || !f.sniffed {
+			continue
+		}
+		ext := strings.ToLower(path.Ext(f.name))
+		allowed := false
+		for _, a := range s.StrictMIMEAllow {
+			allowed = allowed || ext == strings.ToLower(a)
+		}
+		if !allowed {
+			sniffed = append(sniffed, fmt.Sprintf("%s (%s)", path.Join(f.dir, f.name), f.mimeType))
+		}
+	}
+	if len(sniffed) > 0 {
+		return fmt.Errorf("strict MIME: content type of %d files sniffed, map their extensions or allow them: %s", len(sniffed), strings.Join(sniffed, ", "))
+	}
+	return nil
+}
+
+// gzipSidecarExt marks precompressed versions of files, served in their
+// stead to clients accepting gzip.
+const gzipSidecarExt = ".gz"
+
+// useGzipSidecars replaces the gzipped version of files having a .gz
+// sidecar with the sidecar, which then isn't served by itself, along
+// with its modification time. A
+// sidecar that is corrupt or doesn't decompress to its base file is
+// ignored, leaving the gzipped version computed at load time, unless
+// strict is set in which case it fails the load.
+func useGzipSidecars(files []*siteFile, compact bool, strict bool) error {
+	byName := make(map[string]*siteFile, len(files))
+	for _, f := range files {
+		if f != nil {
+			byName[path.Join(f.dir, f.name)] = f
+		}
+	}
+
+	for i, sidecar := range files {
+		if sidecar == nil || path.Ext(sidecar.name) != gzipSidecarExt {
+			continue
+		}
+		name := path.Join(sidecar.dir, sidecar.name)
+		base := byName[strings.TrimSuffix(name, gzipSidecarExt)]
+		if base == nil {
+			continue
+		}
+
+		err := checkGzipSidecar(base, sidecar)
+		if err != nil && strict {
+			return err
+		}
+		if err != nil {
+			log.Printf("%v, compressing %s at load time instead", err, path.Join(base.dir, base.name))
+			files[i] = nil
+			continue
+		}
+
+		base.gzContents = sidecar.contents
+		base.gzLastModified = sidecar.lastModified
+		if compact {
+			base.contents = nil
+		}
+		files[i] = nil
+	}
+	return nil
+}
+
+// checkGzipSidecar decompresses sidecar, which verifies its checksum and
+// length, and compares the result with base.
+func checkGzipSidecar(base *siteFile, sidecar *siteFile) error {
+	name := path.Join(sidecar.dir, sidecar.name)
+	contents, err := sidecar.identity()
+	if err != nil {
+		return err
+	}
+	decompressed, err := decompressContents(contents)
+	if err != nil {
+		return fmt.Errorf("%s: corrupt gzip sidecar: %v", name, err)
+	}
+	identity, err := base.identity()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(decompressed, identity) {
+		return fmt.Errorf("%s: gzip sidecar doesn't match %s", name, base.name)
+	}
+	return nil
+}
+
+// loadFiles reads the whole site into a fresh snapshot. At most
+// LoadWorkers files are read at any time, which for local roots bounds
+// the open descriptors, on top of the directory being walked. Nothing
+// is published until every file was read successfully.
+//
+// Files of prev whose ETag, as reported by the source, didn't change
+// are reused rather than read again.
+func (s *Server) loadFiles(src source, prev *siteSnapshot) (*siteSnapshot, error) {
+	list, err := src.list()
+	if err != nil {
+		return nil, err
+	}
+	list, deep := s.skipDeep(list)
+
+	var prevPaths map[string]*siteFile
+	if prev != nil {
+		prevPaths = prev.paths()
+	}
+
+	workers := s.Workers()
+	files := make([]*siteFile, len(list))
+	overrides := make([][]byte, len(list))
+	metas := make([][]byte, len(list))
+	errs := make([]error, len(list))
+	next := make(chan int)
+	var failed int32
+	var resident, overBudget int64
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if atomic.LoadInt32(&failed) != 0 {
+					continue
+				}
+				// files with metadata are read again, for it not to stick
+				// once their sidecar is gone
+				if old := prevPaths[list[i].name]; old != nil && old.meta == nil && list[i].etag != "" && old.etag == list[i].etag {
+					reused := *old
+					files[i] = &reused
+					continue
+				}
+				contents, contentType, err := src.read(list[i])
+				if err != nil {
+					errs[i] = err
+					atomic.StoreInt32(&failed, 1)
+					continue
+				}
+				if path.Base(list[i].name) == indexOverrideName {
+					overrides[i] = contents
+					continue
+				}
+				if strings.HasSuffix(list[i].name, metaSidecarExt) {
+					metas[i] = contents
+					continue
+				}
+				if s.liveReload != nil && strings.HasPrefix(mime.TypeByExtension(path.Ext(list[i].name)), "text/html") {
+					contents = injectLiveReload(contents)
+				}
+				f := newSiteFile(list[i].name, contents, contentType, s.DefaultMIME, s.Compact, s.Brotli)
+				f.lastModified = list[i].modTime
+				f.etag = list[i].etag
+				if s.SRI {
+					f.sri = sriDigest(contents)
+				}
+				f.checksums = s.checksums(list[i].name, contents)
+				f.nonced = strings.Contains(s.CSP, cspNoncePlaceholder) && isHTML(f) && bytes.Contains(contents, []byte(cspNoncePlaceholder))
+				files[i] = f
+				if s.maxTotalSize > 0 && s.MaxTotalSizeAction != maxTotalSizeWarn &&
+					atomic.AddInt64(&resident, f.residentSize()) > s.maxTotalSize {
+					// stop before memory runs out
+					atomic.StoreInt64(&overBudget, 1)
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+
+	for i := range list {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if overBudget != 0 {
+		return nil, errors.New(s.overBudget(files, false))
+	}
+
+	if err := useGzipSidecars(files, s.Compact, s.Strict); err != nil {
+		return nil, err
+	}
+
+	orphans, err := applyFileMetas(files, list, metas)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkSniffed(files); err != nil {
+		return nil, err
+	}
+	warnings := newWarnings(nil, warnMetaOrphan, orphans...)
+
+	if !s.NoSecretScan {
+		secrets, err := s.scanSecrets(files)
+		if err != nil {
+			return nil, err
+		}
+		warnings = newWarnings(warnings, warnSecret, secrets...)
+	}
+	if s.maxTotalSize > 0 {
+		if problem := s.overBudget(files, true); problem != "" {
+			if s.MaxTotalSizeAction != maxTotalSizeWarn {
+				return nil, errors.New(problem)
+			}
+			warnings = newWarnings(warnings, warnOverBudget, problem)
+		}
+	}
+
+	indexes := make(map[string]string)
+	for i, contents := range overrides {
+		if contents != nil {
+			dir := path.Dir(list[i].name)
+			if indexes[dir], err = parseIndexOverride(list[i].name, contents); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	snap := &siteSnapshot{files: make(map[string]*siteFile, len(files)), warnings: warnings}
+	if len(deep) > 0 {
+		snap.warn(warnTooDeep, "skipped %d files deeper than %d levels, like %s", len(deep), s.MaxPathDepth, deep[0])
+	}
+	for _, f := range files {
+		if f != nil {
+			s.addFile(snap, f, indexes)
+		}
+	}
+	s.addRegistered(snap)
+	s.addSecurityTxt(snap)
+	checkHealthPaths(snap)
+	if err := s.loadAssetManifest(snap); err != nil {
+		return nil, err
+	}
+	if s.AutoIndex {
+		if err := buildListings(snap); err != nil {
+			return nil, err
+		}
+	}
+	if s.NotFound != "" {
+		snap.error404 = snap.files[path.Join("/", s.NotFound)]
+	}
+	s.setRootFallback(snap)
+	snap.count = len(snap.paths())
+	if s.RoutesPath != "" {
+		if snap.routes, err = buildRoutes(snap); err != nil {
+			return nil, err
+		}
+	}
+	if s.SearchPath != "" {
+		snap.search = s.buildSearchIndex(snap)
+	}
+	if !s.NoSuggestions {
+		snap.suggester = newSuggester(snap)
+		if snap.error404 != nil {
+			page, err := snap.error404.identity()
+			if err != nil {
+				return nil, err
+			}
+			if bytes.Contains(page, []byte(suggestionsPlaceholder)) {
+				snap.error404Tpl = page
+			}
+		}
+	}
+
+	return snap, nil
+}
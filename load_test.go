@@ -0,0 +1,190 @@
+package marb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIndexOverride(t *testing.T) {
+	s := newTestServer(t, Config{}, map[string]string{
+		"index.html":      "root index",
+		"docs/.index":     "home.html\n",
+		"docs/home.html":  "docs home",
+		"docs/index.html": "not the index here",
+		"blog/index.html": "blog index",
+	})
+
+	for _, tt := range []struct {
+		path     string
+		status   int
+		body     string
+		location string
+	}{
+		{"/", http.StatusOK, "root index", ""},
+		{"/docs/", http.StatusOK, "docs home", ""},
+		{"/docs", http.StatusOK, "docs home", ""},
+		{"/docs/home.html", http.StatusMovedPermanently, "", "/docs"},
+		{"/docs/index.html", http.StatusOK, "not the index here", ""},
+		{"/blog/", http.StatusOK, "blog index", ""},
+		{"/docs/.index", http.StatusNotFound, "", ""},
+	} {
+		rec := get(s, tt.path)
+		if rec.Code != tt.status || tt.body != "" && rec.Body.String() != tt.body || rec.Header().Get("Location") != tt.location {
+			t.Errorf("%s: got %d %q to %q, want %d %q to %q", tt.path, rec.Code, rec.Body, rec.Header().Get("Location"), tt.status, tt.body, tt.location)
+		}
+	}
+}
+
+func TestIndexOverrideInvalid(t *testing.T) {
+	if _, err := parseIndexOverride("/docs/.index", []byte("sub/home.html")); err == nil {
+		t.Error("an index override naming a file in a subdirectory was accepted")
+	}
+	if _, err := parseIndexOverride("/docs/.index", []byte(" \n")); err == nil {
+		t.Error("an empty index override was accepted")
+	}
+}
+
+func gzipped(t *testing.T, s string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	zw.Write([]byte(s))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestGzipSidecars(t *testing.T) {
+	script := strings.Repeat("console.log('the same line, over and over');\n", 50)
+	sidecar := gzipped(t, script)
+	s := newTestServer(t, Config{}, map[string]string{
+		"app.js":       script,
+		"app.js.gz":    sidecar,
+		"other.js":     script,
+		"other.js.gz":  gzipped(t, "something else"),
+		"broken.js":    script,
+		"broken.js.gz": sidecar[:len(sidecar)-8],
+	})
+
+	for _, tt := range []struct {
+		path    string
+		sidecar bool
+	}{
+		{"/app.js", true},
+		{"/other.js", false},
+		{"/broken.js", false},
+	} {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+		if rec.Header().Get("Content-Encoding") != "gzip" || (rec.Body.String() == sidecar) != tt.sidecar {
+			t.Errorf("%s: sidecar served %v with Content-Encoding %q, want %v with gzip", tt.path, rec.Body.String() == sidecar, rec.Header().Get("Content-Encoding"), tt.sidecar)
+		}
+		if rec := get(s, tt.path+".gz"); rec.Code != http.StatusNotFound {
+			t.Errorf("%s.gz: got %d, want the sidecar not to be served by itself", tt.path, rec.Code)
+		}
+	}
+
+	for _, broken := range []map[string]string{
+		{"index.html": "home", "app.js": script, "app.js.gz": sidecar[:len(sidecar)-8]},
+		{"index.html": "home", "app.js": script, "app.js.gz": gzipped(t, "something else")},
+	} {
+		if _, err := New(Config{Root: writeSite(t, broken), Strict: true}); err == nil {
+			t.Error("Strict: a bad gzip sidecar didn't fail the load")
+		}
+	}
+}
+
+func TestDefaultMIME(t *testing.T) {
+	files := map[string]string{
+		"index.html":   "home",
+		"data.xyz123":  "\x00\x01\x02binary",
+		"notes.xyz123": "plain words",
+		"style.css":    "body{}",
+	}
+	for _, tt := range []struct {
+		defaultMIME string
+		want        map[string]string
+	}{
+		{"", map[string]string{"/data.xyz123": "application/octet-stream", "/notes.xyz123": "text/plain; charset=utf-8", "/style.css": "text/css; charset=utf-8"}},
+		{"application/x-custom", map[string]string{"/data.xyz123": "application/x-custom", "/notes.xyz123": "text/plain; charset=utf-8", "/style.css": "text/css; charset=utf-8"}},
+	} {
+		s := newTestServer(t, Config{DefaultMIME: tt.defaultMIME}, files)
+		for p, want := range tt.want {
+			if got := get(s, p).Header().Get("Content-Type"); got != want {
+				t.Errorf("DefaultMIME %q, %s: Content-Type %q, want %q", tt.defaultMIME, p, got, want)
+			}
+		}
+	}
+
+	if _, err := New(Config{Root: writeSite(t, files), DefaultMIME: "not a type;;"}); err == nil {
+		t.Error("invalid default MIME type accepted")
+	}
+}
+
+func TestWasmType(t *testing.T) {
+	module := "\x00asm\x01\x00\x00\x00"
+	s := newTestServer(t, Config{DefaultMIME: "text/plain"}, map[string]string{
+		"app.wasm": module,
+		"APP.WASM": module,
+	})
+	for _, p := range []string{"/app.wasm", "/APP.WASM"} {
+		if got := get(s, p).Header().Get("Content-Type"); got != "application/wasm" {
+			t.Errorf("%s: Content-Type %q, want application/wasm", p, got)
+		}
+	}
+}
+
+func TestGzipSidecarLastModified(t *testing.T) {
+	script := strings.Repeat("console.log('the same line, over and over');\n", 50)
+	root := writeSite(t, map[string]string{"app.js": script, "app.js.gz": gzipped(t, script)})
+	base := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	later := base.Add(time.Hour)
+	for name, modTime := range map[string]time.Time{"app.js": base, "app.js.gz": later} {
+		if err := os.Chtimes(filepath.Join(root, name), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := New(Config{Root: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, tt := range []struct {
+		encoding     string
+		modSince     time.Time
+		lastModified time.Time
+		status       int
+	}{
+		{"", time.Time{}, base, http.StatusOK},
+		{"gzip", time.Time{}, later, http.StatusOK},
+		{"", base, base, http.StatusNotModified},
+		// the sidecar was written after the copy the client has
+		{"gzip", base, later, http.StatusOK},
+		{"gzip", later, later, http.StatusNotModified},
+	} {
+		r := httptest.NewRequest("GET", "/app.js", nil)
+		r.Header.Set("Accept-Encoding", tt.encoding)
+		if !tt.modSince.IsZero() {
+			r.Header.Set("If-Modified-Since", tt.modSince.Format(http.TimeFormat))
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+		if rec.Code != tt.status {
+			t.Errorf("%q since %v: got %d, want %d", tt.encoding, tt.modSince, rec.Code, tt.status)
+		}
+		if got := rec.Header().Get("Last-Modified"); got != tt.lastModified.Format(http.TimeFormat) {
+			t.Errorf("%q since %v: Last-Modified %s, want %s", tt.encoding, tt.modSince, got, tt.lastModified.Format(http.TimeFormat))
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package marb
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultLoadingRetryAfter = 5 * time.Second
+
+// serveLoading answers 503 to every request while the files are first
+// loaded in the background, reporting whether it did, so that clients
+// come back later rather than getting a 404 for every path.
+func (s *Server) serveLoading(w http.ResponseWriter, r *http.Request) bool {
+	if !s.current().loading {
+		return false
+	}
+	retryAfter := s.LoadingRetryAfter
+	if retryAfter <= 0 {
+		retryAfter = defaultLoadingRetryAfter
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Retry-After", strconv.FormatInt(int64((retryAfter+time.Second-1)/time.Second), 10))
+	writeDynamic(w, r, http.StatusServiceUnavailable, "text/plain; charset=utf-8", []byte("loading, try again shortly\n"))
+	return true
+}
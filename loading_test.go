@@ -0,0 +1,44 @@
+package marb
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadInBackground(t *testing.T) {
+	captureLog(t)
+	// a load over budget fails, leaving the server loading until a
+	// reload succeeds
+	s := newTestServer(t, Config{LoadInBackground: true, LoadingRetryAfter: 1500 * time.Millisecond, MaxTotalSize: "1KB"},
+		map[string]string{"index.html": "home", "big.bin": noise(2000)})
+
+	rec := get(s, "/")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "2" {
+		t.Errorf("while loading: got %d with Retry-After %q, want 503 with 2", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("while loading: Cache-Control %q, want no-store", rec.Header().Get("Cache-Control"))
+	}
+	if rec := get(s, "/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("while loading: /readyz got %d, want 503", rec.Code)
+	}
+	if rec := get(s, "/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("while loading: /healthz got %d, want 200", rec.Code)
+	}
+
+	if err := os.Remove(filepath.Join(s.Root, "big.bin")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(s, "/"); rec.Code != http.StatusOK || rec.Body.String() != "home" {
+		t.Errorf("once loaded: got %d %q", rec.Code, rec.Body)
+	}
+	if rec := get(s, "/readyz"); rec.Code != http.StatusOK {
+		t.Errorf("once loaded: /readyz got %d, want 200", rec.Code)
+	}
+}
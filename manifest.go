@@ -0,0 +1,154 @@
+package marb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// immutableCacheControl is sent with fingerprinted assets, whose
+// contents never change under a given name.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// viteChunk is an entry of a Vite manifest, keyed by source path.
+type viteChunk struct {
+	File    string   `json:"file"`
+	IsEntry bool     `json:"isEntry"`
+	CSS     []string `json:"css"`
+	Assets  []string `json:"assets"`
+	Imports []string `json:"imports"`
+}
+
+// loadAssetManifest reads the asset manifest of snap, a JSON object
+// mapping logical asset names to their fingerprinted names, like
+// {"app.js": "app.abc123.js"}, as webpack emits, or a Vite manifest
+// mapping source paths to chunks. Names are relative to the root, with
+// or without a leading slash. Only the former kind gets redirects, but
+// the fingerprinted files of both are immutable, and those missing are
+// warned about. The manifest itself isn't served unless
+// ServeAssetManifest is set.
+func (s *Server) loadAssetManifest(snap *siteSnapshot) error {
+	if s.AssetManifest == "" {
+		return nil
+	}
+
+	name := path.Join("/", s.AssetManifest)
+	f := snap.files[name]
+	if f == nil {
+		return fmt.Errorf("%s: asset manifest not found", name)
+	}
+	contents, err := f.identity()
+	if err != nil {
+		return err
+	}
+	if !s.ServeAssetManifest {
+		delete(snap.files, name)
+	}
+
+	var manifest map[string]json.RawMessage
+	if err := json.Unmarshal(contents, &manifest); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	snap.assets = make(map[string]string, len(manifest))
+	snap.immutable = make(map[string]bool, len(manifest))
+	chunks := make(map[string]viteChunk)
+	fingerprinted := func(logical, target string) error {
+		if strings.Contains(target, "://") {
+			return fmt.Errorf("%s: %s: only local assets are supported", name, logical)
+		}
+		target = path.Join("/", target)
+		if snap.files[target] == nil {
+			snap.warn(warnManifestMissing, "%s: %s refers to missing %s", name, logical, target)
+		}
+		snap.immutable[target] = true
+		return nil
+	}
+	for logical, raw := range manifest {
+		var target string
+		if err := json.Unmarshal(raw, &target); err == nil {
+			if err := fingerprinted(logical, target); err != nil {
+				return err
+			}
+			snap.assets[path.Join("/", logical)] = path.Join("/", target)
+			continue
+		}
+
+		var chunk viteChunk
+		if err := json.Unmarshal(raw, &chunk); err != nil {
+			return fmt.Errorf("%s: %s: %v", name, logical, err)
+		}
+		for _, target := range append(append([]string{chunk.File}, chunk.CSS...), chunk.Assets...) {
+			if err := fingerprinted(logical, target); err != nil {
+				return err
+			}
+		}
+		chunks[logical] = chunk
+	}
+
+	if s.AssetPreload {
+		for page, link := range vitePreloads(chunks) {
+			if f := snap.files[page]; f != nil {
+				f.preload = link
+			}
+		}
+	}
+	return nil
+}
+
+// vitePreloads returns the Link header of the HTML entries of a Vite
+// manifest, by path, preloading their scripts and stylesheets along
+// with those they statically import.
+func vitePreloads(chunks map[string]viteChunk) map[string]string {
+	preloads := make(map[string]string)
+	for key, chunk := range chunks {
+		if !chunk.IsEntry || path.Ext(key) != ".html" {
+			continue
+		}
+
+		var links []string
+		seen := make(map[string]bool)
+		var visit func(key string)
+		visit = func(key string) {
+			if seen[key] {
+				return
+			}
+			seen[key] = true
+			chunk := chunks[key]
+			for _, css := range chunk.CSS {
+				links = append(links, "<"+path.Join("/", css)+">; rel=preload; as=style")
+			}
+			if chunk.File != "" {
+				links = append(links, "<"+path.Join("/", chunk.File)+">; rel=modulepreload")
+			}
+			for _, imported := range chunk.Imports {
+				visit(imported)
+			}
+		}
+		visit(key)
+		if len(links) > 0 {
+			preloads[path.Join("/", key)] = strings.Join(links, ", ")
+		}
+	}
+	return preloads
+}
+
+// redirectAsset redirects requests for a logical asset name to its
+// fingerprinted one, reporting whether it did. The redirect itself must
+// not be cached, as the next deploy may change it.
+func (s *Server) redirectAsset(w http.ResponseWriter, r *http.Request, snap *siteSnapshot) bool {
+	target, ok := snap.assets[rootedPath(r.URL.Path)]
+	if !ok {
+		return false
+	}
+
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	setResult(r, resultRedirect)
+	http.Redirect(w, r, target, http.StatusFound)
+	return true
+}
@@ -0,0 +1,62 @@
+package marb
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAssetManifest(t *testing.T) {
+	s := newTestServer(t, Config{AssetManifest: "manifest.json"}, map[string]string{
+		"index.html":           "home",
+		"manifest.json":        `{"app.js": "assets/app.abc123.js", "/missing.css": "assets/missing.def456.css"}`,
+		"assets/app.abc123.js": "console.log(1)",
+	})
+
+	for _, tt := range []struct {
+		path         string
+		status       int
+		location     string
+		cacheControl string
+	}{
+		{"/app.js", http.StatusFound, "/assets/app.abc123.js", "no-cache"},
+		{"/app.js?v=2", http.StatusFound, "/assets/app.abc123.js?v=2", "no-cache"},
+		{"/assets/app.abc123.js", http.StatusOK, "", immutableCacheControl},
+		{"/manifest.json", http.StatusNotFound, "", ""},
+	} {
+		rec := get(s, tt.path)
+		if rec.Code != tt.status || rec.Header().Get("Location") != tt.location || rec.Header().Get("Cache-Control") != tt.cacheControl {
+			t.Errorf("%s: got %d to %q with Cache-Control %q, want %d to %q with %q", tt.path, rec.Code, rec.Header().Get("Location"), rec.Header().Get("Cache-Control"), tt.status, tt.location, tt.cacheControl)
+		}
+	}
+
+	var missing []Warning
+	for _, w := range s.Warnings() {
+		if w.Code == warnManifestMissing {
+			missing = append(missing, w)
+		}
+	}
+	if len(missing) != 1 {
+		t.Errorf("manifest-missing warnings %v, want one about /assets/missing.def456.css", missing)
+	}
+}
+
+func TestAssetManifestVite(t *testing.T) {
+	s := newTestServer(t, Config{AssetManifest: ".vite/manifest.json", AssetPreload: true}, map[string]string{
+		"index.html": "home",
+		".vite/manifest.json": `{
+			"index.html": {"file": "assets/index.1.js", "isEntry": true, "css": ["assets/index.2.css"], "imports": ["_shared"]},
+			"_shared": {"file": "assets/shared.3.js"}
+		}`,
+		"assets/index.1.js":  "main()",
+		"assets/index.2.css": "body{}",
+		"assets/shared.3.js": "shared()",
+	})
+
+	want := "</assets/index.2.css>; rel=preload; as=style, </assets/index.1.js>; rel=modulepreload, </assets/shared.3.js>; rel=modulepreload"
+	if got := get(s, "/").Header().Get("Link"); got != want {
+		t.Errorf("Link of /: %q, want %q", got, want)
+	}
+	if got := get(s, "/assets/shared.3.js").Header().Get("Cache-Control"); got != immutableCacheControl {
+		t.Errorf("Cache-Control of an imported chunk: %q, want %q", got, immutableCacheControl)
+	}
+}
@@ -0,0 +1,1846 @@
+// Package marb serves static sites from memory.
+package marb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+type siteFile struct {
+	contents     []byte // identity bytes, nil for gzip-only files in compact mode
+	gzContents   []byte // nil when gzip doesn't make the file smaller
+	brContents   []byte // nil without Brotli, or when it doesn't make the file smaller
+	mimeType     string
+	size         int // of the identity bytes
+	isIndex      bool
+	etag         string            // as reported by the source, empty for local files
+	sri          string            // Subresource Integrity value, if computed
+	checksums    map[string]string // hex digests by algorithm, for checksum sidecars
+	nonced       bool              // HTML holding the CSP nonce placeholder
+	sniffed      bool              // type detected from the contents
+	preload      string            // Link header preloading what the page needs
+	meta         *fileMeta         // from its metadata sidecar, if any
+	headers      fileHeaders
+	name         string
+	dir          string
+	lastModified time.Time
+	// of the gzip sidecar served in place of gzipping the file, which
+	// may have been written later, zero otherwise
+	gzLastModified time.Time
+}
+
+// encoding returns the content coding full responses are sent with to
+// clients accepting gzip.
+func (f *siteFile) encoding() string {
+	if f.gzContents != nil {
+		return "gzip"
+	}
+	return ""
+}
+
+// body returns the bytes of the representation with the given content
+// coding, "" meaning identity.
+func (f *siteFile) body(encoding string) []byte {
+	switch encoding {
+	case "gzip":
+		return f.gzContents
+	case "br":
+		return f.brContents
+	}
+	return f.contents
+}
+
+// modTime returns the modification time of the representation with the
+// given content coding, "" meaning identity.
+func (f *siteFile) modTime(encoding string) time.Time {
+	if encoding == "gzip" && !f.gzLastModified.IsZero() {
+		return f.gzLastModified
+	}
+	return f.lastModified
+}
+
+// identity returns the uncompressed bytes, decompressing them if only
+// the gzipped version is kept.
+func (f *siteFile) identity() ([]byte, error) {
+	if f.contents != nil || f.gzContents == nil {
+		return f.contents, nil
+	}
+	return decompressContents(f.gzContents)
+}
+
+// fileHeaders are the header values describing a file, formatted once
+// it's loaded rather than on every request. Responses share them, which
+// is fine as headers are only ever replaced, never appended to in place.
+// All lengths are known in compact mode too, size being kept when the
+// identity bytes aren't, so HEAD responses always advertise the length
+// a GET would get, without compressing or decompressing anything.
+type fileHeaders struct {
+	contentLength   []string // of the identity bytes
+	gzContentLength []string
+	brContentLength []string
+	contentType     []string
+	lastModified    []string // of the identity bytes
+	gzLastModified  []string
+}
+
+var (
+	gzipEncoding       = []string{"gzip"}
+	brotliEncoding     = []string{"br"}
+	acceptRangesBytes  = []string{"bytes"}
+	varyAcceptEncoding = []string{"Accept-Encoding"}
+	nosniff            = []string{"nosniff"}
+)
+
+// formatHeaders fills in f.headers, to be called once f is complete.
+func (f *siteFile) formatHeaders() {
+	f.headers = fileHeaders{
+		contentLength:   []string{strconv.Itoa(f.size)},
+		gzContentLength: []string{strconv.Itoa(len(f.gzContents))},
+		brContentLength: []string{strconv.Itoa(len(f.brContents))},
+		contentType:     []string{f.mimeType},
+		lastModified:    []string{f.lastModified.UTC().Format(http.TimeFormat)},
+	}
+	f.headers.gzLastModified = f.headers.lastModified
+	if !f.gzLastModified.IsZero() {
+		f.headers.gzLastModified = []string{f.gzLastModified.UTC().Format(http.TimeFormat)}
+	}
+}
+
+func (f *siteFile) SetHeaders(h http.Header, encoding string) {
+	h["Content-Type"] = f.headers.contentType
+	switch encoding {
+	case "gzip":
+		h["Content-Length"] = f.headers.gzContentLength
+		h["Last-Modified"] = f.headers.gzLastModified
+		h["Content-Encoding"] = gzipEncoding
+	case "br":
+		h["Content-Length"] = f.headers.brContentLength
+		h["Last-Modified"] = f.headers.lastModified
+		h["Content-Encoding"] = brotliEncoding
+	default:
+		h["Content-Length"] = f.headers.contentLength
+		h["Last-Modified"] = f.headers.lastModified
+	}
+}
+
+// brotliQuality trades load time for smaller files: Brotli's best is
+// too slow for large sites to load in reasonable time.
+const brotliQuality = 9
+
+// compressContents compresses contents with the given content coding,
+// gzip or br.
+func compressContents(contents []byte, encoding string) ([]byte, bool) {
+	var buf bytes.Buffer
+
+	var zw io.WriteCloser
+	if encoding == "br" {
+		zw = brotli.NewWriterLevel(&buf, brotliQuality)
+	} else {
+		zw = gzip.NewWriter(&buf)
+	}
+	_, err := zw.Write(contents)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		log.Printf("could not compress with %s: %v", encoding, err)
+		return nil, false
+	}
+
+	if buf.Len() >= len(contents) {
+		// if size doesn't get reduced, then what's the point?
+		return nil, false
+	}
+
+	return buf.Bytes(), true
+}
+
+// defaultMaxIgnoredBody is the largest body drained from requests that
+// have no use for one.
+const defaultMaxIgnoredBody = 4 << 10
+
+// dynamicGzipThreshold is the smallest generated response worth
+// compressing on the fly.
+const dynamicGzipThreshold = 1024
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(io.Discard) },
+}
+
+// gzipBuffers hold dynamic bodies while they're compressed.
+var gzipBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// codingQ returns the q-value an Accept-Encoding header value gives
+// coding, a lowercase token, and whether it lists it at all. Real-world
+// headers aren't always well-formed: empty elements are skipped, as are
+// those whose coding isn't a token or whose q-value doesn't parse, so
+// that a header making no sense at all accepts nothing but identity. A
+// coding listed twice gets the lowest of its q-values. Being called on
+// most requests, it scans the header in place rather than splitting it.
+func codingQ(header, coding string) (q float64, listed bool) {
+	for rest := header; rest != ""; {
+		var part string
+		part, rest, _ = strings.Cut(rest, ",")
+		token, params, _ := strings.Cut(part, ";")
+		if token = strings.TrimSpace(token); !strings.EqualFold(token, coding) || !isToken(token) {
+			continue
+		}
+
+		partQ, ok := 1.0, true
+		for params != "" {
+			var param string
+			param, params, _ = strings.Cut(params, ";")
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(strings.TrimSpace(name), "q") {
+				var err error
+				partQ, err = strconv.ParseFloat(strings.TrimSpace(value), 64)
+				ok = err == nil && partQ >= 0 && partQ <= 1
+			}
+		}
+		if ok && (!listed || partQ < q) {
+			q, listed = partQ, true
+		}
+	}
+	return q, listed
+}
+
+// isToken reports whether s is a token, as defined by RFC 9110: one or
+// more of a restricted set of characters.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+			continue
+		}
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header value
+// allows the given content coding, honoring q-values and wildcards.
+func acceptsEncoding(header string, coding string) bool {
+	return encodingQ(header, coding) > 0
+}
+
+// encodingQ returns the q-value the Accept-Encoding header value gives
+// the given content coding, or failing that the wildcard, 0 if neither
+// is listed.
+func encodingQ(header string, coding string) float64 {
+	if q, ok := codingQ(header, coding); ok {
+		return q
+	}
+	q, _ := codingQ(header, "*")
+	return q
+}
+
+// acceptsIdentity reports whether the Accept-Encoding header value
+// allows no content coding at all, which only an explicit identity;q=0,
+// or *;q=0 without identity listed, refuses.
+func acceptsIdentity(header string) bool {
+	if q, ok := codingQ(header, "identity"); ok {
+		return q > 0
+	}
+	if q, ok := codingQ(header, "*"); ok {
+		return q > 0
+	}
+	return true
+}
+
+// negotiateEncoding returns the content coding f is sent with in
+// answer to r, "" meaning identity: of the compressed versions f has,
+// the one the client gives the highest q-value, Brotli winning ties,
+// as long as it accepts any. Responses for files having one vary with
+// Accept-Encoding.
+func negotiateEncoding(h http.Header, r *http.Request, f *siteFile) string {
+	if f.gzContents == nil && f.brContents == nil {
+		return ""
+	}
+	varyOnEncoding(h)
+	header := r.Header.Get("Accept-Encoding")
+	encoding, best := "", 0.0
+	if f.brContents != nil {
+		if q := encodingQ(header, "br"); q > best {
+			encoding, best = "br", q
+		}
+	}
+	if f.gzContents != nil {
+		if q := encodingQ(header, "gzip"); q > best {
+			encoding = "gzip"
+		}
+	}
+	return encoding
+}
+
+// varyOnEncoding adds Accept-Encoding to the Vary header of h.
+func varyOnEncoding(h http.Header) {
+	if len(h["Vary"]) == 0 {
+		h["Vary"] = varyAcceptEncoding
+	} else {
+		h.Add("Vary", "Accept-Encoding")
+	}
+}
+
+// applyEncodingHint merges the codings EncodingHintHeader says the
+// client accepts into the Accept-Encoding header of r, for whatever
+// negotiates content codings further down to take them into account.
+func (s *Server) applyEncodingHint(w http.ResponseWriter, r *http.Request) {
+	if s.EncodingHintHeader == "" {
+		return
+	}
+	w.Header().Add("Vary", s.EncodingHintHeader)
+	hint := r.Header.Get(s.EncodingHintHeader)
+	if hint == "" {
+		return
+	}
+	if header := r.Header.Get("Accept-Encoding"); header != "" {
+		hint = header + ", " + hint
+	}
+	r.Header.Set("Accept-Encoding", hint)
+}
+
+// serveNotAcceptable answers 406 to requests for f refusing every
+// content coding it's available in, when StrictEncoding is set,
+// reporting whether it did. Otherwise such clients get it in identity,
+// as RFC 9110 allows.
+func (s *Server) serveNotAcceptable(w http.ResponseWriter, r *http.Request, f *siteFile) bool {
+	header := r.Header.Get("Accept-Encoding")
+	if !s.StrictEncoding || acceptsIdentity(header) || f.gzContents != nil && acceptsEncoding(header, "gzip") ||
+		f.brContents != nil && acceptsEncoding(header, "br") {
+		return false
+	}
+	available := "identity"
+	if f.gzContents != nil {
+		available += ", gzip"
+	}
+	if f.brContents != nil {
+		available += ", br"
+	}
+	setResult(r, resultNotAcceptable)
+	w.Header()["X-Content-Type-Options"] = nosniff
+	writeDynamic(w, r, http.StatusNotAcceptable, "text/plain; charset=utf-8",
+		[]byte(fmt.Sprintf("406 not acceptable: %s is only available as %s, which Accept-Encoding refuses\n", r.URL.Path, available)))
+	return true
+}
+
+// writeDynamic sends a generated response body, compressing it on the
+// fly when it's large enough and the client accepts gzip. Like
+// compressContents, it sends the body uncompressed when gzip doesn't
+// make it smaller, which the compressed size tells before anything is
+// written. HEAD requests go through the same steps to get the same
+// headers. Static files never go through here, as they are already
+// compressed at load time.
+func writeDynamic(w http.ResponseWriter, r *http.Request, status int, contentType string, body []byte) {
+	writeCompressed(w, r, status, contentType, body, dynamicGzipThreshold)
+}
+
+// saveData reports whether r carries the Save-Data client hint, asking
+// for as few bytes as possible, even at some CPU cost.
+func saveData(r *http.Request) bool {
+	token, _, _ := strings.Cut(r.Header.Get("Save-Data"), ";")
+	return strings.EqualFold(strings.TrimSpace(token), "on")
+}
+
+// writeCompressed is writeDynamic compressing bodies of at least
+// threshold bytes, or of any size for clients asking to save data.
+func writeCompressed(w http.ResponseWriter, r *http.Request, status int, contentType string, body []byte, threshold int) {
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	varyOnEncoding(h)
+	if threshold > 0 {
+		h.Add("Vary", "Save-Data")
+		if saveData(r) {
+			threshold = 0
+		}
+	}
+
+	if len(body) >= threshold && acceptsEncoding(r.Header.Get("Accept-Encoding"), "gzip") {
+		buf := gzipBuffers.Get().(*bytes.Buffer)
+		defer gzipBuffers.Put(buf)
+		buf.Reset()
+
+		zw := gzipWriters.Get().(*gzip.Writer)
+		zw.Reset(buf)
+		zw.Write(body)
+		zw.Close()
+		zw.Reset(io.Discard)
+		gzipWriters.Put(zw)
+
+		if buf.Len() < len(body) {
+			h["Content-Encoding"] = gzipEncoding
+			body = buf.Bytes()
+		}
+	}
+
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+func decompressContents(contents []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(contents))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	return io.ReadAll(zr)
+}
+
+// parseRange parses a single-range Range header against a body of the
+// given size. ok is false when the header should be ignored and the full
+// body served, which is also what happens for multiple ranges.
+// satisfiable is false when the range lies entirely outside the body.
+func parseRange(header string, size int) (start, end int, ok, satisfiable bool) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return 0, 0, false, false
+	}
+
+	spec := strings.TrimSpace(header[len("bytes="):])
+	if strings.ContainsRune(spec, ',') {
+		return 0, 0, false, false
+	}
+
+	first, last, found := strings.Cut(spec, "-")
+	if !found {
+		return 0, 0, false, false
+	}
+
+	if first == "" {
+		// suffix range: the last n bytes
+		n, err := strconv.Atoi(last)
+		if err != nil || n < 0 {
+			return 0, 0, false, false
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, true, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true, true
+	}
+
+	start, err := strconv.Atoi(first)
+	if err != nil || start < 0 {
+		return 0, 0, false, false
+	}
+
+	end = size - 1
+	if last != "" {
+		end, err = strconv.Atoi(last)
+		if err != nil || end < start {
+			return 0, 0, false, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	if start >= size {
+		return 0, 0, true, false
+	}
+	return start, end, true, true
+}
+
+// siteSnapshot is the set of files being served. Files are keyed by
+// their slash separated path relative to the root, with a leading slash.
+type siteSnapshot struct {
+	files        map[string]*siteFile
+	count        int // of files, not counting the directories keying indexes
+	error404     *siteFile
+	rootFallback *siteFile // served at / without an index or listing
+
+	assets    map[string]string // logical asset paths to fingerprinted ones
+	immutable map[string]bool   // fingerprinted asset paths
+
+	dirs map[string][]dirEntry // directory listings, when AutoIndex is set
+
+	warnings []Warning // problems found while loading, served all the same
+
+	routes []byte       // JSON array of the paths, when RoutesPath is set
+	search *searchIndex // when SearchPath is set
+
+	suggester   *suggester // unless NoSuggestions is set
+	error404Tpl []byte     // custom 404 page holding the suggestions placeholder
+
+	loading bool // stands in for the files until loaded, with LoadInBackground
+
+	generation uint64   // counting successful reloads, from 1
+	deployID   []string // X-Deploy-Id header value, the generation
+}
+
+const defaultIndex = "index.html"
+
+// Index modes: whether requests naming an index file explicitly are
+// redirected to its directory or served as is. Either way, directories
+// are served their index, HEAD requests getting the same headers as GET
+// ones.
+const (
+	indexModeRedirect = "redirect"
+	indexModeServe    = "serve"
+)
+
+// Config holds the settings of a Server.
+type Config struct {
+	Name        string   // server name used for HTTPS redirects, defaults to the Host header
+	Root        string   // directory, s3://bucket/prefix or gs://bucket/prefix to serve files from
+	Index       string   // index file name, defaults to index.html
+	IndexMode   string   // "redirect", the default, sends requests naming the index to its directory; "serve" serves them
+	NotFound    string   // file served on error 404, relative to Root
+	ForceHTTPS  bool     // redirect requests with X-Forwarded-Proto: http to HTTPS
+	HTTPSPort   int      // port HTTPS is served on, when not 443, for redirects without Name
+	HTTPSExempt []string // glob patterns of paths never redirected to HTTPS
+	AddrHeader  string   // header holding the client address, for logging
+	LogExclude  []string // glob patterns of paths served without being logged
+	HostLogs    []string // HOST=FILE access logs of virtual hosts, others going to the main log
+	LoadWorkers int      // number of files read concurrently, 0 means one per CPU
+
+	// RootFallback is served at / when the root has no index, nor a
+	// listing with AutoIndex, rather than the 404 page. It's a file
+	// relative to Root, or "welcome" for a built-in page.
+	RootFallback string
+
+	// Watch polls the local root every WatchInterval, 1s by default,
+	// reloading it on changes. It's meant for development, as is
+	// LiveReload, which requires it: HTML pages are then loaded with a
+	// script reloading them whenever the watcher applies a change.
+	Watch         bool
+	WatchInterval time.Duration
+	LiveReload    bool
+
+	// AutoIndex lists the contents of directories without an index,
+	// in HTML or, to clients preferring it, JSON.
+	AutoIndex bool
+
+	// NotFoundCacheControl is the Cache-Control header of 404
+	// responses, which cache rules don't apply to, and of files whose
+	// metadata sidecar sets another status than a 2xx. NotFoundMaxAge is
+	// a shorthand for "public, max-age=" that many seconds.
+	NotFoundCacheControl string
+	NotFoundMaxAge       time.Duration
+
+	// ModTimeSkew is how much later than the modification time of a file
+	// an If-Modified-Since date must be for a 304. Clients dating their
+	// copies with their own, early clock could otherwise keep a file
+	// changed right after they fetched it; the price is full responses
+	// for files changed less than ModTimeSkew before they were fetched.
+	ModTimeSkew time.Duration
+
+	// CacheControl is the default Cache-Control header of files, as
+	// understood by parseCacheControl. CacheRules override it for the
+	// paths they match, as described by parseCacheRule, the most
+	// specific matching pattern winning.
+	CacheControl string
+	CacheRules   []string
+
+	// AssetManifest is the path, relative to Root, of a JSON object
+	// mapping logical asset names to fingerprinted ones. Requests for
+	// the former are redirected to the latter, which are served as
+	// immutable. It can also be a Vite manifest, whose outputs are
+	// immutable too, and whose HTML entries are sent with a Link
+	// header preloading their scripts and stylesheets if AssetPreload
+	// is set. The manifest itself isn't served, unless
+	// ServeAssetManifest is set.
+	AssetManifest      string
+	AssetPreload       bool
+	ServeAssetManifest bool
+
+	// DefaultMIME is the content type of files whose type neither their
+	// extension nor their contents tell, instead of
+	// application/octet-stream.
+	DefaultMIME string
+
+	// StrictMIME fails loading when the type of files was sniffed from
+	// their contents, neither their extension, their source nor their
+	// metadata sidecar telling it, unless their extension, like ".bin",
+	// is in StrictMIMEAllow. DefaultMIME counts as telling it.
+	StrictMIME      bool
+	StrictMIMEAllow []string
+
+	// ChecksumEndpoints lists the algorithms, sha256 or sha512, of the
+	// checksum sidecars synthesized for files matching the glob patterns
+	// of ChecksumPaths, all of them if empty: /file.sha256 is then the
+	// digest of /file, as coreutils prints it. Actual files take
+	// precedence.
+	ChecksumEndpoints []string
+	ChecksumPaths     []string
+
+	// TarDownloads lists glob patterns of directories whose files can be
+	// downloaded as one archive, with ?download=tar or ?download=tar.gz,
+	// as long as they add up to at most TarDownloadMaxSize bytes, 1GiB
+	// by default. Archives are disabled without patterns.
+	TarDownloads       []string
+	TarDownloadMaxSize int64
+
+	// NoSecretScan turns off the warnings about files that likely hold
+	// secrets, going by their name or first bytes, like .env files or
+	// private keys. StrictSecretScan makes loading fail on them instead.
+	NoSecretScan     bool
+	StrictSecretScan bool
+
+	// NoSuggestions turns off the paths close to missing ones suggested
+	// on 404s, in place of a <!--marb:suggestions--> comment in the
+	// custom 404 page or in the body of the default one, for sites where
+	// disclosing paths is a concern.
+	NoSuggestions bool
+
+	// SRI computes the Subresource Integrity value of files at load
+	// time, listed by the admin API. SRIHeader also sends it with files
+	// in the X-SRI header, and implies SRI.
+	SRI       bool
+	SRIHeader bool
+
+	// CSP is the Content-Security-Policy sent with HTML files. Each
+	// __CSP_NONCE__ in it is replaced with a fresh nonce on every
+	// request, and so is each one in HTML files, which are then served
+	// compressed on the fly and without validators.
+	CSP string
+
+	// CrossOriginIsolation lists glob patterns of paths served cross-origin
+	// isolated, as needed for SharedArrayBuffer: HTML files get COOP
+	// and COEP headers, and others a CORP one, same-origin unless they
+	// match CORPCrossOrigin. 404s get all three.
+	CrossOriginIsolation []string
+	CORPCrossOrigin      []string
+
+	// TimingAllowOrigin lists the origins, like https://rum.example.com,
+	// or * for any, allowed to read the resource timing details of the
+	// files, in the Timing-Allow-Origin header.
+	TimingAllowOrigin []string
+
+	// MaxTotalSize bounds the memory the files take, like "1GB", the
+	// gzipped versions included. Loading stops as soon as it's exceeded,
+	// unless MaxTotalSizeAction is "warn" rather than "fail", the
+	// default, in which case the files are served all the same.
+	MaxTotalSize       string
+	MaxTotalSizeAction string
+
+	// RoutesPath, like "/_routes.json", serves a JSON array of all the
+	// paths of the site, for single page apps to prefetch them. With
+	// RoutesAuth, it requires one of the admin tokens.
+	RoutesPath string
+	RoutesAuth bool
+
+	// MaxPathDepth, unless 0, is the most levels of directories files
+	// may be found at, deeper ones being neither loaded nor looked up.
+	MaxPathDepth int
+
+	// SearchPath, like "/_search", answers ?q=words with the HTML pages
+	// holding all of them, in JSON, out of a full-text index built at
+	// load time.
+	SearchPath string
+
+	// LogOnlySlow, unless 0, logs requests once answered and only when
+	// they took that long or more, with the details of where the time
+	// went, rather than all of them as they come.
+	LogOnlySlow time.Duration
+
+	// EncodingHintHeader names a header that proxies stripping
+	// Accept-Encoding set instead, like "X-Accept-Encoding: gzip". Its
+	// value is read like Accept-Encoding, in addition to it.
+	EncodingHintHeader string
+
+	// StrictEncoding answers 406 Not Acceptable to requests refusing
+	// all the content codings a file is available in, identity
+	// included, rather than sending it uncompressed all the same.
+	StrictEncoding bool
+
+	// HealthcheckPaths are looked up by every /readyz probe, which fails
+	// unless they resolve to files with contents, as it does when fewer
+	// than ReadyzMinFiles files are loaded. They catch reloads that went
+	// wrong without failing, like an empty bucket prefix.
+	HealthcheckPaths []string
+	ReadyzMinFiles   int
+
+	// Strict makes loading fail on problems that are otherwise worked
+	// around, like corrupt .gz sidecars or symbolic links out of the
+	// root.
+	Strict bool
+
+	// MaxIgnoredBody bounds the bodies of GET, HEAD and OPTIONS
+	// requests, which are read and dropped. Larger or chunked ones are
+	// refused with 413. Defaults to 4KiB.
+	MaxIgnoredBody int64
+
+	// RejectSuspiciousPaths answers 400 to requests whose decoded path
+	// holds null bytes, backslashes or other control characters, which
+	// no file can be named after but may confuse whatever is in front.
+	RejectSuspiciousPaths bool
+
+	// MinHTTPVersion, like "1.1", answers 505 to requests made with an
+	// older version of HTTP, health checks included. Any is served if
+	// empty.
+	MinHTTPVersion string
+
+	// Paths with repeated slashes or dot segments are redirected to
+	// their clean form, unless NoCanonicalSlashes is set, in which case
+	// they're served as is.
+	NoCanonicalSlashes bool
+
+	// Deprecated: paths are canonicalized by default, CanonicalSlashes
+	// is ignored.
+	CanonicalSlashes bool
+
+	// IndexRedirectCode is the status of redirects from index files to
+	// their directory, from directories to their trailing slash and
+	// from / to a single file, HTTPSRedirectCode that of redirects to
+	// HTTPS, and CanonicalRedirectCode that of redirects to canonical
+	// paths. All default to 301.
+	IndexRedirectCode     int
+	HTTPSRedirectCode     int
+	CanonicalRedirectCode int
+
+	// When Root is a single file, it's served at / and its name
+	// redirects there, unless SingleFileAtName is set, in which case it
+	// is the other way around.
+	SingleFileAtName bool
+
+	Compact           bool // keep only the gzipped version of compressible files
+	Brotli            bool // also keep a Brotli version, sent to clients preferring it
+	NoRangeDecompress bool // in compact mode, ignore Range on gzipped files
+
+	WebhookPath     string        // path of the reload webhook, disabled if empty
+	WebhookSecret   string        // HMAC key for webhook signatures
+	WebhookMaxBody  int64         // maximum webhook body size, defaults to 1MiB
+	WebhookInterval time.Duration // minimum average interval between signed webhook requests, defaults to 10 seconds
+	WebhookWindow   time.Duration // replay protection window, defaults to 10 minutes
+
+	// SyncInterval makes the server reload periodically, which is
+	// mostly useful for bucket roots. Only objects whose ETag changed
+	// are downloaded again.
+	SyncInterval time.Duration
+
+	AdminToken    string   // bearer token required by the admin handler, if set
+	AdminTokens   []string // more admin tokens, as ID=TOKEN, the ID telling who made changes
+	DeployMaxSize int64    // largest tarball accepted by the admin deploy endpoint, defaults to 256MiB
+
+	// MaxDecompressedSize bounds the size of deployed tarballs once
+	// decompressed, for each entry and all of them together, defaults
+	// to 1GiB.
+	MaxDecompressedSize int64
+
+	// SecurityContacts and SecurityExpires generate a security.txt
+	// for sites without one. SecurityExpires is an RFC 3339 time, or a
+	// duration counted from load time.
+	SecurityContacts []string
+	SecurityExpires  string
+
+	// FallbackProxy is the URL of an origin that requests for paths
+	// missing from the site are forwarded to, whatever their method.
+	FallbackProxy       string
+	FallbackHeaders     []string      // request headers forwarded to it, all if empty
+	FallbackExclude     []string      // glob patterns of paths never forwarded
+	FallbackTimeout     time.Duration // connect and response header timeout, defaults to 30s
+	FallbackMaxFailures int           // consecutive failures after which it's deemed down, defaults to 5
+	FallbackCooldown    time.Duration // how long it's left alone when down, defaults to 30s
+	StreamBufferSize    int           // size of the buffer its responses are copied through, defaults to 32KiB
+
+	// StatsdAddr is the host:port of a StatsD agent receiving metrics
+	// about every request over UDP, named after StatsdPrefix and
+	// tagged, the DogStatsD way, with StatsdTags, like "env:prod".
+	StatsdAddr   string
+	StatsdPrefix string
+	StatsdTags   []string
+
+	// PurgeURL is the CDN API endpoint asked to purge the URLs changed
+	// by each reload, in the PurgeStyle API style ("cloudflare", the
+	// default, or "fastly"). URLs are made of PurgeBaseURL, the public
+	// URL of the site, followed by the paths.
+	PurgeURL     string
+	PurgeToken   string
+	PurgeStyle   string
+	PurgeBaseURL string
+	PurgeBatch   int // URLs per purge request, defaults to 30
+
+	// NELReportURL, if set, is where browsers are asked to report
+	// network errors through NEL and Report-To headers, sent on HTTPS
+	// responses only. NELMaxAge defaults to 24h and the failure
+	// sampling fraction to 1.
+	NELReportURL         string
+	NELMaxAge            time.Duration
+	NELIncludeSubdomains bool
+	NELSuccessFraction   float64
+	NELFailureFraction   float64
+
+	// Throttle lists PATTERN=RATE rules pacing the responses for
+	// matching paths, like "/downloads/*=2MB/s". ThrottleGlobal, if
+	// set, caps the rate of all throttled responses together.
+	Throttle       []string
+	ThrottleGlobal string
+
+	// ConcurrencyLimits lists PATTERN=N rules capping how many
+	// requests for matching paths are served at once, like
+	// "/downloads/*=8", the most specific matching rule applying.
+	// Requests over a limit wait up to ConcurrencyWait for their turn,
+	// then get a 503.
+	ConcurrencyLimits []string
+	ConcurrencyWait   time.Duration
+
+	// Chaos lists rules injecting latency and failures into responses,
+	// for testing clients, as described by parseChaosRule. They're
+	// refused unless ChaosEnable is set too.
+	Chaos       []string
+	ChaosEnable bool
+
+	// LogLevel is the initial log level: debug, info (the default) or
+	// error, at which requests aren't logged anymore. DebugHeaders
+	// makes responses tell which file answered them, and Maintenance
+	// answers 503 to everything. All three can be changed at runtime
+	// through the admin API.
+	LogLevel     string
+	DebugHeaders bool
+	Maintenance  bool
+
+	// LoadInBackground makes New return before the files are loaded,
+	// for the listener to come up at once. Until they are, requests get
+	// a 503 with a Retry-After of LoadingRetryAfter, 5s by default, and
+	// /readyz fails. A failed load leaves it that way until a later
+	// reload succeeds.
+	LoadInBackground  bool
+	LoadingRetryAfter time.Duration
+
+	// MaintenanceRetryAfter tells clients when to come back in
+	// maintenance mode, in the Retry-After header: either a duration,
+	// sent as seconds, or an RFC1123 date.
+	MaintenanceRetryAfter string
+
+	// ReloadDebounce is how long a reload waits for other triggers to
+	// join it before starting, as described by reload. DeployIDHeader
+	// makes responses tell the generation of the files they were served
+	// from, counting successful reloads, in an X-Deploy-Id header, for
+	// caches and proxies to log.
+	ReloadDebounce time.Duration
+	DeployIDHeader bool
+
+	// ReloadHistory is the number of past reloads reported by the admin
+	// API, 20 by default, each listing at most ReloadReportPaths added,
+	// changed and removed paths, 100 by default.
+	ReloadHistory     int
+	ReloadReportPaths int
+
+	// Shared, if set, is state shared with the other servers of the
+	// process given the same, as described by Shared.
+	Shared *Shared
+
+	// OnReload, if set, is called after every successful reload,
+	// whatever triggered it, startup included.
+	OnReload func(stats ReloadStats)
+
+	// Middleware wraps the file serving handler, the first entry being
+	// the outermost. Requests are logged and, when forcing HTTPS or
+	// canonical slashes, redirected before reaching any middleware.
+	Middleware []func(http.Handler) http.Handler
+
+	// Sources tells where the value of each field came from, keyed by
+	// field name, e.g. SourceFlag, for the configuration dump of the
+	// admin API. Fields missing from it are reported as defaults.
+	Sources map[string]string
+}
+
+// Workers returns the number of files read concurrently while loading,
+// defaulting to the number of CPUs.
+func (c *Config) Workers() int {
+	if c.LoadWorkers < 1 {
+		return runtime.NumCPU()
+	}
+	return c.LoadWorkers
+}
+
+// Server serves the files of a directory tree or bucket from memory.
+type Server struct {
+	Config
+	httpsExempt   pathPatterns
+	logExclude    pathPatterns
+	tarDownloads  pathPatterns
+	maxTotalSize  int64
+	minProto      [2]int // major and minor version, from MinHTTPVersion
+	checksumPaths pathPatterns
+	cacheRules    cacheRules
+	hostLogs      map[string]*hostLog
+	adminTokens   map[string]string // by ID
+	runtime       *runtimeSettings
+	handler       http.Handler
+	snapshot      atomic.Value // *siteSnapshot
+	reloadMu      sync.Mutex
+	pendingMu     sync.Mutex
+	pending       *reloadRun // reload triggers can still join
+	source        source
+	sourceName    string // Root, or what replaced it, for logging
+	singleFile    string // name of the file served when Root is one
+	liveReload    *liveReloader
+	webhook       *webhook
+	fallback      *fallbackProxy
+	purger        *purger
+	statsd        *statsd
+	concurrency   *concurrencyLimits
+	nel           *networkErrorLogging
+	securityTxt   *securityTxt
+	registered    map[string]*siteFile // by RegisterBytes, guarded by reloadMu
+	stop          chan struct{}
+
+	crossOriginIsolation pathPatterns
+	corpCrossOrigin      pathPatterns
+	timingAllowOrigin    []string // header value, shared by responses
+
+	shuttingDown int32 // set by StartShutdown
+
+	metrics *metrics // of Shared, if set
+
+	statusMu sync.Mutex
+	status   reloadStatus
+	reloads  []reloadReport // oldest first
+}
+
+func (s *Server) current() *siteSnapshot {
+	return s.snapshot.Load().(*siteSnapshot)
+}
+
+// addFile adds f to snap, at its directory too if it's an index. Flat
+// sources like buckets and tarballs may hold both a file and a
+// directory with an index at one path: the file is served there,
+// whichever comes first, and the index only at its own path, like any
+// other file.
+func (s *Server) addFile(snap *siteSnapshot, f *siteFile, indexes map[string]string) {
+	index, ok := indexes[f.dir]
+	if !ok {
+		index = s.Index
+	}
+
+	p := path.Join(f.dir, f.name)
+	f.isIndex = f.name == index
+	f.formatHeaders()
+	if other := snap.files[f.dir]; f.isIndex && other != nil && path.Join(other.dir, other.name) == f.dir {
+		snap.warn(warnPathCollision, "%s is both a file and a directory with an index, serving the file", f.dir)
+		f.isIndex = false
+	}
+	if other := snap.files[p]; other != nil && other.isIndex && other.dir == p {
+		snap.warn(warnPathCollision, "%s is both a file and a directory with an index, serving the file", p)
+		// snapshots being served aren't modified, a copy is kept
+		shadowed := *other
+		shadowed.isIndex = false
+		snap.files[path.Join(other.dir, other.name)] = &shadowed
+	}
+	if f.isIndex {
+		snap.files[f.dir] = f
+	}
+	snap.files[p] = f
+}
+
+func (s *Server) resolveFile(snap *siteSnapshot, p string) *siteFile {
+	return snap.files[rootedPath(p)]
+}
+
+// rootedPath is path.Join("/", p), without allocating when p is rooted
+// and clean already, as request paths mostly are.
+func rootedPath(p string) string {
+	if strings.HasPrefix(p, "/") {
+		return path.Clean(p)
+	}
+	return path.Join("/", p)
+}
+
+func (s *Server) serveOptions(w http.ResponseWriter) {
+	allowedMethods := []string{http.MethodOptions, http.MethodGet, http.MethodHead}
+	w.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// isPreflight reports whether r is a CORS preflight. Browsers send them
+// without credentials, so they are answered without requiring any, the
+// same whether the resource exists or is protected: marb allows no
+// cross-origin requests, and sends no Access-Control-Allow-* headers for
+// browsers to go on.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// serveServerOptions answers OPTIONS *, which asks about the server as a
+// whole rather than a resource, with the methods it allows anywhere,
+// returning whether r was one.
+func (s *Server) serveServerOptions(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodOptions || r.RequestURI != "*" {
+		return false
+	}
+	s.serveOptions(w)
+	return true
+}
+
+// refuseBody answers 413 and closes the connection for GET, HEAD and
+// OPTIONS requests carrying a body larger than MaxIgnoredBody, or one of
+// unknown length. Smaller bodies are drained, so that the connection
+// can be reused.
+func (s *Server) refuseBody(w http.ResponseWriter, r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+
+	limit := s.MaxIgnoredBody
+	if limit <= 0 {
+		limit = defaultMaxIgnoredBody
+	}
+
+	chunked := len(r.TransferEncoding) > 0
+	if chunked || r.ContentLength > limit {
+		w.Header().Set("Connection", "close")
+		w.Header()["X-Content-Type-Options"] = nosniff
+		writeDynamic(w, r, http.StatusRequestEntityTooLarge, "text/plain; charset=utf-8", []byte("request body not allowed\n"))
+		return true
+	}
+
+	if r.ContentLength > 0 {
+		io.Copy(io.Discard, io.LimitReader(r.Body, limit))
+	}
+	return false
+}
+
+// suspiciousPath reports whether p holds a backslash or a control
+// character, null bytes included.
+func suspiciousPath(p string) bool {
+	return strings.IndexFunc(p, func(c rune) bool {
+		return c == '\\' || c < 0x20 || c == 0x7f
+	}) >= 0
+}
+
+// refuseSuspiciousPath answers 400 to requests for suspicious paths when
+// RejectSuspiciousPaths is set, reporting whether it did.
+func (s *Server) refuseSuspiciousPath(w http.ResponseWriter, r *http.Request) bool {
+	if !s.RejectSuspiciousPaths || !suspiciousPath(r.URL.Path) {
+		return false
+	}
+	log.Printf("warning: rejected suspicious path from %s: %q", s.clientAddr(r), r.RequestURI)
+	w.Header()["X-Content-Type-Options"] = nosniff
+	writeDynamic(w, r, http.StatusBadRequest, "text/plain; charset=utf-8", []byte("bad request path\n"))
+	return true
+}
+
+// refuseHTTPVersion answers 505 to requests made with a version of HTTP
+// older than MinHTTPVersion, reporting whether it did.
+func (s *Server) refuseHTTPVersion(w http.ResponseWriter, r *http.Request) bool {
+	if r.ProtoAtLeast(s.minProto[0], s.minProto[1]) {
+		return false
+	}
+	writeDynamic(w, r, http.StatusHTTPVersionNotSupported, "text/plain; charset=utf-8", []byte("HTTP version not supported\n"))
+	return true
+}
+
+// serve404 handles requests for paths missing from the site, passing
+// them to the fallback proxy if there's one.
+func (s *Server) serve404(w http.ResponseWriter, r *http.Request, snap *siteSnapshot) {
+	if s.fallback != nil && s.fallback.allow(r) {
+		setResult(r, resultFallback)
+		s.fallback.ServeHTTP(w, r)
+		return
+	}
+
+	s.serveNotFound(w, r, snap)
+}
+
+// serveNotFound answers 404, with the custom page if there's one.
+// Conditional requests get the full page all the same, as a 304 would
+// lose the 404 status; instead, downstream caches can be allowed to keep
+// it for a while with NotFoundCacheControl, and revalidate it with
+// Last-Modified.
+func (s *Server) serveNotFound(w http.ResponseWriter, r *http.Request, snap *siteSnapshot) {
+	setResult(r, resultNotFound)
+	s.setIsolationHeaders(w.Header(), r, true, true)
+	if s.NotFoundCacheControl != "" {
+		w.Header().Set("Cache-Control", s.NotFoundCacheControl)
+	}
+
+	if snap.error404 == nil {
+		w.Header()["X-Content-Type-Options"] = nosniff
+		contentType, body := notFoundBody(r, s.suggestions(r, snap))
+		writeDynamic(w, r, http.StatusNotFound, contentType, body)
+		return
+	}
+	if snap.error404Tpl != nil {
+		links := suggestionsHTML(s.suggestions(r, snap))
+		body := bytes.Replace(snap.error404Tpl, []byte(suggestionsPlaceholder), links, -1)
+		writeDynamic(w, r, http.StatusNotFound, snap.error404.mimeType, body)
+		return
+	}
+
+	encoding := negotiateEncoding(w.Header(), r, snap.error404)
+	s.setHeaders(w.Header(), r, snap.error404, encoding)
+	w.WriteHeader(http.StatusNotFound)
+
+	if r.Method != http.MethodHead {
+		body := snap.error404.body(encoding)
+		if encoding == "" {
+			var err error
+			if body, err = snap.error404.identity(); err != nil {
+				log.Printf("%s: could not decompress: %v", path.Join(snap.error404.dir, snap.error404.name), err)
+				return
+			}
+		}
+		w.Write(body)
+	}
+}
+
+func (s *Server) redirectIndex(w http.ResponseWriter, r *http.Request) {
+	redirect(w, r, path.Dir(r.URL.Path), s.IndexRedirectCode)
+}
+
+// redirectCodes are the statuses redirects can be configured with.
+var redirectCodes = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusSeeOther:          true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+// redirect redirects r to target with code, or with its method
+// preserving counterpart for methods other than GET and HEAD, which
+// clients may turn into GETs after a 301 or a 302.
+func redirect(w http.ResponseWriter, r *http.Request, target string, code int) {
+	setResult(r, resultRedirect)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		switch code {
+		case http.StatusMovedPermanently:
+			code = http.StatusPermanentRedirect
+		case http.StatusFound:
+			code = http.StatusTemporaryRedirect
+		}
+	}
+	http.Redirect(w, r, target, code)
+}
+
+// canonicalPath returns p with repeated slashes and dot segments
+// removed, keeping a trailing slash.
+func canonicalPath(p string) string {
+	clean := rootedPath(p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		if len(p) == len(clean)+1 && strings.HasPrefix(p, clean) {
+			return p
+		}
+		clean += "/"
+	}
+	return clean
+}
+
+// canonicalTarget returns the canonical form of the request URI of r,
+// or "" if its path is canonical already. It's the path of the request
+// URI that gets cleaned, rather than r.URL.Path, for the redirect to
+// keep whatever prefix was stripped by a handler mounting the server.
+// Otherwise, it goes straight to where serveFile would then redirect.
+func (s *Server) canonicalTarget(r *http.Request) string {
+	if s.NoCanonicalSlashes || canonicalPath(r.URL.Path) == r.URL.Path {
+		return ""
+	}
+
+	if mounted(r) {
+		u, _ := url.ParseRequestURI(r.RequestURI)
+		target := url.URL{Path: canonicalPath(u.Path), RawQuery: r.URL.RawQuery}
+		return target.String()
+	}
+	return s.finalTarget(r, canonicalPath(r.URL.Path))
+}
+
+// mounted reports whether r reached the server with a prefix of its
+// path stripped, which only its request URI still has.
+func mounted(r *http.Request) bool {
+	u, err := url.ParseRequestURI(r.RequestURI)
+	return err == nil && u.Path != "" && u.Path != r.URL.Path
+}
+
+// finalTarget returns the URL of p, the clean path of r, or of where
+// serveFile redirects requests for p if it does, so that a redirect to
+// p gets clients there in one hop.
+func (s *Server) finalTarget(r *http.Request, p string) string {
+	if next := s.fileRedirect(r, p); next != "" {
+		p = next
+	}
+	target := url.URL{Path: p, RawQuery: r.URL.RawQuery}
+	return target.String()
+}
+
+// fileRedirect returns the path serveFile redirects requests like r for
+// the clean path p to, or "" if it serves them: single files at their
+// name, explicit index files and directory listings without a trailing
+// slash are redirected.
+func (s *Server) fileRedirect(r *http.Request, p string) string {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return ""
+	}
+	if s.singleFile != "" && s.SingleFileAtName && p == "/" {
+		return "/" + s.singleFile
+	}
+
+	snap := s.current()
+	if _, ok := snap.assets[p]; ok {
+		return "" // temporary, not a canonical URL
+	}
+	f := s.resolveFile(snap, p)
+	if f == nil {
+		if _, ok := snap.dirs[p]; ok && !strings.HasSuffix(p, "/") {
+			return p + "/"
+		}
+		return ""
+	}
+	if f.isIndex && s.IndexMode != indexModeServe && path.Base(p) == f.name && !strings.HasSuffix(p, "/") {
+		return path.Dir(p)
+	}
+	return ""
+}
+
+// redirectCanonical redirects requests for paths that aren't canonical,
+// returning whether it did.
+func (s *Server) redirectCanonical(w http.ResponseWriter, r *http.Request) bool {
+	target := s.canonicalTarget(r)
+	if target == "" {
+		return false
+	}
+
+	redirect(w, r, target, s.CanonicalRedirectCode)
+	return true
+}
+
+// redirectToHTTPS redirects r to HTTPS, and to the canonical form of
+// its path, or where serveFile would redirect it, at once, sparing
+// clients further redirects.
+func (s *Server) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := s.Name
+	if host == "" {
+		host = httpsHost(r.Host, s.HTTPSPort)
+	}
+	uri := r.RequestURI
+	if target := s.canonicalTarget(r); target != "" {
+		uri = target
+	} else if !mounted(r) && s.fileRedirect(r, r.URL.Path) != "" {
+		uri = s.finalTarget(r, r.URL.Path)
+	}
+	redirect(w, r, "https://"+host+uri, s.HTTPSRedirectCode)
+}
+
+// hostname returns the host of a Host header without its port, nor
+// the brackets of an IPv6 literal.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// httpsHost returns the host of the HTTPS URL for a request to host,
+// IPv6 literals included: the port of host is that of plain HTTP,
+// which is replaced with port, or dropped if that's 443 or 0.
+func httpsHost(host string, port int) string {
+	host = hostname(host)
+	if port != 0 && port != 443 {
+		return net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+func (s *Server) shouldRedirectToHTTPS(r *http.Request) bool {
+	if !s.ForceHTTPS || s.httpsExempt.match(r.URL.Path) {
+		return false
+	}
+
+	return r.Header.Get("X-Forwarded-Proto") == "http"
+}
+
+// canServeRange reports whether byte ranges of f can be served. They
+// are always served from the identity bytes, which compact mode has to
+// decompress unless told not to.
+func (s *Server) canServeRange(f *siteFile) bool {
+	return f.contents != nil || !s.NoRangeDecompress
+}
+
+// ifRangeMatches reports whether the If-Range precondition, if any,
+// allows a partial response. Only dates are meaningful, as no entity
+// tags are sent.
+func ifRangeMatches(r *http.Request, f *siteFile) bool {
+	ifRange := r.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+
+	t, err := time.Parse(http.TimeFormat, ifRange)
+	if err != nil {
+		return false
+	}
+	return t.Equal(f.lastModified.Truncate(time.Second))
+}
+
+// fileResponse describes the response serving a file, headers aside.
+type fileResponse struct {
+	status     int
+	encoding   string // content coding of the body, "" for identity
+	start, end int    // of the byte range, for 206s
+	body       bool   // false for 304s and other errors
+	result     string // for the access log
+}
+
+// prepareFile sets the headers of the response to r serving f, and
+// tells what to send after them. GET and HEAD requests both go through
+// it, so that they get the same status and headers: nothing in there
+// depends on the method, nor reads the contents of f, which only GET
+// requests then get.
+//
+// Ranges are served from the identity bytes of f, no matter which
+// encodings the client accepts, as ranges of a gzip stream are useless.
+// A Range header that can't be honored gets the full body.
+func (s *Server) prepareFile(h http.Header, r *http.Request, f *siteFile, snap *siteSnapshot) fileResponse {
+	s.setCacheControl(h, r.URL.Path, snap)
+	// files standing for an error, like a 410 for a removed page, are
+	// cached like 404s
+	if status := f.status(); (status < 200 || status > 299) && s.NotFoundCacheControl != "" {
+		h.Set("Cache-Control", s.NotFoundCacheControl)
+	}
+	if f.meta != nil && f.meta.CacheControl != "" {
+		h.Set("Cache-Control", f.meta.CacheControl)
+	}
+	resp := fileResponse{status: f.status(), body: true}
+	if !noTransform(h) {
+		resp.encoding = negotiateEncoding(h, r, f)
+	}
+
+	// conditional and range requests only make sense for 200s
+	if modSince := r.Header.Get("If-Modified-Since"); modSince != "" && !s.stripValidators(r) && resp.status == http.StatusOK {
+		modSinceTime, err := time.Parse(http.TimeFormat, modSince)
+		if err != nil {
+			resp.status, resp.body, resp.result = http.StatusBadRequest, false, resultBadRequest
+			return resp
+		}
+
+		// Last-Modified only has a precision of a second, so the date
+		// clients send back is compared to the truncated time of the
+		// representation they'd get
+		if !modSinceTime.Before(f.modTime(resp.encoding).Truncate(time.Second).Add(s.ModTimeSkew)) {
+			s.setHeaders(h, r, f, resp.encoding)
+			resp.status, resp.body, resp.result = http.StatusNotModified, false, resultNotModified
+			return resp
+		}
+	}
+
+	if f.contents != nil && resp.status == http.StatusOK {
+		// ranges are only advertised when identity bytes are at hand
+		h["Accept-Ranges"] = acceptRangesBytes
+	}
+
+	resp.result = resultFull
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		resp.result = resultRangeIgnored
+		if s.canServeRange(f) && resp.status == http.StatusOK && ifRangeMatches(r, f) {
+			start, end, ok, satisfiable := parseRange(rangeHeader, f.size)
+			if ok && !satisfiable {
+				h.Set("Content-Range", fmt.Sprintf("bytes */%d", f.size))
+				resp.status, resp.body, resp.result = http.StatusRequestedRangeNotSatisfiable, false, resultRangeNotSatisfiable
+				return resp
+			}
+			if ok {
+				resp.status, resp.encoding, resp.start, resp.end, resp.result = http.StatusPartialContent, "", start, end, resultRange
+			}
+		}
+	}
+
+	s.setHeaders(h, r, f, resp.encoding)
+	if resp.status == http.StatusPartialContent {
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", resp.start, resp.end, f.size))
+		h.Set("Content-Length", strconv.Itoa(resp.end-resp.start+1))
+	}
+	s.setDebugHeaders(h, f, resp.encoding)
+	return resp
+}
+
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, snap *siteSnapshot) {
+	if s.tooDeep(r.URL.Path) {
+		s.serveNotFound(w, r, snap)
+		return
+	}
+
+	if s.singleFile != "" && s.SingleFileAtName && r.URL.Path == "/" {
+		redirect(w, r, "/"+url.PathEscape(s.singleFile), s.IndexRedirectCode)
+		return
+	}
+
+	if s.redirectAsset(w, r, snap) || s.serveTarDownload(w, r, snap) {
+		return
+	}
+
+	f := s.resolveFile(snap, r.URL.Path)
+	if _, listed := snap.dirs["/"]; f == nil && r.URL.Path == "/" && !listed {
+		f = snap.rootFallback
+	}
+
+	if f == nil {
+		if s.serveChecksum(w, r, snap) {
+			return
+		}
+		dir := rootedPath(r.URL.Path)
+		if entries, ok := snap.dirs[dir]; ok {
+			if !strings.HasSuffix(r.URL.Path, "/") {
+				target := url.URL{Path: path.Base(dir) + "/", RawQuery: r.URL.RawQuery}
+				redirect(w, r, target.String(), s.IndexRedirectCode)
+				return
+			}
+			setResult(r, resultListing)
+			s.serveListing(w, r, dir, entries)
+			return
+		}
+		s.serve404(w, r, snap)
+		return
+	}
+
+	if f.isIndex && s.IndexMode != indexModeServe && path.Base(r.URL.Path) == f.name && !strings.HasSuffix(r.URL.Path, "/") {
+		s.redirectIndex(w, r)
+		return
+	}
+
+	if s.serveNotAcceptable(w, r, f) {
+		return
+	}
+
+	if f.nonced {
+		s.serveNonced(w, r, f)
+		return
+	}
+
+	resp := s.prepareFile(w.Header(), r, f, snap)
+	setResult(r, resp.result)
+	if resp.body && s.logEnabled(levelDebug) {
+		// not paying for the arguments otherwise
+		s.debugf("%s %s: serving %s with encoding %q", r.Method, r.URL.Path, path.Join(f.dir, f.name), resp.encoding)
+	}
+	w.WriteHeader(resp.status)
+	if r.Method == http.MethodHead || !resp.body {
+		return
+	}
+
+	body := f.body(resp.encoding)
+	if resp.encoding == "" && body == nil && f.size > 0 {
+		// compact mode only kept the gzipped version
+		var err error
+		if body, err = f.identity(); err != nil {
+			log.Printf("%s: could not decompress: %v", path.Join(f.dir, f.name), err)
+			return
+		}
+	}
+	if resp.status == http.StatusPartialContent {
+		body = body[resp.start : resp.end+1]
+	}
+	w.Write(body)
+}
+
+func (s *Server) clientAddr(r *http.Request) string {
+	if s.AddrHeader != "" {
+		return r.Header.Get(s.AddrHeader)
+	}
+	return r.RemoteAddr
+}
+
+// logRequest logs r once answered, with the status, size, result and
+// encoding of the response.
+func (s *Server) logRequest(r *http.Request, cw *countingWriter) {
+	if s.LogOnlySlow > 0 || !s.logEnabled(levelInfo) || s.logExclude.match(r.URL.Path) {
+		return
+	}
+	s.accessLogf(r)("%s %s %s %d %d %s %s%s", s.clientAddr(r), r.Method, r.RequestURI,
+		cw.status, cw.bytes, cw.logResult(), cw.logEncoding(), cw.logThrottle())
+}
+
+// logSlowRequest logs r once answered if it took LogOnlySlow or more,
+// whatever the log level, telling how long it took to start the
+// response and then to write its body, and how much of that was spent
+// pacing it if it was throttled.
+func (s *Server) logSlowRequest(r *http.Request, cw *countingWriter, start time.Time) {
+	elapsed := time.Since(start)
+	if s.LogOnlySlow <= 0 || elapsed < s.LogOnlySlow || s.logExclude.match(r.URL.Path) {
+		return
+	}
+	firstByte := elapsed
+	if !cw.wroteHeader.IsZero() {
+		firstByte = cw.wroteHeader.Sub(start)
+	}
+	s.accessLogf(r)("%s %s %s slow: %d %s, %d bytes in %v, %v to first byte and %v of body, %s%s",
+		s.clientAddr(r), r.Method, r.RequestURI, cw.status, cw.logResult(), cw.bytes, elapsed.Round(time.Microsecond),
+		firstByte.Round(time.Microsecond), (elapsed - firstByte).Round(time.Microsecond), cw.logEncoding(), cw.logThrottle())
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	cw := &countingWriter{ResponseWriter: w}
+	r = s.withOutcome(r, cw)
+	defer func() {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		s.metrics.countResponse(cw.status, cw.bytes)
+		s.logRequest(r, cw)
+		s.logSlowRequest(r, cw, start)
+		if s.statsd != nil {
+			s.statsd.countRequest(cw.status, cw.bytes, time.Since(start))
+		}
+	}()
+	w = cw
+	s.applyEncodingHint(w, r)
+	if s.DeployIDHeader {
+		if id := s.current().deployID; id != nil {
+			w.Header()["X-Deploy-Id"] = id
+		}
+	}
+
+	if s.refuseHTTPVersion(w, r) || s.refuseBody(w, r) || s.serveServerOptions(w, r) || s.refuseSuspiciousPath(w, r) || s.serveHealth(w, r) || s.serveLoading(w, r) || s.serveMaintenance(w, r) {
+		return
+	}
+
+	if s.shouldRedirectToHTTPS(r) {
+		s.redirectToHTTPS(w, r)
+		return
+	}
+
+	if s.redirectCanonical(w, r) {
+		return
+	}
+
+	s.handler.ServeHTTP(w, r)
+}
+
+// serve is the innermost handler, wrapped by the configured middleware.
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if s.webhook != nil && r.URL.Path == s.WebhookPath {
+		s.serveWebhook(w, r)
+		return
+	}
+	if s.liveReload != nil && r.URL.Path == liveReloadPath {
+		s.serveLiveReload(w, r)
+		return
+	}
+	if s.RoutesPath != "" && r.URL.Path == s.RoutesPath {
+		s.serveRoutes(w, r)
+		return
+	}
+	if s.SearchPath != "" && r.URL.Path == s.SearchPath {
+		s.serveSearch(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		s.serveOptions(w)
+	case http.MethodGet, http.MethodHead:
+		s.serveFile(w, r, s.current())
+	default:
+		if snap := s.current(); s.fallback != nil && s.resolveFile(snap, r.URL.Path) == nil {
+			s.serve404(w, r, snap)
+			return
+		}
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// New loads the files under cfg.Root and returns a Server for them.
+func New(cfg Config) (*Server, error) {
+	s := &Server{Config: cfg, metrics: new(metrics)}
+	if cfg.Shared != nil {
+		s.metrics = &cfg.Shared.metrics
+	}
+	if s.Index == "" {
+		s.Index = defaultIndex
+	}
+	if s.IndexMode == "" {
+		s.IndexMode = indexModeRedirect
+	}
+	if s.IndexMode != indexModeRedirect && s.IndexMode != indexModeServe {
+		return nil, fmt.Errorf("unknown index mode %q", s.IndexMode)
+	}
+	for name, code := range map[string]*int{"index": &s.IndexRedirectCode, "HTTPS": &s.HTTPSRedirectCode, "canonical": &s.CanonicalRedirectCode} {
+		if *code == 0 {
+			*code = http.StatusMovedPermanently
+		}
+		if !redirectCodes[*code] {
+			return nil, fmt.Errorf("%s redirect code %d isn't a redirect status", name, *code)
+		}
+	}
+	if s.SRIHeader {
+		s.SRI = true
+	}
+	if cfg.MaxTotalSize != "" {
+		size, err := parseSize(cfg.MaxTotalSize)
+		if err != nil {
+			return nil, err
+		}
+		s.maxTotalSize = size
+	}
+	if s.MinHTTPVersion != "" {
+		major, minor, ok := http.ParseHTTPVersion("HTTP/" + s.MinHTTPVersion)
+		if !ok {
+			return nil, fmt.Errorf("invalid minimum HTTP version %q", s.MinHTTPVersion)
+		}
+		s.minProto = [2]int{major, minor}
+	}
+	if s.MaxTotalSizeAction == "" {
+		s.MaxTotalSizeAction = maxTotalSizeFail
+	}
+	if s.MaxTotalSizeAction != maxTotalSizeFail && s.MaxTotalSizeAction != maxTotalSizeWarn {
+		return nil, fmt.Errorf("unknown max total size action %q", s.MaxTotalSizeAction)
+	}
+	if s.ReloadHistory < 1 {
+		s.ReloadHistory = defaultReloadHistory
+	}
+	if s.ReloadReportPaths < 1 {
+		s.ReloadReportPaths = defaultReloadReportPaths
+	}
+
+	for _, pattern := range cfg.HTTPSExempt {
+		if err := s.httpsExempt.Set(pattern); err != nil {
+			return nil, fmt.Errorf("https exempt pattern %q: %v", pattern, err)
+		}
+	}
+	for _, pattern := range cfg.CrossOriginIsolation {
+		if err := s.crossOriginIsolation.Set(pattern); err != nil {
+			return nil, fmt.Errorf("cross-origin isolation pattern %q: %v", pattern, err)
+		}
+	}
+	for _, origin := range cfg.TimingAllowOrigin {
+		if u, err := url.Parse(origin); origin != "*" && (err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "") {
+			return nil, fmt.Errorf("timing allow origin %q is neither * nor an origin", origin)
+		}
+	}
+	if len(cfg.TimingAllowOrigin) > 0 {
+		s.timingAllowOrigin = []string{strings.Join(cfg.TimingAllowOrigin, ", ")}
+	}
+	for _, pattern := range cfg.CORPCrossOrigin {
+		if err := s.corpCrossOrigin.Set(pattern); err != nil {
+			return nil, fmt.Errorf("CORP cross-origin pattern %q: %v", pattern, err)
+		}
+	}
+	for _, pattern := range cfg.TarDownloads {
+		if err := s.tarDownloads.Set(pattern); err != nil {
+			return nil, fmt.Errorf("tar download pattern %q: %v", pattern, err)
+		}
+	}
+	for _, algorithm := range cfg.ChecksumEndpoints {
+		if checksumHashes[algorithm] == nil {
+			return nil, fmt.Errorf("unknown checksum algorithm %q, expected sha256 or sha512", algorithm)
+		}
+	}
+	for _, pattern := range cfg.ChecksumPaths {
+		if err := s.checksumPaths.Set(pattern); err != nil {
+			return nil, fmt.Errorf("checksum path pattern %q: %v", pattern, err)
+		}
+	}
+	if s.TarDownloadMaxSize <= 0 {
+		s.TarDownloadMaxSize = defaultTarDownloadMaxSize
+	}
+	var err error
+	if cfg.CacheControl != "" {
+		if s.CacheControl, err = parseCacheControl(cfg.CacheControl); err != nil {
+			return nil, fmt.Errorf("cache control %q: %v", cfg.CacheControl, err)
+		}
+	}
+	if cfg.NotFoundMaxAge != 0 {
+		if cfg.NotFoundCacheControl != "" {
+			return nil, errors.New("404 max age and 404 cache control are mutually exclusive")
+		}
+		if cfg.NotFoundMaxAge < 0 {
+			return nil, fmt.Errorf("negative 404 max age %v", cfg.NotFoundMaxAge)
+		}
+		s.NotFoundCacheControl = fmt.Sprintf("public, max-age=%d", int64(cfg.NotFoundMaxAge/time.Second))
+	}
+	if cfg.ModTimeSkew < 0 {
+		return nil, fmt.Errorf("negative modification time skew %v", cfg.ModTimeSkew)
+	}
+	if cfg.NotFoundCacheControl != "" {
+		if s.NotFoundCacheControl, err = parseCacheControl(cfg.NotFoundCacheControl); err != nil {
+			return nil, fmt.Errorf("404 cache control %q: %v", cfg.NotFoundCacheControl, err)
+		}
+	}
+	if cfg.EncodingHintHeader != "" && !isToken(cfg.EncodingHintHeader) {
+		return nil, fmt.Errorf("invalid encoding hint header name %q", cfg.EncodingHintHeader)
+	}
+	for _, ext := range cfg.StrictMIMEAllow {
+		if !strings.HasPrefix(ext, ".") || strings.Contains(ext, "/") {
+			return nil, fmt.Errorf("strict MIME allowed extension %q doesn't look like .ext", ext)
+		}
+	}
+	if cfg.DefaultMIME != "" {
+		if _, _, err := mime.ParseMediaType(cfg.DefaultMIME); err != nil {
+			return nil, fmt.Errorf("default MIME type %q: %v", cfg.DefaultMIME, err)
+		}
+	}
+	for _, rule := range cfg.CacheRules {
+		c, err := parseCacheRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		s.cacheRules = append(s.cacheRules, c)
+	}
+	if s.adminTokens, err = parseAdminTokens(cfg); err != nil {
+		return nil, err
+	}
+	if s.runtime, err = newRuntimeSettings(cfg); err != nil {
+		return nil, err
+	}
+	for _, pattern := range cfg.LogExclude {
+		if err := s.logExclude.Set(pattern); err != nil {
+			return nil, fmt.Errorf("log exclude pattern %q: %v", pattern, err)
+		}
+	}
+
+	if cfg.WebhookPath != "" {
+		if cfg.WebhookSecret == "" {
+			return nil, errors.New("a webhook secret is required to enable the webhook")
+		}
+		s.webhook = newWebhook(cfg)
+	}
+
+	if s.source, err = newSource(cfg.Root); err != nil {
+		return nil, err
+	}
+	if src, ok := s.source.(*fsSource); ok {
+		src.strict = cfg.Strict
+	}
+	s.sourceName = cfg.Root
+	if err := checkDevMode(cfg, s.source); err != nil {
+		return nil, err
+	}
+	logDevMode(cfg)
+	if cfg.LiveReload {
+		s.liveReload = newLiveReloader()
+	}
+	if src, ok := s.source.(*fsSource); ok && src.isFile() {
+		if cfg.NotFound != "" {
+			return nil, errors.New("a 404 page can't be used when serving a single file")
+		}
+		if cfg.RootFallback != "" {
+			return nil, errors.New("a root fallback can't be used when serving a single file")
+		}
+		if cfg.Index != "" && cfg.Index != defaultIndex {
+			log.Printf("serving the single file %s, ignoring the index name %q", cfg.Root, cfg.Index)
+		}
+		s.singleFile = path.Base(cfg.Root)
+		s.Index = s.singleFile
+		if cfg.SingleFileAtName {
+			// no file is an index, / redirecting to the file instead
+			s.Index = ""
+		}
+	}
+	if s.securityTxt, err = newSecurityTxt(cfg.SecurityContacts, cfg.SecurityExpires); err != nil {
+		return nil, err
+	}
+	if cfg.NELReportURL != "" {
+		if s.nel, err = newNetworkErrorLogging(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.PurgeURL != "" {
+		if s.purger, err = newPurger(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.StatsdAddr != "" {
+		if s.statsd, err = newStatsd(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.FallbackProxy != "" {
+		s.fallback, err = newFallbackProxy(cfg, func(w http.ResponseWriter, r *http.Request) {
+			s.serveNotFound(w, r, s.current())
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.hostLogs, err = newHostLogs(cfg.HostLogs); err != nil {
+		return nil, err
+	}
+
+	s.handler = http.HandlerFunc(s.serve)
+	throttle, err := newThrottle(cfg.Throttle, cfg.ThrottleGlobal)
+	if err != nil {
+		return nil, err
+	}
+	if throttle != nil {
+		s.handler = throttle.wrap(s.handler)
+	}
+	// throttled responses hold their slot while paced
+	if s.concurrency, err = newConcurrencyLimits(cfg.ConcurrencyLimits, cfg.ConcurrencyWait); err != nil {
+		return nil, err
+	}
+	if s.concurrency != nil {
+		s.handler = s.concurrency.wrap(s.handler)
+	}
+	chaos, err := newChaos(cfg.Chaos, cfg.ChaosEnable)
+	if err != nil {
+		return nil, err
+	}
+	if chaos != nil {
+		s.handler = chaos(s.handler)
+	}
+	for i := len(cfg.Middleware) - 1; i >= 0; i-- {
+		s.handler = cfg.Middleware[i](s.handler)
+	}
+
+	if cfg.LoadInBackground {
+		s.snapshot.Store(&siteSnapshot{loading: true})
+		go s.reload("startup")
+	} else if _, err := s.reload("startup"); err != nil {
+		return nil, err
+	}
+
+	s.stop = make(chan struct{})
+	if cfg.SyncInterval > 0 {
+		go s.syncLoop(cfg.SyncInterval)
+	}
+	if s.purger != nil {
+		go s.purger.run(s.stop)
+	}
+	if s.statsd != nil {
+		go s.statsd.run(s.stop)
+	}
+	if cfg.Watch {
+		interval := cfg.WatchInterval
+		if interval <= 0 {
+			interval = defaultWatchInterval
+		}
+		go s.watchLoop(interval)
+	}
+	return s, nil
+}
+
+// Close stops the background work of the server. It keeps serving
+// requests it's handed.
+func (s *Server) Close() error {
+	close(s.stop)
+	for _, l := range s.hostLogs {
+		l.close()
+	}
+	return nil
+}
@@ -0,0 +1,1140 @@
+package marb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSite writes files, keyed by their slash separated path, to a
+// temporary directory and returns it.
+func writeSite(t testing.TB, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, contents := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// newTestServer returns a Server for cfg serving files, keyed by their
+// slash separated path, from a temporary directory.
+func newTestServer(t testing.TB, cfg Config, files map[string]string) *Server {
+	t.Helper()
+	cfg.Root = writeSite(t, files)
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// captureLog returns the buffer the standard logger writes to until the
+// test ends.
+func captureLog(t testing.TB) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	flags := log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	})
+	return &buf
+}
+
+// serveRequest serves a method request for path to h, with header,
+// and returns the response.
+func serveRequest(h http.Handler, method, path string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+// get serves a GET request for path to s and returns the response.
+func get(s http.Handler, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+// discardWriter is a ResponseWriter dropping what it's sent, keeping
+// its header map from one request to the next so that measuring the
+// allocations of a request only counts those of the server.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+// serveAllocs returns the allocations of serving GET path, access
+// logging being off.
+func serveAllocs(t *testing.T, s *Server, path string) float64 {
+	t.Helper()
+	r := httptest.NewRequest("GET", path, nil)
+	w := &discardWriter{header: make(http.Header)}
+	return testing.AllocsPerRun(100, func() {
+		clear(w.header)
+		s.ServeHTTP(w, r)
+	})
+}
+
+func benchmarkServe(b *testing.B, s *Server, path string) {
+	r := httptest.NewRequest("GET", path, nil)
+	w := &discardWriter{header: make(http.Header)}
+	b.ReportAllocs()
+	for b.Loop() {
+		clear(w.header)
+		s.ServeHTTP(w, r)
+	}
+}
+
+// A plain GET / only allocates the countingWriter wrapping the response.
+func TestServeIndexAllocs(t *testing.T) {
+	s := newTestServer(t, Config{LogLevel: "error"}, map[string]string{"index.html": "<p>hello</p>"})
+	if n := serveAllocs(t, s, "/"); n > 1 {
+		t.Errorf("GET / makes %v allocations, want at most 1", n)
+	}
+}
+
+func BenchmarkServeIndex(b *testing.B) {
+	s := newTestServer(b, Config{LogLevel: "error"}, map[string]string{"index.html": "<p>hello</p>"})
+	benchmarkServe(b, s, "/")
+}
+
+// smallSite is a site of small files without a custom 404 page.
+var smallSite = map[string]string{
+	"index.html":    "<p>hello</p>",
+	"css/site.css":  "body { margin: 0 }",
+	"js/app.min.js": "console.log(1)",
+}
+
+func TestServeAllocs(t *testing.T) {
+	s := newTestServer(t, Config{LogLevel: "error"}, smallSite)
+	for _, tt := range []struct {
+		path string
+		max  float64
+	}{
+		{"/css/site.css", 1},
+		{"/missing.png", 5},
+	} {
+		if n := serveAllocs(t, s, tt.path); n > tt.max {
+			t.Errorf("GET %s makes %v allocations, want at most %v", tt.path, n, tt.max)
+		}
+	}
+}
+
+func BenchmarkServeSmallFile(b *testing.B) {
+	s := newTestServer(b, Config{LogLevel: "error"}, smallSite)
+	benchmarkServe(b, s, "/css/site.css")
+}
+
+func BenchmarkServe404(b *testing.B) {
+	s := newTestServer(b, Config{LogLevel: "error"}, smallSite)
+	benchmarkServe(b, s, "/missing.png")
+}
+
+// The headers of a file are formatted once, when it's loaded, and then
+// copied into each response without allocating.
+func TestSetHeadersAllocs(t *testing.T) {
+	s := newTestServer(t, Config{}, smallSite)
+	f := s.current().files["/css/site.css"]
+	h := make(http.Header)
+	for _, encoding := range []string{"", "gzip"} {
+		if n := testing.AllocsPerRun(100, func() { f.SetHeaders(h, encoding) }); n != 0 {
+			t.Errorf("SetHeaders(%q) makes %v allocations, want none", encoding, n)
+		}
+	}
+}
+
+func BenchmarkSetHeaders(b *testing.B) {
+	s := newTestServer(b, Config{}, smallSite)
+	f := s.current().files["/css/site.css"]
+	h := make(http.Header)
+	b.ReportAllocs()
+	for b.Loop() {
+		f.SetHeaders(h, "gzip")
+	}
+}
+
+func TestServeGetHead(t *testing.T) {
+	page := bytes.Repeat([]byte("<p>The same paragraph, over and over.</p>\n"), 50)
+	s := newTestServer(t, Config{}, map[string]string{"index.html": "<p>hello</p>", "page.html": string(page)})
+	f := s.current().files["/page.html"]
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+
+	for _, tt := range []struct {
+		name    string
+		methods []string // GET and HEAD if nil
+		path    string
+		header  http.Header
+		status  int
+		want    http.Header // "" for a header that must be missing
+		body    []byte      // of the GET response, unchecked if nil
+	}{
+		{
+			name: "full", path: "/page.html", status: http.StatusOK,
+			want: http.Header{"Content-Type": {"text/html; charset=utf-8"}, "Content-Length": {strconv.Itoa(len(page))}, "Content-Encoding": {""}, "Vary": {"Accept-Encoding"}},
+			body: page,
+		},
+		{
+			name: "gzipped", path: "/page.html", header: http.Header{"Accept-Encoding": {"gzip"}}, status: http.StatusOK,
+			want: http.Header{"Content-Length": {strconv.Itoa(len(f.gzContents))}, "Content-Encoding": {"gzip"}, "Vary": {"Accept-Encoding"}},
+			body: f.gzContents,
+		},
+		{
+			name: "not modified", path: "/page.html", header: http.Header{"If-Modified-Since": {future}}, status: http.StatusNotModified,
+			want: http.Header{"Last-Modified": {f.headers.lastModified[0]}, "Content-Range": {""}},
+			body: []byte{},
+		},
+		{
+			name: "range", path: "/page.html", header: http.Header{"Range": {"bytes=3-11"}}, status: http.StatusPartialContent,
+			want: http.Header{"Content-Range": {fmt.Sprintf("bytes 3-11/%d", len(page))}, "Content-Length": {"9"}, "Content-Encoding": {""}},
+			body: page[3:12],
+		},
+		{
+			name: "not found", path: "/missing.html", status: http.StatusNotFound,
+			want: http.Header{"Content-Type": {"text/plain; charset=utf-8"}, "Last-Modified": {""}},
+		},
+		{
+			name: "method not allowed", methods: []string{"POST", "DELETE"}, path: "/page.html", status: http.StatusMethodNotAllowed,
+			body: []byte{},
+		},
+	} {
+		methods := tt.methods
+		if methods == nil {
+			methods = []string{"GET", "HEAD"}
+		}
+		for _, method := range methods {
+			t.Run(tt.name+"/"+method, func(t *testing.T) {
+				r := httptest.NewRequest(method, tt.path, nil)
+				for name, values := range tt.header {
+					r.Header[name] = values
+				}
+				rec := httptest.NewRecorder()
+				s.ServeHTTP(rec, r)
+
+				if rec.Code != tt.status {
+					t.Errorf("status %d, want %d", rec.Code, tt.status)
+				}
+				for name, values := range tt.want {
+					if got := rec.Header().Get(name); got != values[0] {
+						t.Errorf("%s: %q, want %q", name, got, values[0])
+					}
+				}
+				switch {
+				case method == "HEAD" && rec.Body.Len() > 0:
+					t.Errorf("HEAD response has a %d bytes body", rec.Body.Len())
+				case method == "GET" && tt.body != nil && !bytes.Equal(rec.Body.Bytes(), tt.body):
+					t.Errorf("body %q, want %q", rec.Body, tt.body)
+				}
+			})
+		}
+	}
+
+	// whatever the conditions, range and encoding, HEAD gets exactly the
+	// headers of GET, in plain and compact mode alike
+	past := f.modTime("").Add(-time.Hour).UTC().Format(http.TimeFormat)
+	conditions := map[string]http.Header{
+		"unconditional":            nil,
+		"modified since":           {"If-Modified-Since": {past}},
+		"not modified since":       {"If-Modified-Since": {future}},
+		"none match":               {"If-None-Match": {`"other"`}},
+		"none match any":           {"If-None-Match": {"*"}},
+		"if-range current":         {"If-Range": {f.headers.lastModified[0]}},
+		"if-range stale":           {"If-Range": {past}},
+		"if-range entity tag":      {"If-Range": {`"other"`}},
+		"not modified, none match": {"If-Modified-Since": {future}, "If-None-Match": {`"other"`}},
+	}
+	ranges := []string{"", "bytes=3-11", "bytes=-5", "bytes=100-", "bytes=0-1,5-6", "bytes=1000000-", "lines=1-2"}
+	encodings := []string{"", "gzip", "br", "gzip, br", "identity", "gzip;q=0", "*;q=0"}
+	for _, cfg := range []Config{{Brotli: true}, {Brotli: true, Compact: true}} {
+		s := newTestServer(t, cfg, map[string]string{"page.html": string(page)})
+		for name, condition := range conditions {
+			for _, rng := range ranges {
+				for _, encoding := range encodings {
+					header := http.Header{}
+					for k, v := range condition {
+						header[k] = v
+					}
+					if rng != "" {
+						header.Set("Range", rng)
+					}
+					if encoding != "" {
+						header.Set("Accept-Encoding", encoding)
+					}
+
+					got := serveRequest(s, "GET", "/page.html", header)
+					head := serveRequest(s, "HEAD", "/page.html", header)
+					if head.Code != got.Code || !reflect.DeepEqual(head.Header(), got.Header()) {
+						t.Errorf("compact %v, %s, Range %q, Accept-Encoding %q: HEAD got %d\n%v\nwant GET's %d\n%v", cfg.Compact, name, rng, encoding, head.Code, head.Header(), got.Code, got.Header())
+					}
+					if head.Body.Len() > 0 {
+						t.Errorf("compact %v, %s, Range %q, Accept-Encoding %q: HEAD response has a %d bytes body", cfg.Compact, name, rng, encoding, head.Body.Len())
+					}
+				}
+			}
+		}
+	}
+}
+
+// In compact mode only the compressed bytes of a file are kept, yet
+// HEAD requests get the Content-Length a GET would, whatever encoding
+// is negotiated, since every encoding's length is recorded at load time.
+func TestHeadContentLengthCompact(t *testing.T) {
+	page := strings.Repeat("<p>The same paragraph, over and over.</p>\n", 50)
+	s := newTestServer(t, Config{Compact: true, Brotli: true}, map[string]string{"index.html": "<p>hello</p>", "page.html": page})
+	if f := s.current().files["/page.html"]; f.contents != nil {
+		t.Fatal("compact mode kept the identity bytes of /page.html")
+	}
+
+	for _, accept := range []string{"", "gzip", "br", "gzip, br;q=0.5", "identity"} {
+		var lengths [2]string
+		for i, method := range []string{"GET", "HEAD"} {
+			r := httptest.NewRequest(method, "/page.html", nil)
+			r.Header.Set("Accept-Encoding", accept)
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, r)
+			lengths[i] = rec.Header().Get("Content-Length")
+			if method == "GET" && lengths[i] != strconv.Itoa(rec.Body.Len()) {
+				t.Errorf("Accept-Encoding %q: GET Content-Length %s for a %d bytes body", accept, lengths[i], rec.Body.Len())
+			}
+		}
+		if lengths[0] != lengths[1] {
+			t.Errorf("Accept-Encoding %q: HEAD Content-Length %s, GET %s", accept, lengths[1], lengths[0])
+		}
+	}
+}
+
+func TestHTTPSHost(t *testing.T) {
+	for _, tt := range []struct {
+		host string
+		name string // without its port
+		port int
+		want string
+	}{
+		{"example.com", "example.com", 0, "example.com"},
+		{"example.com:8080", "example.com", 0, "example.com"},
+		{"example.com:8080", "example.com", 443, "example.com"},
+		{"example.com:8080", "example.com", 8443, "example.com:8443"},
+		{"Example.COM:8080", "Example.COM", 0, "Example.COM"},
+		{"192.0.2.1", "192.0.2.1", 0, "192.0.2.1"},
+		{"192.0.2.1:8080", "192.0.2.1", 8443, "192.0.2.1:8443"},
+		{"[2001:db8::1]", "2001:db8::1", 0, "[2001:db8::1]"},
+		{"[2001:db8::1]:8080", "2001:db8::1", 0, "[2001:db8::1]"},
+		{"[2001:DB8::1]:8080", "2001:DB8::1", 8443, "[2001:DB8::1]:8443"},
+	} {
+		if got := hostname(tt.host); got != tt.name {
+			t.Errorf("hostname(%q) = %q, want %q", tt.host, got, tt.name)
+		}
+		if got := httpsHost(tt.host, tt.port); got != tt.want {
+			t.Errorf("httpsHost(%q, %d) = %q, want %q", tt.host, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	for _, tt := range []struct {
+		header          string
+		start, end      int
+		ok, satisfiable bool
+	}{
+		{"bytes=0-9", 0, 9, true, true},
+		{"bytes=90-", 90, 99, true, true},
+		{"bytes=90-200", 90, 99, true, true},
+		{"bytes=-10", 90, 99, true, true},
+		{"bytes=-200", 0, 99, true, true},
+		{"bytes=100-", 0, 0, true, false},
+		{"bytes=-0", 0, 0, true, false},
+		{"bytes=0-1,5-6", 0, 0, false, false},
+		{"bytes=9-1", 0, 0, false, false},
+		{"items=0-9", 0, 0, false, false},
+	} {
+		start, end, ok, satisfiable := parseRange(tt.header, 100)
+		if ok != tt.ok || satisfiable != tt.satisfiable || satisfiable && (start != tt.start || end != tt.end) {
+			t.Errorf("parseRange(%q, 100) = %d, %d, %v, %v, want %d, %d, %v, %v", tt.header, start, end, ok, satisfiable, tt.start, tt.end, tt.ok, tt.satisfiable)
+		}
+	}
+}
+
+// In compact mode, ranges of gzipped files are served by decompressing
+// them, unless NoRangeDecompress says to send the full file instead.
+func TestRangeCompact(t *testing.T) {
+	page := strings.Repeat("<p>The same paragraph, over and over.</p>\n", 50)
+	for _, noDecompress := range []bool{false, true} {
+		s := newTestServer(t, Config{Compact: true, NoRangeDecompress: noDecompress}, map[string]string{"page.html": page})
+		r := httptest.NewRequest("GET", "/page.html", nil)
+		r.Header.Set("Range", "bytes=10-19")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+
+		if rec.Header().Get("Accept-Ranges") != "" {
+			t.Errorf("NoRangeDecompress %v: Accept-Ranges sent without the identity bytes in memory", noDecompress)
+		}
+		if noDecompress {
+			if rec.Code != http.StatusOK || rec.Body.String() != page {
+				t.Errorf("NoRangeDecompress: got %d with %d bytes, want 200 with the full file", rec.Code, rec.Body.Len())
+			}
+			continue
+		}
+		if rec.Code != http.StatusPartialContent || rec.Body.String() != page[10:20] {
+			t.Errorf("got %d %q, want 206 %q", rec.Code, rec.Body, page[10:20])
+		}
+	}
+}
+
+// Ranges are served from the identity bytes, even to clients accepting
+// gzip, as long as If-Range, if sent, names the current version.
+func TestRangeIfRange(t *testing.T) {
+	page := strings.Repeat("<p>The same paragraph, over and over.</p>\n", 50)
+	s := newTestServer(t, Config{}, map[string]string{"page.html": page})
+	lastModified := s.current().files["/page.html"].headers.lastModified[0]
+
+	for _, tt := range []struct {
+		ifRange string
+		status  int
+		body    string
+	}{
+		{"", http.StatusPartialContent, page[10:20]},
+		{lastModified, http.StatusPartialContent, page[10:20]},
+		{"Mon, 02 Jan 2006 15:04:05 GMT", http.StatusOK, ""},
+		{`"some-etag"`, http.StatusOK, ""},
+	} {
+		r := httptest.NewRequest("GET", "/page.html", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		r.Header.Set("Range", "bytes=10-19")
+		if tt.ifRange != "" {
+			r.Header.Set("If-Range", tt.ifRange)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+
+		if rec.Code != tt.status || rec.Header().Get("Accept-Ranges") != "bytes" {
+			t.Errorf("If-Range %q: got %d with Accept-Ranges %q, want %d with bytes", tt.ifRange, rec.Code, rec.Header().Get("Accept-Ranges"), tt.status)
+		}
+		if tt.status == http.StatusPartialContent && (rec.Body.String() != tt.body || rec.Header().Get("Content-Encoding") != "") {
+			t.Errorf("If-Range %q: got %q with Content-Encoding %q, want the identity bytes %q", tt.ifRange, rec.Body, rec.Header().Get("Content-Encoding"), tt.body)
+		}
+		if tt.status == http.StatusOK && rec.Header().Get("Content-Encoding") != "gzip" {
+			t.Errorf("If-Range %q: full response not gzipped", tt.ifRange)
+		}
+	}
+}
+
+func TestHTTPSExempt(t *testing.T) {
+	s := newTestServer(t, Config{ForceHTTPS: true, HTTPSExempt: []string{"/.well-known/acme-challenge/*"}}, map[string]string{
+		"index.html":                         "home",
+		".well-known/acme-challenge/token42": "proof",
+	})
+
+	for _, tt := range []struct {
+		path     string
+		proto    string
+		status   int
+		location string
+	}{
+		{"/", "http", http.StatusMovedPermanently, "https://example.com/"},
+		{"/", "https", http.StatusOK, ""},
+		{"/.well-known/acme-challenge/token42", "http", http.StatusOK, ""},
+		{"/.well-known/acme-challenge/", "http", http.StatusMovedPermanently, "https://example.com/.well-known/acme-challenge/"},
+	} {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Host = "example.com:8080"
+		r.Header.Set("X-Forwarded-Proto", tt.proto)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+		if rec.Code != tt.status || rec.Header().Get("Location") != tt.location {
+			t.Errorf("%s over %s: got %d to %q, want %d to %q", tt.path, tt.proto, rec.Code, rec.Header().Get("Location"), tt.status, tt.location)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var order []string
+	tag := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				w.Header().Add("X-Middleware", name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	s := newTestServer(t, Config{ForceHTTPS: true, Middleware: []func(http.Handler) http.Handler{tag("outer"), tag("inner"), auth}}, map[string]string{"index.html": "home"})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer x")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK || rec.Body.String() != "home" || strings.Join(order, ",") != "outer,inner" {
+		t.Errorf("got %d %q through %v, want 200 home through outer,inner", rec.Code, rec.Body, order)
+	}
+
+	if rec := get(s, "/"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without credentials: got %d, want the 401 of the middleware", rec.Code)
+	}
+
+	// HTTPS redirects happen before any middleware
+	order = nil
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Forwarded-Proto", "http")
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+	if rec.Code != http.StatusMovedPermanently || len(order) != 0 {
+		t.Errorf("plain HTTP request: got %d through %v, want a redirect through no middleware", rec.Code, order)
+	}
+}
+
+func TestCanonicalSlashes(t *testing.T) {
+	files := map[string]string{"index.html": "home", "docs/index.html": "docs", "docs/page.html": "page"}
+	s := newTestServer(t, Config{}, files)
+	for _, tt := range []struct {
+		handler  http.Handler
+		uri      string
+		status   int
+		location string
+	}{
+		{s, "//docs//page.html?q=1", http.StatusMovedPermanently, "/docs/page.html?q=1"},
+		{s, "/docs/./page.html", http.StatusMovedPermanently, "/docs/page.html"},
+		{s, "/x/../docs//", http.StatusMovedPermanently, "/docs/"},
+		// straight to the directory rather than to its index first
+		{s, "/docs//index.html", http.StatusMovedPermanently, "/docs"},
+		{s, "/docs/page.html", http.StatusOK, ""},
+		// the prefix stripped by a mounting handler is kept
+		{http.StripPrefix("/site", s), "/site//docs/page.html", http.StatusMovedPermanently, "/site/docs/page.html"},
+	} {
+		rec := httptest.NewRecorder()
+		tt.handler.ServeHTTP(rec, httptest.NewRequest("GET", tt.uri, nil))
+		if rec.Code != tt.status || rec.Header().Get("Location") != tt.location {
+			t.Errorf("%s: got %d to %q, want %d to %q", tt.uri, rec.Code, rec.Header().Get("Location"), tt.status, tt.location)
+		}
+	}
+
+	s = newTestServer(t, Config{NoCanonicalSlashes: true}, files)
+	if rec := get(s, "//docs//page.html"); rec.Code != http.StatusOK || rec.Body.String() != "page" {
+		t.Errorf("NoCanonicalSlashes: got %d %q, want the page served as is", rec.Code, rec.Body)
+	}
+}
+
+func TestRefuseBody(t *testing.T) {
+	s := newTestServer(t, Config{MaxIgnoredBody: 16}, map[string]string{"index.html": "home"})
+
+	for _, method := range []string{"GET", "HEAD", "OPTIONS"} {
+		for _, tt := range []struct {
+			body    string
+			chunked bool
+			status  int
+		}{
+			{"", false, 0},
+			{"small body", false, 0},
+			{strings.Repeat("x", 17), false, http.StatusRequestEntityTooLarge},
+			{"small body", true, http.StatusRequestEntityTooLarge},
+		} {
+			body := strings.NewReader(tt.body)
+			r := httptest.NewRequest(method, "/", body)
+			if tt.chunked {
+				r.ContentLength, r.TransferEncoding = -1, []string{"chunked"}
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, r)
+
+			want := tt.status
+			if want == 0 {
+				want = http.StatusOK
+				if method == "OPTIONS" {
+					want = http.StatusNoContent
+				}
+			}
+			if rec.Code != want {
+				t.Errorf("%s with a %d bytes body, chunked %v: got %d, want %d", method, len(tt.body), tt.chunked, rec.Code, want)
+			}
+			if tt.status == 0 && body.Len() > 0 {
+				t.Errorf("%s with a %d bytes body: %d bytes left undrained", method, len(tt.body), body.Len())
+			}
+			if tt.status != 0 && rec.Header().Get("Connection") != "close" {
+				t.Errorf("%s with a %d bytes body, chunked %v: connection kept open", method, len(tt.body), tt.chunked)
+			}
+		}
+	}
+
+	// other methods' bodies are none of its business
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", 17))))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST with a large body: got %d, want 405", rec.Code)
+	}
+}
+
+func TestIndexMode(t *testing.T) {
+	files := map[string]string{"index.html": "home", "docs/index.html": "docs"}
+	for _, tt := range []struct {
+		mode     string
+		path     string
+		status   int
+		location string
+	}{
+		{"", "/docs/index.html", http.StatusMovedPermanently, "/docs"},
+		{"", "/docs/", http.StatusOK, ""},
+		{"", "/docs", http.StatusOK, ""},
+		{"", "/index.html", http.StatusMovedPermanently, "/"},
+		{indexModeServe, "/docs/index.html", http.StatusOK, ""},
+		{indexModeServe, "/docs/", http.StatusOK, ""},
+		{indexModeServe, "/index.html", http.StatusOK, ""},
+	} {
+		s := newTestServer(t, Config{IndexMode: tt.mode}, files)
+		var heads [2]http.Header
+		for i, method := range []string{"GET", "HEAD"} {
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest(method, tt.path, nil))
+			if rec.Code != tt.status || rec.Header().Get("Location") != tt.location {
+				t.Errorf("mode %q, %s %s: got %d to %q, want %d to %q", tt.mode, method, tt.path, rec.Code, rec.Header().Get("Location"), tt.status, tt.location)
+			}
+			heads[i] = rec.Header()
+		}
+		for _, name := range []string{"Content-Type", "Content-Length", "Last-Modified", "Location"} {
+			if heads[0].Get(name) != heads[1].Get(name) {
+				t.Errorf("mode %q, %s: %s %q for GET but %q for HEAD", tt.mode, tt.path, name, heads[0].Get(name), heads[1].Get(name))
+			}
+		}
+	}
+
+	if _, err := New(Config{Root: writeSite(t, files), IndexMode: "list"}); err == nil {
+		t.Error("unknown index mode accepted")
+	}
+}
+
+func TestWriteDynamic(t *testing.T) {
+	compressible := []byte(strings.Repeat("the same words, over and over ", 100))
+	incompressible := make([]byte, 4<<10)
+	for i := range incompressible {
+		// a xorshift sequence gzip can't shrink
+		x := uint32(i+1) * 2654435761
+		x ^= x << 13
+		x ^= x >> 17
+		incompressible[i] = byte(x ^ x<<5)
+	}
+	small := []byte(strings.Repeat("ab", 300))
+
+	for _, tt := range []struct {
+		name     string
+		body     []byte
+		saveData bool
+		gzipped  bool
+	}{
+		{"compressible", compressible, false, true},
+		{"incompressible", incompressible, false, false},
+		{"small", small, false, false},
+		{"small saving data", small, true, true},
+	} {
+		var heads [2]http.Header
+		for i, method := range []string{"GET", "HEAD"} {
+			r := httptest.NewRequest(method, "/", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			if tt.saveData {
+				r.Header.Set("Save-Data", "on")
+			}
+			rec := httptest.NewRecorder()
+			writeDynamic(rec, r, http.StatusOK, "text/plain; charset=utf-8", tt.body)
+			heads[i] = rec.Header()
+
+			if method == "HEAD" {
+				if rec.Body.Len() > 0 {
+					t.Errorf("%s: HEAD response has a body", tt.name)
+				}
+				continue
+			}
+			body := rec.Body.Bytes()
+			if (rec.Header().Get("Content-Encoding") == "gzip") != tt.gzipped {
+				t.Errorf("%s: Content-Encoding %q, want gzipped %v", tt.name, rec.Header().Get("Content-Encoding"), tt.gzipped)
+			}
+			if tt.gzipped {
+				var err error
+				if body, err = decompressContents(body); err != nil {
+					t.Fatalf("%s: %v", tt.name, err)
+				}
+			}
+			if !bytes.Equal(body, tt.body) {
+				t.Errorf("%s: body differs from what was written", tt.name)
+			}
+			if rec.Header().Get("Content-Length") != strconv.Itoa(rec.Body.Len()) {
+				t.Errorf("%s: Content-Length %s for %d bytes", tt.name, rec.Header().Get("Content-Length"), rec.Body.Len())
+			}
+		}
+		for _, name := range []string{"Content-Encoding", "Content-Length", "Vary"} {
+			if heads[0].Get(name) != heads[1].Get(name) {
+				t.Errorf("%s: %s %q for GET but %q for HEAD", tt.name, name, heads[0].Get(name), heads[1].Get(name))
+			}
+		}
+	}
+}
+
+func TestRejectSuspiciousPaths(t *testing.T) {
+	files := map[string]string{"index.html": "home", `a\b.txt`: "backslash"}
+	for _, reject := range []bool{false, true} {
+		logs := captureLog(t)
+		s := newTestServer(t, Config{RejectSuspiciousPaths: reject}, files)
+
+		for _, tt := range []struct {
+			path   string
+			status int
+		}{
+			{"/a%5Cb.txt", http.StatusOK},
+			{"/index.html%00.txt", http.StatusNotFound},
+			{"/a%0Ab", http.StatusNotFound},
+			{"/a%7Fb", http.StatusNotFound},
+		} {
+			want := tt.status
+			if reject {
+				want = http.StatusBadRequest
+			}
+			if rec := get(s, tt.path); rec.Code != want {
+				t.Errorf("rejecting %v: %s got %d, want %d", reject, tt.path, rec.Code, want)
+			}
+		}
+		if got := strings.Count(logs.String(), "rejected suspicious path"); reject && got != 4 || !reject && got != 0 {
+			t.Errorf("rejecting %v: logged %d rejections:\n%s", reject, got, logs)
+		}
+		if rec := get(s, "/"); rec.Code != http.StatusOK {
+			t.Errorf("rejecting %v: / got %d", reject, rec.Code)
+		}
+	}
+}
+
+func TestAcceptEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		header   string
+		gzip, br float64
+		identity bool
+		chosen   string
+	}{
+		{"", 0, 0, true, ""},
+		{"gzip, br", 1, 1, true, "br"},
+		{"GZIP;Q=0.5, br;q=0.4", 0.5, 0.4, true, "gzip"},
+		{"gzip;q=0.8, gzip;q=0.2, br;q=0.2", 0.2, 0.2, true, "br"},
+		{"gzip, gzip;q=0", 0, 0, true, ""},
+		{"*;q=0.3, br;q=0", 0.3, 0, true, "gzip"},
+		{"*;q=0", 0, 0, false, ""},
+		{"*;q=0, identity", 0, 0, true, ""},
+		{"gzip;q=2, br;q=abc, ,, deflate", 0, 0, true, ""},
+		{"gzip;q=0.5;level=9, br ;q=1", 0.5, 1, true, "br"},
+		{"g(zip), gzip", 1, 0, true, "gzip"},
+		{"identity;q=0, gzip", 1, 0, false, "gzip"},
+	} {
+		if q := encodingQ(tt.header, "gzip"); q != tt.gzip {
+			t.Errorf("%q: gzip q=%v, want %v", tt.header, q, tt.gzip)
+		}
+		if q := encodingQ(tt.header, "br"); q != tt.br {
+			t.Errorf("%q: br q=%v, want %v", tt.header, q, tt.br)
+		}
+		if got := acceptsEncoding(tt.header, "gzip"); got != (tt.gzip > 0) {
+			t.Errorf("%q: accepts gzip %v", tt.header, got)
+		}
+		if got := acceptsIdentity(tt.header); got != tt.identity {
+			t.Errorf("%q: accepts identity %v, want %v", tt.header, got, tt.identity)
+		}
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", tt.header)
+		f := &siteFile{gzContents: []byte("gz"), brContents: []byte("br")}
+		if got := negotiateEncoding(http.Header{}, r, f); got != tt.chosen {
+			t.Errorf("%q: negotiated %q, want %q", tt.header, got, tt.chosen)
+		}
+	}
+}
+
+// Clients that don't take gzip get the bytes of the file as is, in
+// plain and compact mode alike, with a Vary telling caches why.
+func TestIdentityWithoutGzip(t *testing.T) {
+	page := strings.Repeat("<p>The same paragraph, over and over.</p>\n", 50)
+	for _, compact := range []bool{false, true} {
+		s := newTestServer(t, Config{Compact: compact}, map[string]string{"page.html": page})
+		for _, header := range []http.Header{nil, {"Accept-Encoding": {"deflate"}}, {"Accept-Encoding": {"gzip;q=0, br;q=0"}}, {"Accept-Encoding": {"identity"}}} {
+			rec := serveRequest(s, "GET", "/page.html", header)
+			if rec.Code != http.StatusOK || rec.Body.String() != page {
+				t.Errorf("compact %v, %v: got %d with a %d bytes body, want the page", compact, header, rec.Code, rec.Body.Len())
+			}
+			h := rec.Header()
+			if h.Get("Content-Encoding") != "" || h.Get("Vary") != "Accept-Encoding" || h.Get("Content-Length") != strconv.Itoa(len(page)) {
+				t.Errorf("compact %v, %v: Content-Encoding %q, Vary %q, Content-Length %q", compact, header, h.Get("Content-Encoding"), h.Get("Vary"), h.Get("Content-Length"))
+			}
+		}
+	}
+}
+
+func TestStrictEncoding(t *testing.T) {
+	page := strings.Repeat("<p>The same paragraph, over and over.</p>\n", 50)
+	files := map[string]string{"page.html": page, "tiny.txt": "x"}
+
+	for _, strict := range []bool{false, true} {
+		s := newTestServer(t, Config{StrictEncoding: strict}, files)
+		for _, tt := range []struct {
+			path, header string
+			refused      bool
+			encoding     string
+		}{
+			{"/page.html", "gzip", false, "gzip"},
+			{"/page.html", "identity;q=0, gzip", false, "gzip"},
+			{"/page.html", "identity;q=0", true, ""},
+			{"/page.html", "*;q=0", true, ""},
+			{"/page.html", "identity;q=0, gzip;q=0, br;q=0", true, ""},
+			{"/tiny.txt", "*;q=0", true, ""},
+			{"/tiny.txt", "*;q=0, identity", false, ""},
+		} {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Header.Set("Accept-Encoding", tt.header)
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, r)
+
+			want, encoding := http.StatusOK, tt.encoding
+			if strict && tt.refused {
+				want = http.StatusNotAcceptable
+			}
+			if rec.Code != want {
+				t.Errorf("strict %v: %s with %q got %d, want %d", strict, tt.path, tt.header, rec.Code, want)
+			}
+			if rec.Code == http.StatusOK && rec.Header().Get("Content-Encoding") != encoding {
+				t.Errorf("strict %v: %s with %q sent as %q, want %q", strict, tt.path, tt.header, rec.Header().Get("Content-Encoding"), encoding)
+			}
+		}
+	}
+}
+
+func TestEncodingHintHeader(t *testing.T) {
+	page := strings.Repeat("<p>The same paragraph, over and over.</p>\n", 50)
+	s := newTestServer(t, Config{EncodingHintHeader: "X-Accept-Encoding"}, map[string]string{"page.html": page})
+
+	for _, tt := range []struct {
+		accept, hint, encoding string
+	}{
+		{"", "", ""},
+		{"", "gzip", "gzip"},
+		{"gzip", "", "gzip"},
+		{"identity", "gzip", "gzip"},
+		// a coding listed twice gets the lowest q-value
+		{"gzip", "gzip;q=0", ""},
+	} {
+		r := httptest.NewRequest("GET", "/page.html", nil)
+		r.Header.Set("Accept-Encoding", tt.accept)
+		r.Header.Set("X-Accept-Encoding", tt.hint)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+		if got := rec.Header().Get("Content-Encoding"); got != tt.encoding {
+			t.Errorf("Accept-Encoding %q, hint %q: sent as %q, want %q", tt.accept, tt.hint, got, tt.encoding)
+		}
+		if vary := strings.Join(rec.Header()["Vary"], ", "); !strings.Contains(vary, "X-Accept-Encoding") {
+			t.Errorf("Accept-Encoding %q, hint %q: Vary %q lacks the hint header", tt.accept, tt.hint, vary)
+		}
+	}
+
+	if _, err := New(Config{Root: writeSite(t, smallSite), EncodingHintHeader: "X Accept"}); err == nil {
+		t.Error("invalid hint header name accepted")
+	}
+}
+
+func TestSaveData(t *testing.T) {
+	for header, want := range map[string]bool{"": false, "on": true, " On ;ext": true, "off": false, "only": false} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Save-Data", header)
+		if got := saveData(r); got != want {
+			t.Errorf("Save-Data %q: got %v, want %v", header, got, want)
+		}
+	}
+
+	// only responses the hint changes vary with it
+	body := []byte(strings.Repeat("ab", 300))
+	for _, tt := range []struct {
+		threshold int
+		vary      string
+	}{
+		{dynamicGzipThreshold, "Accept-Encoding, Save-Data"},
+		{0, "Accept-Encoding"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		writeCompressed(rec, r, http.StatusOK, "text/plain; charset=utf-8", body, tt.threshold)
+		if vary := strings.Join(rec.Header()["Vary"], ", "); vary != tt.vary {
+			t.Errorf("threshold %d: Vary %q, want %q", tt.threshold, vary, tt.vary)
+		}
+	}
+}
+
+func TestModTimeSkew(t *testing.T) {
+	root := writeSite(t, map[string]string{"index.html": "home"})
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 500e6, time.UTC)
+	if err := os.Chtimes(filepath.Join(root, "index.html"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		skew   time.Duration
+		after  time.Duration // If-Modified-Since past the second of modTime
+		status int
+	}{
+		// an echoed Last-Modified, truncated to the second
+		{0, 0, http.StatusNotModified},
+		{0, -time.Second, http.StatusOK},
+		{10 * time.Second, 0, http.StatusOK},
+		{10 * time.Second, 9 * time.Second, http.StatusOK},
+		{10 * time.Second, 10 * time.Second, http.StatusNotModified},
+	} {
+		s, err := New(Config{Root: root, ModTimeSkew: tt.skew})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("If-Modified-Since", modTime.Truncate(time.Second).Add(tt.after).Format(http.TimeFormat))
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+		s.Close()
+		if rec.Code != tt.status {
+			t.Errorf("skew %v, If-Modified-Since %v later: got %d, want %d", tt.skew, tt.after, rec.Code, tt.status)
+		}
+	}
+
+	if _, err := New(Config{Root: root, ModTimeSkew: -time.Second}); err == nil {
+		t.Error("negative skew accepted")
+	}
+}
+
+func TestServerOptions(t *testing.T) {
+	s := newTestServer(t, Config{}, smallSite)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("OPTIONS", "*", nil))
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Allow") != "OPTIONS, GET, HEAD" {
+		t.Errorf("OPTIONS *: got %d with Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+
+	// net/http answers it itself unless told not to
+	ts := httptest.NewUnstartedServer(s)
+	ts.Config.DisableGeneralOptionsHandler = true
+	ts.Start()
+	defer ts.Close()
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "OPTIONS * HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Allow") != "OPTIONS, GET, HEAD" {
+		t.Errorf("OPTIONS * over the wire: got %d with Allow %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+}
+
+func TestRedirectInOneHop(t *testing.T) {
+	files := map[string]string{"index.html": "home", "docs/index.html": "docs", "photos/a.jpg": "jpg"}
+	https := newTestServer(t, Config{ForceHTTPS: true, AutoIndex: true}, files)
+	plain := newTestServer(t, Config{AutoIndex: true}, files)
+	single, err := New(Config{Root: writeSite(t, map[string]string{"report.pdf": "%PDF"}) + "/report.pdf", SingleFileAtName: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer single.Close()
+
+	for _, tt := range []struct {
+		s        *Server
+		uri      string
+		location string
+	}{
+		{https, "/docs/index.html?q=1", "https://example.com/docs?q=1"},
+		{https, "//docs//index.html", "https://example.com/docs"},
+		{https, "/photos", "https://example.com/photos/"},
+		{https, "/photos/a.jpg", "https://example.com/photos/a.jpg"},
+		{plain, "//photos", "/photos/"},
+		{plain, "/docs/./index.html", "/docs"},
+		{single, "//", "/report.pdf"},
+	} {
+		r := httptest.NewRequest("GET", tt.uri, nil)
+		r.Header.Set("X-Forwarded-Proto", "http")
+		rec := httptest.NewRecorder()
+		tt.s.ServeHTTP(rec, r)
+		if rec.Header().Get("Location") != tt.location {
+			t.Errorf("%s: redirected to %q, want %q", tt.uri, rec.Header().Get("Location"), tt.location)
+			continue
+		}
+
+		// where it leads is served right away
+		u, _ := url.Parse(tt.location)
+		r = httptest.NewRequest("GET", u.RequestURI(), nil)
+		r.Header.Set("X-Forwarded-Proto", "https")
+		rec = httptest.NewRecorder()
+		tt.s.ServeHTTP(rec, r)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: %s got %d, want 200 after one redirect", tt.uri, tt.location, rec.Code)
+		}
+	}
+}
+
+func TestPathCollision(t *testing.T) {
+	s := newTestServer(t, Config{}, smallSite)
+	for _, order := range [][]string{{"/docs", "/docs/index.html"}, {"/docs/index.html", "/docs"}} {
+		snap := &siteSnapshot{files: make(map[string]*siteFile)}
+		for _, name := range order {
+			s.addFile(snap, newSiteFile(name, []byte(name), "", "", false, false), nil)
+		}
+		if f := s.resolveFile(snap, "/docs"); f == nil || string(f.contents) != "/docs" {
+			t.Errorf("%q: /docs resolves to %v, want the file", order, f)
+		}
+		if f := s.resolveFile(snap, "/docs/index.html"); f == nil || f.isIndex {
+			t.Errorf("%q: /docs/index.html resolves to %v, want it served as any file", order, f)
+		}
+		if len(snap.warnings) != 1 || snap.warnings[0].Code != warnPathCollision {
+			t.Errorf("%q: warnings %v, want one %s", order, snap.warnings, warnPathCollision)
+		}
+	}
+
+	// tarballs are flat, and can hold both
+	s = newTestServer(t, Config{AdminToken: "secret"}, smallSite)
+	captureLog(t)
+	if rec := deploy(s, "secret", tarball(t, map[string]string{"index.html": "home", "docs": "file", "docs/index.html": "index"})); rec.Code != http.StatusOK {
+		t.Fatalf("deploy: got %d %q", rec.Code, rec.Body)
+	}
+	if rec := get(s, "/docs"); rec.Code != http.StatusOK || rec.Body.String() != "file" {
+		t.Errorf("/docs: got %d %q, want the file", rec.Code, rec.Body)
+	}
+	if rec := get(s, "/docs/index.html"); rec.Code != http.StatusOK || rec.Body.String() != "index" {
+		t.Errorf("/docs/index.html: got %d %q, want the index served at its own path", rec.Code, rec.Body)
+	}
+}
+
+func TestMinHTTPVersion(t *testing.T) {
+	for _, tt := range []struct {
+		min    string
+		proto  string
+		status int
+	}{
+		{"", "HTTP/1.0", http.StatusOK},
+		{"1.1", "HTTP/1.0", http.StatusHTTPVersionNotSupported},
+		{"1.1", "HTTP/1.1", http.StatusOK},
+		{"1.1", "HTTP/2.0", http.StatusOK},
+		{"2.0", "HTTP/1.1", http.StatusHTTPVersionNotSupported},
+		{"2.0", "HTTP/2.0", http.StatusOK},
+	} {
+		s := newTestServer(t, Config{MinHTTPVersion: tt.min}, smallSite)
+		for _, path := range []string{"/", "/healthz"} {
+			r := httptest.NewRequest("GET", path, nil)
+			r.Proto = tt.proto
+			r.ProtoMajor, r.ProtoMinor, _ = http.ParseHTTPVersion(tt.proto)
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, r)
+			if rec.Code != tt.status {
+				t.Errorf("minimum %q, %s %s: got %d, want %d", tt.min, tt.proto, path, rec.Code, tt.status)
+			}
+		}
+	}
+
+	for _, min := range []string{"1", "one", "1.1.1", "HTTP/1.1"} {
+		if _, err := New(Config{Root: writeSite(t, smallSite), MinHTTPVersion: min}); err == nil {
+			t.Errorf("minimum HTTP version %q accepted", min)
+		}
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	page := strings.Repeat("<p>Nothing here, nothing at all.</p>\n", 50)
+	site := map[string]string{"index.html": "home", "404.html": page}
+
+	// the default page, and cache rules not applying to 404s
+	s := newTestServer(t, Config{NotFoundCacheControl: "public, max-age=60", CacheRules: []string{"/*=no-store"}}, site)
+	rec := get(s, "/missing")
+	if rec.Code != http.StatusNotFound || rec.Header().Get("Cache-Control") != "public, max-age=60" {
+		t.Errorf("default page: %d with Cache-Control %q", rec.Code, rec.Header().Get("Cache-Control"))
+	}
+	if rec := get(newTestServer(t, Config{NotFoundMaxAge: 90 * time.Second}, site), "/missing"); rec.Header().Get("Cache-Control") != "public, max-age=90" {
+		t.Errorf("NotFoundMaxAge: Cache-Control %q", rec.Header().Get("Cache-Control"))
+	}
+	if rec := get(newTestServer(t, Config{}, site), "/missing"); rec.Header()["Cache-Control"] != nil {
+		t.Errorf("Cache-Control %q sent unasked", rec.Header()["Cache-Control"])
+	}
+	if _, err := New(Config{Root: writeSite(t, site), NotFoundCacheControl: "no-cache", NotFoundMaxAge: time.Minute}); err == nil {
+		t.Error("NotFoundCacheControl and NotFoundMaxAge accepted together")
+	}
+	if _, err := New(Config{Root: writeSite(t, site), NotFoundCacheControl: "max-age=soon"}); err == nil {
+		t.Error("invalid NotFoundCacheControl accepted")
+	}
+
+	// the custom page
+	s = newTestServer(t, Config{NotFound: "404.html", NotFoundCacheControl: "public, max-age=60"}, site)
+	rec = get(s, "/missing")
+	lastModified := rec.Header().Get("Last-Modified")
+	if rec.Code != http.StatusNotFound || rec.Body.String() != page || lastModified == "" {
+		t.Fatalf("custom page: %d with Last-Modified %q, body %.40q", rec.Code, lastModified, rec.Body)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "public, max-age=60" {
+		t.Errorf("custom page: Cache-Control %q", got)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("custom page: Content-Type %q", got)
+	}
+
+	// conditional requests get the full page, a 304 losing the 404
+	for _, header := range []http.Header{
+		{"If-Modified-Since": {lastModified}},
+		{"If-Modified-Since": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}},
+		{"If-None-Match": {"*"}},
+		{"If-None-Match": {`"anything"`}},
+	} {
+		rec := serveRequest(s, "GET", "/missing", header)
+		if rec.Code != http.StatusNotFound || rec.Body.String() != page {
+			t.Errorf("%v: got %d with a %d bytes body, want 404 with the page", header, rec.Code, rec.Body.Len())
+		}
+	}
+
+	// HEAD gets the headers of GET, for each kind of 404 page
+	tpl := newTestServer(t, Config{NotFound: "404.html"}, map[string]string{"index.html": "home", "404.html": "<!--marb:suggestions-->" + page})
+	for name, s := range map[string]*Server{"default": newTestServer(t, Config{}, site), "custom": s, "with suggestions": tpl} {
+		for _, header := range []http.Header{nil, {"Accept-Encoding": {"gzip"}}, {"Accept": {"application/json"}}} {
+			got := serveRequest(s, "GET", "/indx", header)
+			head := serveRequest(s, "HEAD", "/indx", header)
+			if got.Code != http.StatusNotFound || head.Code != http.StatusNotFound {
+				t.Errorf("%s %v: GET %d, HEAD %d, want 404", name, header, got.Code, head.Code)
+			}
+			if !reflect.DeepEqual(got.Header(), head.Header()) {
+				t.Errorf("%s %v: HEAD headers\n%v\nwant those of GET\n%v", name, header, head.Header(), got.Header())
+			}
+			if head.Body.Len() > 0 {
+				t.Errorf("%s %v: HEAD response has a %d bytes body", name, header, head.Body.Len())
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package marb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// metaSidecarExt marks metadata sidecars, overriding the headers and
+// status of the file they're named after, like report.pdf.marbmeta for
+// report.pdf. They aren't served themselves.
+const metaSidecarExt = ".marbmeta"
+
+// fileMeta is the contents of a metadata sidecar, a JSON object.
+type fileMeta struct {
+	ContentType  string            `json:"contentType"`
+	Headers      map[string]string `json:"headers"`
+	Disposition  string            `json:"disposition"`  // Content-Disposition, like "attachment"
+	CacheControl string            `json:"cacheControl"` // as understood by parseCacheControl
+	Status       int               `json:"status"`
+}
+
+// managedHeaders can't be set in the headers of a metadata sidecar,
+// either because marb sets them from the file, or because the sidecar
+// has a field of its own for them.
+var managedHeaders = map[string]bool{
+	"Cache-Control":       true,
+	"Content-Disposition": true,
+	"Content-Encoding":    true,
+	"Content-Length":      true,
+	"Content-Range":       true,
+	"Content-Type":        true,
+	"Last-Modified":       true,
+	"Transfer-Encoding":   true,
+}
+
+// parseFileMeta parses and checks the metadata sidecar at name.
+func parseFileMeta(name string, contents []byte) (*fileMeta, error) {
+	var meta fileMeta
+	dec := json.NewDecoder(bytes.NewReader(contents))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&meta); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	if meta.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(meta.ContentType); err != nil {
+			return nil, fmt.Errorf("%s: content type %q: %v", name, meta.ContentType, err)
+		}
+	}
+	if meta.Disposition != "" {
+		if _, _, err := mime.ParseMediaType(meta.Disposition); err != nil {
+			return nil, fmt.Errorf("%s: disposition %q: %v", name, meta.Disposition, err)
+		}
+	}
+	if meta.CacheControl != "" {
+		value, err := parseCacheControl(meta.CacheControl)
+		if err != nil {
+			return nil, fmt.Errorf("%s: cache control %q: %v", name, meta.CacheControl, err)
+		}
+		meta.CacheControl = value
+	}
+	headers := make(map[string]string, len(meta.Headers))
+	for key, value := range meta.Headers {
+		canonical := http.CanonicalHeaderKey(key)
+		switch {
+		case !isToken(key):
+			return nil, fmt.Errorf("%s: invalid header name %q", name, key)
+		case managedHeaders[canonical]:
+			return nil, fmt.Errorf("%s: header %s can't be overridden", name, canonical)
+		case strings.ContainsAny(value, "\r\n\x00"):
+			return nil, fmt.Errorf("%s: invalid value for header %s", name, canonical)
+		}
+		headers[canonical] = value
+	}
+	meta.Headers = headers
+	// statuses without a body, or meaning something else than "here is
+	// the file", would make no sense
+	if s := meta.Status; s != 0 && (s < 200 || s > 599 || s == http.StatusNoContent || s == http.StatusPartialContent ||
+		s == http.StatusResetContent || s >= 300 && s < 400) {
+		return nil, fmt.Errorf("%s: status %d can't be used", name, s)
+	}
+	return &meta, nil
+}
+
+// applyFileMetas parses the metadata sidecars of metas, indexed like
+// files, and applies them to their files. A sidecar without a file is
+// only warned about, an invalid one fails the load.
+func applyFileMetas(files []*siteFile, list []*sourceFile, metas [][]byte) ([]string, error) {
+	byName := make(map[string]*siteFile, len(files))
+	for _, f := range files {
+		if f != nil {
+			byName[path.Join(f.dir, f.name)] = f
+		}
+	}
+
+	var warnings []string
+	for i, contents := range metas {
+		if contents == nil {
+			continue
+		}
+		name := list[i].name
+		meta, err := parseFileMeta(name, contents)
+		if err != nil {
+			return nil, err
+		}
+		f := byName[strings.TrimSuffix(name, metaSidecarExt)]
+		if f == nil {
+			warnings = append(warnings, fmt.Sprintf("%s: no %s to apply it to", name, path.Base(strings.TrimSuffix(name, metaSidecarExt))))
+			continue
+		}
+		f.meta = meta
+		if meta.ContentType != "" {
+			f.mimeType, f.sniffed = meta.ContentType, false
+		}
+	}
+	return warnings, nil
+}
+
+// status returns the status f is served with.
+func (f *siteFile) status() int {
+	if f.meta == nil || f.meta.Status == 0 {
+		return http.StatusOK
+	}
+	return f.meta.Status
+}
+
+// setMetaHeaders sets the headers the metadata sidecar of f overrides,
+// Cache-Control aside.
+func (f *siteFile) setMetaHeaders(h http.Header) {
+	if f.meta == nil {
+		return
+	}
+	if f.meta.Disposition != "" {
+		h.Set("Content-Disposition", f.meta.Disposition)
+	}
+	for key, value := range f.meta.Headers {
+		h.Set(key, value)
+	}
+}
@@ -0,0 +1,36 @@
+package marb
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMetaStatusCacheControl(t *testing.T) {
+	s := newTestServer(t, Config{CacheControl: "public, max-age=3600", NotFoundMaxAge: time.Minute}, map[string]string{
+		"index.html":                "home",
+		"gone.html":                 "gone",
+		"gone.html.marbmeta":        `{"status": 410}`,
+		"private.html":              "gone too",
+		"private.html.marbmeta":     `{"status": 410, "cacheControl": "no-store"}`,
+		"unavailable.html":          "later",
+		"unavailable.html.marbmeta": `{"status": 503}`,
+	})
+
+	for _, tt := range []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/", http.StatusOK, "public, max-age=3600"},
+		{"/gone.html", http.StatusGone, "public, max-age=60"},
+		{"/private.html", http.StatusGone, "no-store"},
+		{"/unavailable.html", http.StatusServiceUnavailable, "public, max-age=60"},
+		{"/missing.html", http.StatusNotFound, "public, max-age=60"},
+	} {
+		rec := get(s, tt.path)
+		if rec.Code != tt.status || rec.Header().Get("Cache-Control") != tt.want {
+			t.Errorf("%s: got %d with Cache-Control %q, want %d with %q", tt.path, rec.Code, rec.Header().Get("Cache-Control"), tt.status, tt.want)
+		}
+	}
+}
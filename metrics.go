@@ -0,0 +1,146 @@
+package marb
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// metrics counts what the server did since it started, for the admin
+// API to expose in the Prometheus text format.
+type metrics struct {
+	responses      [6]int64 // by status class, 1xx to 5xx
+	responseBytes  int64
+	reloads        int64
+	reloadFailures int64
+}
+
+func (m *metrics) countResponse(status int, bytes int64) {
+	if class := status / 100; class >= 1 && class <= 5 {
+		atomic.AddInt64(&m.responses[class], 1)
+	}
+	atomic.AddInt64(&m.responseBytes, bytes)
+}
+
+func (m *metrics) countReload(err error) {
+	if err != nil {
+		atomic.AddInt64(&m.reloadFailures, 1)
+	} else {
+		atomic.AddInt64(&m.reloads, 1)
+	}
+}
+
+// countingWriter records the status and body size of a response, and
+// when its headers were written, and for the access log, its result as
+// set by setResult and its pacing as set by setThrottled.
+type countingWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader time.Time
+	result      string
+	throttle    string // rate it was paced to, if throttled
+	paced       time.Duration
+}
+
+func (c *countingWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+		c.wroteHeader = time.Now()
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+		c.wroteHeader = time.Now()
+	}
+	n, err := c.ResponseWriter.Write(p)
+	c.bytes += int64(n)
+	return n, err
+}
+
+func (c *countingWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *countingWriter) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.ResponseWriter.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return http.ErrNotSupported
+}
+
+// labelEscaper escapes label values in the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// serveMetrics exposes the metrics on the admin API. The exposition is
+// gzipped for scrapers accepting it, whatever its size, as long as that
+// makes it smaller.
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		adminError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var b strings.Builder
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("marb_responses_total", "counter", "Responses sent, by status class.")
+	for class := 1; class <= 5; class++ {
+		fmt.Fprintf(&b, "marb_responses_total{code=\"%dxx\"} %d\n", class, atomic.LoadInt64(&s.metrics.responses[class]))
+	}
+	metric("marb_response_bytes_total", "counter", "Response body bytes sent.")
+	fmt.Fprintf(&b, "marb_response_bytes_total %d\n", atomic.LoadInt64(&s.metrics.responseBytes))
+
+	metric("marb_reloads_total", "counter", "Reloads, by result.")
+	fmt.Fprintf(&b, "marb_reloads_total{result=\"success\"} %d\n", atomic.LoadInt64(&s.metrics.reloads))
+	fmt.Fprintf(&b, "marb_reloads_total{result=\"failure\"} %d\n", atomic.LoadInt64(&s.metrics.reloadFailures))
+
+	var files, bytes int64
+	for _, f := range s.current().paths() {
+		files++
+		bytes += f.residentSize()
+	}
+	metric("marb_files", "gauge", "Files served.")
+	fmt.Fprintf(&b, "marb_files %d\n", files)
+	metric("marb_memory_bytes", "gauge", "Memory taken by the files, compressed versions included.")
+	fmt.Fprintf(&b, "marb_memory_bytes %d\n", bytes)
+
+	draining := 0
+	if s.Draining() {
+		draining = 1
+	}
+	metric("marb_draining", "gauge", "Whether the server is drained.")
+	fmt.Fprintf(&b, "marb_draining %d\n", draining)
+
+	if s.concurrency != nil {
+		metric("marb_concurrency_limit", "gauge", "Most requests served at once for the paths of a -limit-concurrency pattern.")
+		for _, rule := range s.concurrency.rules {
+			fmt.Fprintf(&b, "marb_concurrency_limit{pattern=\"%s\"} %d\n", labelEscaper.Replace(rule.pattern), cap(rule.slots))
+		}
+		metric("marb_concurrency_in_flight", "gauge", "Requests being served for the paths of a -limit-concurrency pattern.")
+		for _, rule := range s.concurrency.rules {
+			fmt.Fprintf(&b, "marb_concurrency_in_flight{pattern=\"%s\"} %d\n", labelEscaper.Replace(rule.pattern), len(rule.slots))
+		}
+		metric("marb_concurrency_rejected_total", "counter", "Requests answered 503 for being over the limit of a -limit-concurrency pattern.")
+		for _, rule := range s.concurrency.rules {
+			fmt.Fprintf(&b, "marb_concurrency_rejected_total{pattern=\"%s\"} %d\n", labelEscaper.Replace(rule.pattern), atomic.LoadInt64(&rule.rejected))
+		}
+	}
+
+	if s.statsd != nil {
+		metric("marb_statsd_dropped_total", "counter", "StatsD metrics dropped, the queue being full or the agent unreachable.")
+		fmt.Fprintf(&b, "marb_statsd_dropped_total %d\n", atomic.LoadInt64(&s.statsd.dropped))
+	}
+
+	writeCompressed(w, r, http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()), 0)
+}
@@ -0,0 +1,47 @@
+package marb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	s := newTestServer(t, Config{}, smallSite)
+	get(s, "/")
+	get(s, "/missing")
+	get(s, "/missing")
+
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got %d, want 200", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding %q, want gzip", got)
+	}
+	body, err := decompressContents(rec.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE marb_responses_total counter\n",
+		"marb_responses_total{code=\"2xx\"} 1\n",
+		"marb_responses_total{code=\"4xx\"} 2\n",
+		"marb_reloads_total{result=\"success\"} 1\n",
+		"marb_draining 0\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+
+	// scrapers not asking for gzip get the text as is
+	rec = get(s.AdminHandler(), "/metrics")
+	if rec.Header().Get("Content-Encoding") != "" || !strings.HasPrefix(rec.Body.String(), "# HELP") {
+		t.Errorf("uncompressed scrape: Content-Encoding %q, body %.40q", rec.Header().Get("Content-Encoding"), rec.Body)
+	}
+}
@@ -0,0 +1,80 @@
+package marb
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	nelGroup         = "network-errors"
+	defaultNELMaxAge = 24 * time.Hour
+)
+
+// networkErrorLogging holds the Report-To and NEL headers asking
+// browsers to report failures to reach the site, as described in
+// https://www.w3.org/TR/network-error-logging/.
+type networkErrorLogging struct {
+	reportTo string
+	nel      string
+}
+
+func newNetworkErrorLogging(cfg Config) (*networkErrorLogging, error) {
+	u, err := url.Parse(cfg.NELReportURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return nil, errors.New("the NEL report URL must be an absolute https URL")
+	}
+
+	maxAge := cfg.NELMaxAge
+	if maxAge <= 0 {
+		maxAge = defaultNELMaxAge
+	}
+	failure := cfg.NELFailureFraction
+	if failure == 0 {
+		failure = 1
+	}
+	if failure < 0 || failure > 1 || cfg.NELSuccessFraction < 0 || cfg.NELSuccessFraction > 1 {
+		return nil, errors.New("NEL sampling fractions must be between 0 and 1")
+	}
+
+	type endpoint struct {
+		URL string `json:"url"`
+	}
+	reportTo, _ := json.Marshal(struct {
+		Group             string     `json:"group"`
+		MaxAge            int64      `json:"max_age"`
+		Endpoints         []endpoint `json:"endpoints"`
+		IncludeSubdomains bool       `json:"include_subdomains,omitempty"`
+	}{nelGroup, int64(maxAge / time.Second), []endpoint{{u.String()}}, cfg.NELIncludeSubdomains})
+
+	nel, _ := json.Marshal(struct {
+		ReportTo          string  `json:"report_to"`
+		MaxAge            int64   `json:"max_age"`
+		IncludeSubdomains bool    `json:"include_subdomains,omitempty"`
+		SuccessFraction   float64 `json:"success_fraction"`
+		FailureFraction   float64 `json:"failure_fraction"`
+	}{nelGroup, int64(maxAge / time.Second), cfg.NELIncludeSubdomains, cfg.NELSuccessFraction, failure})
+
+	return &networkErrorLogging{reportTo: string(reportTo), nel: string(nel)}, nil
+}
+
+// isHTTPS reports whether r reached us, or the proxy in front of us,
+// over HTTPS.
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// setReportingHeaders sets the NEL headers when configured. Browsers
+// ignore NEL policies received over plain HTTP, so they're only sent
+// over HTTPS.
+func (s *Server) setReportingHeaders(h http.Header, r *http.Request) {
+	if s.nel != nil && isHTTPS(r) {
+		h.Set("Report-To", s.nel.reportTo)
+		h.Set("NEL", s.nel.nel)
+	}
+}
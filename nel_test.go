@@ -0,0 +1,43 @@
+package marb
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNetworkErrorLogging(t *testing.T) {
+	s := newTestServer(t, Config{NELReportURL: "https://reports.example.com/nel", NELMaxAge: time.Hour, NELSuccessFraction: 0.01}, map[string]string{"index.html": "home"})
+
+	for _, proto := range []string{"https", "http"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Forwarded-Proto", proto)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, r)
+
+		reportTo, nel := rec.Header().Get("Report-To"), rec.Header().Get("NEL")
+		if proto == "http" {
+			if reportTo != "" || nel != "" {
+				t.Errorf("over plain HTTP: Report-To %q and NEL %q sent", reportTo, nel)
+			}
+			continue
+		}
+		if want := `{"group":"network-errors","max_age":3600,"endpoints":[{"url":"https://reports.example.com/nel"}]}`; reportTo != want {
+			t.Errorf("Report-To %q, want %q", reportTo, want)
+		}
+		if want := `{"report_to":"network-errors","max_age":3600,"success_fraction":0.01,"failure_fraction":1}`; nel != want {
+			t.Errorf("NEL %q, want %q", nel, want)
+		}
+	}
+
+	for _, cfg := range []Config{
+		{NELReportURL: "http://reports.example.com/nel"},
+		{NELReportURL: "/nel"},
+		{NELReportURL: "https://reports.example.com/nel", NELFailureFraction: 1.5},
+		{NELReportURL: "https://reports.example.com/nel", NELSuccessFraction: -0.1},
+	} {
+		if _, err := newNetworkErrorLogging(cfg); err == nil {
+			t.Errorf("report URL %q with fractions %v and %v accepted", cfg.NELReportURL, cfg.NELSuccessFraction, cfg.NELFailureFraction)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package marb
+
+import (
+	"path"
+	"strings"
+)
+
+// pathPatterns is a list of glob patterns, as understood by path.Match,
+// that can be set from a comma separated flag. Patterns without a
+// leading slash are taken relative to the root.
+//
+// A pattern matches a path when it matches the path itself or one of
+// its parent directories, so "/downloads/*" covers everything below
+// /downloads. Per-path rules built on them all pick among the patterns
+// matching a path the same way, as described by mostSpecific.
+type pathPatterns []string
+
+func (p *pathPatterns) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *pathPatterns) Set(value string) error {
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		pattern = normalizePattern(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return err
+		}
+		*p = append(*p, pattern)
+	}
+	return nil
+}
+
+func normalizePattern(pattern string) string {
+	if !strings.HasPrefix(pattern, "/") {
+		pattern = "/" + pattern
+	}
+	return pattern
+}
+
+// matchPattern reports whether pattern matches p or one of its parents.
+func matchPattern(pattern string, p string) bool {
+	for p = path.Clean("/" + p); ; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+		if p == "/" {
+			return false
+		}
+	}
+}
+
+func (p pathPatterns) match(urlPath string) bool {
+	for _, pattern := range p {
+		if matchPattern(pattern, urlPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// specificity returns the number of literal characters of pattern,
+// which wildcards and character classes don't count as.
+func specificity(pattern string) int {
+	n := 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?':
+		case '[':
+			for i++; i < len(pattern) && pattern[i] != ']'; i++ {
+				if pattern[i] == '\\' {
+					i++
+				}
+			}
+		case '\\':
+			i++
+			n++
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+// mostSpecific returns the index of the one of n patterns, as returned
+// by pattern, that applies to urlPath, or -1 if none matches it: the
+// one with the most literal characters, so that "/docs" beats "/*/*/*"
+// and "/docs/*.pdf" beats "/docs/*", and among those the first given.
+func mostSpecific(n int, pattern func(i int) string, urlPath string) int {
+	best, bestSpecificity := -1, -1
+	for i := 0; i < n; i++ {
+		p := pattern(i)
+		if sp := specificity(p); sp > bestSpecificity && matchPattern(p, urlPath) {
+			best, bestSpecificity = i, sp
+		}
+	}
+	return best
+}
@@ -0,0 +1,183 @@
+package marb
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFallbackTimeout     = 30 * time.Second
+	defaultFallbackMaxFailures = 5
+	defaultFallbackCooldown    = 30 * time.Second
+	defaultStreamBufferSize    = 32 << 10
+)
+
+// fallbackProxy forwards requests for paths missing from the site to
+// another origin, typically the one a site is being migrated away from.
+//
+// After maxFailures consecutive failures, the origin is considered down
+// and requests get the local 404 until cooldown elapses, after which a
+// single request is let through to probe it.
+type fallbackProxy struct {
+	proxy       *httputil.ReverseProxy
+	headers     map[string]bool // forwarded request headers, all if nil
+	exclude     pathPatterns
+	maxFailures int
+	cooldown    time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newFallbackProxy(cfg Config, notFound func(w http.ResponseWriter, r *http.Request)) (*fallbackProxy, error) {
+	target, err := url.Parse(cfg.FallbackProxy)
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("fallback proxy %q: not an absolute URL", cfg.FallbackProxy)
+	}
+
+	fp := &fallbackProxy{
+		maxFailures: cfg.FallbackMaxFailures,
+		cooldown:    cfg.FallbackCooldown,
+	}
+	if fp.maxFailures <= 0 {
+		fp.maxFailures = defaultFallbackMaxFailures
+	}
+	if fp.cooldown <= 0 {
+		fp.cooldown = defaultFallbackCooldown
+	}
+	timeout := cfg.FallbackTimeout
+	if timeout <= 0 {
+		timeout = defaultFallbackTimeout
+	}
+	bufferSize := cfg.StreamBufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultStreamBufferSize
+	}
+
+	for _, pattern := range cfg.FallbackExclude {
+		if err := fp.exclude.Set(pattern); err != nil {
+			return nil, fmt.Errorf("fallback exclude pattern %q: %v", pattern, err)
+		}
+	}
+	if len(cfg.FallbackHeaders) > 0 {
+		// bodies are forwarded along with what describes them
+		fp.headers = map[string]bool{"Content-Type": true, "Content-Length": true}
+		for _, h := range cfg.FallbackHeaders {
+			fp.headers[http.CanonicalHeaderKey(h)] = true
+		}
+	}
+
+	director := httputil.NewSingleHostReverseProxy(target).Director
+	fp.proxy = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			if fp.headers != nil {
+				for name := range r.Header {
+					if !fp.headers[name] {
+						r.Header.Del(name)
+					}
+				}
+			}
+			r.Header.Set("X-Forwarded-Host", r.Host)
+			director(r)
+			r.Host = target.Host
+		},
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: timeout}).DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+			MaxIdleConnsPerHost:   16,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		BufferPool: newBufferPool(bufferSize),
+		ModifyResponse: func(resp *http.Response) error {
+			fp.record(resp.StatusCode < 500)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("fallback proxy: %s %s: %v", r.Method, r.URL.Path, err)
+			fp.record(false)
+			notFound(w, r)
+		},
+	}
+
+	return fp, nil
+}
+
+// bufferPool recycles the buffers the proxy copies response bodies
+// through, all of one size. Large ones suit large media coming from the
+// origin, at the cost of memory per response in flight.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{pool: sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, size)
+			return &b
+		},
+	}}
+}
+
+func (p *bufferPool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+func (p *bufferPool) Put(b []byte) {
+	p.pool.Put(&b)
+}
+
+// allow reports whether the request should be proxied, taking
+// exclusions and the state of the origin into account.
+func (fp *fallbackProxy) allow(r *http.Request) bool {
+	if fp.exclude.match(r.URL.Path) {
+		return false
+	}
+
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	if fp.failures < fp.maxFailures {
+		return true
+	}
+	if time.Now().Before(fp.openUntil) || fp.probing {
+		return false
+	}
+	fp.probing = true
+	return true
+}
+
+func (fp *fallbackProxy) record(ok bool) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+
+	fp.probing = false
+	if ok {
+		if fp.failures >= fp.maxFailures {
+			log.Printf("fallback proxy: origin is back")
+		}
+		fp.failures = 0
+		return
+	}
+
+	fp.failures++
+	if fp.failures >= fp.maxFailures {
+		if fp.failures == fp.maxFailures {
+			log.Printf("fallback proxy: origin looks down after %d failures, serving local 404s", fp.failures)
+		}
+		fp.openUntil = time.Now().Add(fp.cooldown)
+	}
+}
+
+func (fp *fallbackProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fp.proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,47 @@
+package marb
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newMediaOrigin returns an origin serving body at any path.
+func newMediaOrigin(t testing.TB, body []byte) *httptest.Server {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Write(body)
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+func TestFallbackProxyStreamBufferSize(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	origin := newMediaOrigin(t, body)
+
+	for _, size := range []int{512, 1 << 20} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			s := newTestServer(t, Config{FallbackProxy: origin.URL, StreamBufferSize: size}, map[string]string{"index.html": "home"})
+			rec := get(s, "/media/clip.mp4")
+			if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), body) {
+				t.Errorf("got %d with %d bytes, want 200 with the %d bytes of the origin", rec.Code, rec.Body.Len(), len(body))
+			}
+		})
+	}
+}
+
+func BenchmarkFallbackProxyStreamBufferSize(b *testing.B) {
+	body := bytes.Repeat([]byte{'x'}, 8<<20)
+	origin := newMediaOrigin(b, body)
+
+	for _, size := range []int{4 << 10, 32 << 10, 256 << 10, 1 << 20} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			s := newTestServer(b, Config{LogLevel: "error", FallbackProxy: origin.URL, StreamBufferSize: size}, map[string]string{"index.html": "home"})
+			benchmarkServe(b, s, "/media/clip.mp4")
+			b.SetBytes(int64(len(body)))
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package marb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPurgeBatch = 30
+
+	purgeAttempts  = 5
+	purgeRetryBase = time.Second
+)
+
+// purgeStatus tells how purging the CDN went.
+type purgeStatus struct {
+	Purged        int        `json:"purged"` // URLs purged since startup
+	Pending       int        `json:"pending"`
+	LastSuccess   *time.Time `json:"lastSuccess,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// purger asks a CDN to drop the URLs a reload touched. It works in the
+// background, so neither serving nor subsequent reloads ever wait for
+// it; URLs queued while it's busy are merged into its next round.
+//
+// Two API styles are supported: "cloudflare" POSTs batches of URLs as
+// {"files": [...]} to the purge URL with a bearer token, and "fastly"
+// POSTs to the purge URL followed by each URL, without its scheme,
+// with the token in a Fastly-Key header.
+type purger struct {
+	apiURL  string
+	token   string
+	style   string
+	baseURL string
+	batch   int
+	client  *http.Client
+
+	mu      sync.Mutex
+	pending map[string]bool
+	status  purgeStatus
+	wake    chan struct{}
+}
+
+func newPurger(cfg Config) (*purger, error) {
+	p := &purger{
+		apiURL:  cfg.PurgeURL,
+		token:   cfg.PurgeToken,
+		style:   cfg.PurgeStyle,
+		baseURL: strings.TrimSuffix(cfg.PurgeBaseURL, "/"),
+		batch:   cfg.PurgeBatch,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		pending: make(map[string]bool),
+		wake:    make(chan struct{}, 1),
+	}
+
+	if p.style == "" {
+		p.style = "cloudflare"
+	}
+	if p.style != "cloudflare" && p.style != "fastly" {
+		return nil, fmt.Errorf("unknown purge style %q", p.style)
+	}
+	if p.baseURL == "" {
+		return nil, fmt.Errorf("a public base URL is required to purge the CDN")
+	}
+	if p.batch <= 0 {
+		p.batch = defaultPurgeBatch
+	}
+	return p, nil
+}
+
+// purgePaths returns the URL paths affected by diff: the paths
+// themselves, and the directories of index files.
+func purgePaths(prev *siteSnapshot, next *siteSnapshot, diff *reloadDiff) []string {
+	seen := make(map[string]bool)
+	var paths []string
+	add := func(p string) {
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+
+	for _, list := range [][]string{diff.Added, diff.Changed, diff.Removed} {
+		for _, p := range list {
+			add(p)
+			if f := prev.files[p]; f != nil && f.isIndex {
+				add(strings.TrimSuffix(path.Dir(p), "/") + "/")
+			}
+			if f := next.files[p]; f != nil && f.isIndex {
+				add(strings.TrimSuffix(path.Dir(p), "/") + "/")
+			}
+		}
+	}
+	return paths
+}
+
+func (p *purger) enqueue(paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	for _, u := range paths {
+		p.pending[p.baseURL+u] = true
+	}
+	p.status.Pending = len(p.pending)
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *purger) run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-p.wake:
+		case <-stop:
+			return
+		}
+
+		p.mu.Lock()
+		urls := make([]string, 0, len(p.pending))
+		for u := range p.pending {
+			urls = append(urls, u)
+		}
+		p.pending = make(map[string]bool)
+		p.mu.Unlock()
+		sort.Strings(urls)
+
+		for len(urls) > 0 {
+			n := p.batch
+			if n > len(urls) {
+				n = len(urls)
+			}
+			p.purgeBatch(urls[:n], stop)
+			urls = urls[n:]
+		}
+
+		p.mu.Lock()
+		p.status.Pending = len(p.pending)
+		p.mu.Unlock()
+	}
+}
+
+// purgeBatch purges urls, retrying with a backoff a bounded number of
+// times before giving up on them.
+func (p *purger) purgeBatch(urls []string, stop <-chan struct{}) {
+	delay := purgeRetryBase
+	for attempt := 1; ; attempt++ {
+		err := p.send(urls)
+		now := time.Now()
+
+		p.mu.Lock()
+		if err == nil {
+			p.status.Purged += len(urls)
+			p.status.LastSuccess = &now
+		} else {
+			p.status.LastError, p.status.LastErrorTime = err.Error(), &now
+		}
+		p.mu.Unlock()
+
+		if err == nil {
+			log.Printf("purge: purged %d URLs", len(urls))
+			return
+		}
+		if attempt == purgeAttempts {
+			log.Printf("purge: giving up on %d URLs: %v", len(urls), err)
+			return
+		}
+
+		log.Printf("purge: %v, retrying in %v", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return
+		}
+		delay *= 2
+	}
+}
+
+func (p *purger) send(urls []string) error {
+	if p.style == "fastly" {
+		for _, u := range urls {
+			req, err := http.NewRequest(http.MethodPost, p.apiURL+strings.TrimPrefix(strings.TrimPrefix(u, "https://"), "http://"), nil)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Fastly-Key", p.token)
+			if _, _, err := doRequest(p.client, req); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	body, _ := json.Marshal(map[string][]string{"files": urls})
+	req, err := http.NewRequest(http.MethodPost, p.apiURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	_, _, err = doRequest(p.client, req)
+	return err
+}
+
+func (p *purger) currentStatus() purgeStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
@@ -0,0 +1,67 @@
+package marb
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+// RegisterBytes serves data at p, a rooted path like /config.json, with
+// the given content type, or a sniffed one if empty. The response is
+// compressed and cached like a file of the site, overriding any at p,
+// and keeps being served across reloads; registering p again replaces
+// it. It's served at once, but only shows in listings, routes and the
+// search index from the next reload on.
+//
+// RegisterBytes panics if p isn't a clean rooted path to a file.
+func (s *Server) RegisterBytes(p string, contentType string, data []byte) {
+	if p == "/" || path.Clean(p) != p || !path.IsAbs(p) {
+		panic(fmt.Sprintf("marb: RegisterBytes: invalid path %q", p))
+	}
+
+	f := newSiteFile(p, data, contentType, s.DefaultMIME, s.Compact, s.Brotli)
+	f.lastModified = time.Now()
+	if s.SRI {
+		f.sri = sriDigest(data)
+	}
+	f.checksums = s.checksums(p, data)
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	if s.registered == nil {
+		s.registered = make(map[string]*siteFile)
+	}
+	s.registered[p] = f
+
+	snap, _ := s.snapshot.Load().(*siteSnapshot)
+	if snap == nil || snap.loading {
+		return
+	}
+	// snapshots being served aren't modified, a copy is swapped in
+	next := *snap
+	next.files = make(map[string]*siteFile, len(snap.files)+1)
+	for key, old := range snap.files {
+		next.files[key] = old
+	}
+	added := *f
+	s.addFile(&next, &added, nil)
+	if s.Shared != nil {
+		old := snap.files[p]
+		if old != nil && path.Join(old.dir, old.name) != p {
+			old = nil // an index keyed by its directory, still held
+		}
+		s.Shared.replace(old, &added)
+	}
+	next.count = len(next.paths())
+	s.snapshot.Store(&next)
+}
+
+// addRegistered adds the responses registered with RegisterBytes to
+// snap, in place of the files at their paths.
+func (s *Server) addRegistered(snap *siteSnapshot) {
+	for _, f := range s.registered {
+		added := *f
+		s.addFile(snap, &added, nil)
+	}
+}
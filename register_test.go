@@ -0,0 +1,63 @@
+package marb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegisterBytes(t *testing.T) {
+	captureLog(t)
+	s := newTestServer(t, Config{}, map[string]string{"index.html": "home", "config.json": `{"from":"file"}`})
+
+	s.RegisterBytes("/config.json", "application/json", []byte(`{"from":"memory"}`))
+	s.RegisterBytes("/version.txt", "", []byte("1.2.3"))
+	check := func(when string) {
+		t.Helper()
+		rec := get(s, "/config.json")
+		if rec.Body.String() != `{"from":"memory"}` || rec.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: /config.json got %q as %s", when, rec.Body, rec.Header().Get("Content-Type"))
+		}
+		rec = get(s, "/version.txt")
+		if rec.Body.String() != "1.2.3" || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+			t.Errorf("%s: /version.txt got %d %q as %s", when, rec.Code, rec.Body, rec.Header().Get("Content-Type"))
+		}
+		if rec := get(s, "/"); rec.Body.String() != "home" {
+			t.Errorf("%s: / got %q", when, rec.Body)
+		}
+	}
+	check("registered")
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	check("reloaded")
+
+	// registered responses are compressed like files
+	data := strings.Repeat(`{"key": "value"}, `, 100)
+	s.RegisterBytes("/config.json", "application/json", []byte(data))
+	r := httptest.NewRequest("GET", "/config.json", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("replaced: Content-Encoding %q, want gzip", rec.Header().Get("Content-Encoding"))
+	}
+	if body, err := decompressContents(rec.Body.Bytes()); err != nil || string(body) != data {
+		t.Errorf("replaced: got %.40q, %v", body, err)
+	}
+
+	for _, p := range []string{"", "/", "config.json", "/a/../b", "/dir/"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%q: no panic", p)
+				}
+			}()
+			s.RegisterBytes(p, "", nil)
+		}()
+	}
+	if rec := get(s, "/"); rec.Code != http.StatusOK {
+		t.Errorf("after invalid registrations: / got %d", rec.Code)
+	}
+}
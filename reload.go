@@ -0,0 +1,314 @@
+package marb
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reloadDiff lists the paths, relative to the root, that a reload
+// added, changed or removed.
+type reloadDiff struct {
+	Added   []string `json:"added"`
+	Changed []string `json:"changed"`
+	Removed []string `json:"removed"`
+}
+
+func (d *reloadDiff) String() string {
+	return fmt.Sprintf("%d added, %d changed, %d removed", len(d.Added), len(d.Changed), len(d.Removed))
+}
+
+func (d *reloadDiff) size() int {
+	return len(d.Added) + len(d.Changed) + len(d.Removed)
+}
+
+// paths returns the files of the snapshot, leaving out directory
+// aliases of index files.
+func (snap *siteSnapshot) paths() map[string]*siteFile {
+	paths := make(map[string]*siteFile, len(snap.files))
+	for key, f := range snap.files {
+		if key == path.Join(f.dir, f.name) {
+			paths[key] = f
+		}
+	}
+	return paths
+}
+
+func sameFile(a *siteFile, b *siteFile) bool {
+	return a.mimeType == b.mimeType &&
+		bytes.Equal(a.contents, b.contents) &&
+		bytes.Equal(a.gzContents, b.gzContents) &&
+		bytes.Equal(a.brContents, b.brContents) &&
+		reflect.DeepEqual(a.meta, b.meta)
+}
+
+func diffSnapshots(prev *siteSnapshot, next *siteSnapshot) *reloadDiff {
+	d := &reloadDiff{Added: []string{}, Changed: []string{}, Removed: []string{}}
+	prevPaths := map[string]*siteFile{}
+	if prev != nil {
+		prevPaths = prev.paths()
+	}
+	nextPaths := next.paths()
+
+	for p, f := range nextPaths {
+		if old, ok := prevPaths[p]; !ok {
+			d.Added = append(d.Added, p)
+		} else if !sameFile(old, f) {
+			d.Changed = append(d.Changed, p)
+		}
+	}
+	for p := range prevPaths {
+		if _, ok := nextPaths[p]; !ok {
+			d.Removed = append(d.Removed, p)
+		}
+	}
+
+	sort.Strings(d.Added)
+	sort.Strings(d.Changed)
+	sort.Strings(d.Removed)
+	return d
+}
+
+// reloadStatus tells how the last reloads went, whatever triggered them.
+type reloadStatus struct {
+	LastSuccess   time.Time  `json:"lastSuccess"`
+	LastTrigger   string     `json:"lastTrigger"`
+	Generation    uint64     `json:"generation"`  // of the files served, sent as X-Deploy-Id with DeployIDHeader
+	LastChanged   int        `json:"lastChanged"` // paths added, changed or removed
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// Defaults of the reload history kept for the admin API.
+const (
+	defaultReloadHistory     = 20
+	defaultReloadReportPaths = 100
+)
+
+// reloadReport is a past reload, kept for the admin API. Its lists of
+// paths are truncated to ReloadReportPaths each, the summary telling
+// how many there were.
+type reloadReport struct {
+	Time      time.Time   `json:"time"`
+	Trigger   string      `json:"trigger"`
+	Source    string      `json:"source"`
+	Duration  string      `json:"duration"`
+	Error     string      `json:"error,omitempty"`
+	Summary   string      `json:"summary,omitempty"`
+	Diff      *reloadDiff `json:"diff,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// record adds a report of a reload to the history, dropping the oldest
+// ones past ReloadHistory. diff is nil when the reload failed.
+// statusMu must be held.
+func (s *Server) record(trigger, from string, start time.Time, diff *reloadDiff, err error) {
+	s.metrics.countReload(err)
+
+	report := reloadReport{Time: start, Trigger: trigger, Source: from, Duration: time.Since(start).String()}
+	if err != nil {
+		report.Error = err.Error()
+	} else {
+		truncate := func(paths []string) []string {
+			if len(paths) > s.ReloadReportPaths {
+				report.Truncated = true
+				return paths[:s.ReloadReportPaths]
+			}
+			return paths
+		}
+		report.Summary = diff.String()
+		report.Diff = &reloadDiff{Added: truncate(diff.Added), Changed: truncate(diff.Changed), Removed: truncate(diff.Removed)}
+	}
+
+	s.reloads = append(s.reloads, report)
+	if len(s.reloads) > s.ReloadHistory {
+		s.reloads = append([]reloadReport(nil), s.reloads[len(s.reloads)-s.ReloadHistory:]...)
+	}
+}
+
+// reloadReports returns the reload history, newest first.
+func (s *Server) reloadReports() []reloadReport {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	reports := make([]reloadReport, len(s.reloads))
+	for i, report := range s.reloads {
+		reports[len(reports)-1-i] = report
+	}
+	return reports
+}
+
+// ReloadStats describes a successful reload, for Config.OnReload.
+type ReloadStats struct {
+	Trigger    string        // what asked for it: startup, manual, webhook, sync, watch or deploy, joined by + when several shared it
+	Generation uint64        // of the files now served, counting successful reloads from 1
+	Files      int           // number of files now served
+	Bytes      int64         // memory they take, compressed versions included
+	Changed    int           // paths added, changed or removed
+	Duration   time.Duration // time taken to load the files
+}
+
+// reloadRun is a reload of the current source, shared by the triggers
+// asking for one before it starts.
+type reloadRun struct {
+	triggers []string
+	done     chan struct{} // closed once it ran, OnReload included
+	diff     *reloadDiff
+	err      error
+}
+
+// reload re-reads the site and swaps it in atomically. On failure the
+// previous snapshot keeps being served. trigger tells what asked for
+// it, for logging.
+//
+// Triggers firing together, like a webhook racing the watcher over the
+// same rsync, share one reload rather than walking the root once each:
+// the first one to ask waits ReloadDebounce for others to join, then
+// for any reload in progress to finish, and runs it for all of them,
+// the others only waiting for the outcome. A trigger firing while a
+// reload runs thus always gets a reload of its own, started after it.
+func (s *Server) reload(trigger string) (*reloadDiff, error) {
+	s.pendingMu.Lock()
+	run := s.pending
+	leader := run == nil
+	if leader {
+		run = &reloadRun{done: make(chan struct{})}
+		s.pending = run
+	}
+	if !slices.Contains(run.triggers, trigger) {
+		run.triggers = append(run.triggers, trigger)
+	}
+	s.pendingMu.Unlock()
+
+	if !leader {
+		<-run.done
+		return run.diff, run.err
+	}
+
+	if s.ReloadDebounce > 0 && trigger != "startup" {
+		time.Sleep(s.ReloadDebounce)
+	}
+	s.reloadMu.Lock()
+	s.pendingMu.Lock()
+	s.pending = nil // later triggers need a reload of their own
+	s.pendingMu.Unlock()
+	diff, stats, err := s.swapHeld(strings.Join(run.triggers, "+"), "", nil, nil)
+	s.reloadMu.Unlock()
+
+	if err == nil && s.OnReload != nil {
+		s.OnReload(stats)
+	}
+	run.diff, run.err = diff, err
+	close(run.done)
+	return diff, err
+}
+
+// swap loads the files of src and, if validate accepts them, swaps them
+// in atomically, src becoming the source of later reloads. from names
+// src in logs. A nil src stands for the current source.
+//
+// OnReload is called once the new files are served, and the locks
+// released so that it may trigger another reload.
+func (s *Server) swap(trigger string, from string, src source, validate func(*siteSnapshot) error) (*reloadDiff, error) {
+	diff, stats, err := s.swapLocked(trigger, from, src, validate)
+	if err == nil && s.OnReload != nil {
+		s.OnReload(stats)
+	}
+	return diff, err
+}
+
+func (s *Server) swapLocked(trigger string, from string, src source, validate func(*siteSnapshot) error) (*reloadDiff, ReloadStats, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	return s.swapHeld(trigger, from, src, validate)
+}
+
+// swapHeld is swapLocked with reloadMu held.
+func (s *Server) swapHeld(trigger string, from string, src source, validate func(*siteSnapshot) error) (*reloadDiff, ReloadStats, error) {
+	if src == nil {
+		src, from = s.source, s.sourceName
+	}
+
+	start := time.Now()
+	prev, _ := s.snapshot.Load().(*siteSnapshot)
+	if prev != nil && prev.loading {
+		prev = nil
+	}
+	snap, err := s.loadFiles(src, prev)
+	if err == nil && validate != nil {
+		err = validate(snap)
+	}
+
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	if err != nil {
+		log.Printf("%s reload failed, keeping previous files: %v", trigger, err)
+		now := time.Now()
+		s.status.LastError, s.status.LastErrorTime = err.Error(), &now
+		s.record(trigger, from, start, nil, err)
+		return nil, ReloadStats{}, err
+	}
+
+	s.status.Generation++
+	snap.generation = s.status.Generation
+	snap.deployID = []string{strconv.FormatUint(snap.generation, 10)}
+	if s.Shared != nil {
+		s.Shared.hold(snap)
+	}
+	s.snapshot.Store(snap)
+	if s.Shared != nil && prev != nil {
+		s.Shared.release(prev)
+	}
+	s.source, s.sourceName = src, from
+	diff := diffSnapshots(prev, snap)
+	log.Printf("%s reload of %s: %s", trigger, from, diff)
+
+	s.status.LastSuccess, s.status.LastTrigger, s.status.LastChanged = time.Now(), trigger, diff.size()
+	s.record(trigger, from, start, diff, nil)
+	if s.purger != nil && prev != nil {
+		s.purger.enqueue(purgePaths(prev, snap, diff))
+	}
+
+	stats := ReloadStats{Trigger: trigger, Generation: snap.generation, Changed: diff.size(), Duration: time.Since(start)}
+	for _, f := range snap.paths() {
+		stats.Files++
+		stats.Bytes += f.residentSize()
+	}
+	return diff, stats, nil
+}
+
+// Reload re-reads the root and swaps the new files in at once, then
+// calls OnReload. When it fails, the previous files keep being served.
+// Concurrent reloads, whatever triggered them, run one at a time.
+func (s *Server) Reload() error {
+	_, err := s.reload("manual")
+	return err
+}
+
+func (s *Server) reloadStatus() reloadStatus {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	return s.status
+}
+
+func (s *Server) syncLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			s.reload("sync")
+		case <-s.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package marb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReloadCoalesces(t *testing.T) {
+	var loads int32
+	s := newTestServer(t, Config{
+		ReloadDebounce: 20 * time.Millisecond,
+		OnReload:       func(ReloadStats) { atomic.AddInt32(&loads, 1) },
+	}, map[string]string{"index.html": "home"})
+	atomic.StoreInt32(&loads, 0) // not counting startup
+
+	const n = 32
+	triggers := []string{"manual", "webhook", "sync", "watch"}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// the file written before triggering must be in the files
+			// served once the reload returns, which is only sure if the
+			// reload started after the trigger
+			name := fmt.Sprintf("page%d.html", i)
+			if err := os.WriteFile(filepath.Join(s.Root, name), []byte(name), 0o644); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := s.reload(triggers[i%len(triggers)]); err != nil {
+				t.Errorf("reload: %v", err)
+				return
+			}
+			if s.current().files["/"+name] == nil {
+				t.Errorf("/%s missing after the reload its trigger asked for", name)
+			}
+		}()
+		if i%8 == 7 {
+			// let some triggers land while a reload runs
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&loads); got == 0 || got >= n {
+		t.Errorf("%d triggers made %d loads, want fewer but at least one", n, got)
+	}
+}
+
+func TestReloadCallback(t *testing.T) {
+	var reloads []ReloadStats
+	s := newTestServer(t, Config{OnReload: func(stats ReloadStats) { reloads = append(reloads, stats) }}, map[string]string{"index.html": "home"})
+	if len(reloads) != 1 || reloads[0].Trigger != "startup" || reloads[0].Generation != 1 || reloads[0].Files != 1 {
+		t.Fatalf("after startup, OnReload got %+v, want one startup reload of 1 file", reloads)
+	}
+
+	if err := os.WriteFile(filepath.Join(s.Root, "about.html"), []byte("about"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if last := reloads[len(reloads)-1]; len(reloads) != 2 || last.Trigger != "manual" || last.Generation != 2 || last.Files != 2 || last.Changed != 1 {
+		t.Errorf("after Reload, OnReload got %+v, want a manual reload of 2 files, 1 changed", reloads)
+	}
+	if rec := get(s, "/about.html"); rec.Body.String() != "about" {
+		t.Errorf("/about.html after Reload: got %d %q", rec.Code, rec.Body)
+	}
+
+	// a failed reload keeps the files and doesn't call OnReload
+	if err := os.RemoveAll(s.Root); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Error("reloading a missing root succeeded")
+	}
+	if len(reloads) != 2 {
+		t.Errorf("OnReload called after a failed reload: %+v", reloads[2:])
+	}
+	if rec := get(s, "/about.html"); rec.Body.String() != "about" {
+		t.Errorf("/about.html after a failed reload: got %d %q", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,79 @@
+package marb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	remoteAttempts  = 4
+	remoteRetryBase = 250 * time.Millisecond
+
+	// remoteTimeout bounds a single request to an object store.
+	remoteTimeout = 5 * time.Minute
+)
+
+var remoteClient = &http.Client{Timeout: remoteTimeout}
+
+// statusError is returned for unexpected HTTP responses from a remote
+// source.
+type statusError struct {
+	url    string
+	status int
+	body   string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.url, http.StatusText(e.status), e.body)
+}
+
+// retryable reports whether err is worth another attempt: transport
+// errors, throttling and server side failures.
+func retryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.status == http.StatusTooManyRequests || se.status >= 500
+	}
+	return true
+}
+
+// withRetry runs op, retrying transient failures with a backoff.
+func withRetry(what string, op func() error) error {
+	delay := remoteRetryBase
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt == remoteAttempts || !retryable(err) {
+			return err
+		}
+		log.Printf("%s: %v, retrying in %v", what, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// doRequest sends req and returns the response body, turning non-2xx
+// responses into a statusError.
+func doRequest(client *http.Client, req *http.Request) (*http.Response, []byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if len(body) > 512 {
+			body = body[:512]
+		}
+		return nil, nil, &statusError{url: req.URL.Redacted(), status: resp.StatusCode, body: string(body)}
+	}
+	return resp, body, nil
+}
@@ -0,0 +1,35 @@
+package marb
+
+import (
+	"path"
+	"time"
+)
+
+// rootFallbackWelcome, as RootFallback, serves welcomePage at / in place
+// of a file of the site.
+const rootFallbackWelcome = "welcome"
+
+const welcomePage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>marb</title></head>
+<body>
+<h1>It works</h1>
+<p>marb is running, but this site has no index page yet.</p>
+</body>
+</html>
+`
+
+// setRootFallback picks the file served at / when the root has no index
+// nor listing.
+func (s *Server) setRootFallback(snap *siteSnapshot) {
+	switch {
+	case s.RootFallback == "" || snap.files["/"] != nil:
+	case s.RootFallback == rootFallbackWelcome:
+		f := newSiteFile("/welcome.html", []byte(welcomePage), "text/html; charset=utf-8", "", s.Compact, s.Brotli)
+		f.lastModified = time.Now()
+		f.formatHeaders()
+		snap.rootFallback = f
+	default:
+		snap.rootFallback = snap.files[path.Join("/", s.RootFallback)]
+	}
+}
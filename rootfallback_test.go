@@ -0,0 +1,41 @@
+package marb
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRootFallback(t *testing.T) {
+	for _, tt := range []struct {
+		fallback string
+		files    map[string]string
+		status   int
+		body     string
+	}{
+		{"", map[string]string{"app.js": "js"}, http.StatusNotFound, ""},
+		{"welcome", map[string]string{"app.js": "js"}, http.StatusOK, "<h1>It works</h1>"},
+		{"start.html", map[string]string{"start.html": "start here"}, http.StatusOK, "start here"},
+		{"welcome", map[string]string{"index.html": "home"}, http.StatusOK, "home"},
+	} {
+		s := newTestServer(t, Config{RootFallback: tt.fallback}, tt.files)
+		rec := get(s, "/")
+		if rec.Code != tt.status || !strings.Contains(rec.Body.String(), tt.body) {
+			t.Errorf("fallback %q with %d files: got %d %.60q, want %d with %q", tt.fallback, len(tt.files), rec.Code, rec.Body, tt.status, tt.body)
+		}
+		// only / falls back
+		if rec := get(s, "/missing"); rec.Code != http.StatusNotFound {
+			t.Errorf("fallback %q: /missing got %d, want 404", tt.fallback, rec.Code)
+		}
+	}
+
+	// a listing beats the fallback
+	s := newTestServer(t, Config{RootFallback: "welcome", AutoIndex: true}, map[string]string{"app.js": "js"})
+	if rec := get(s, "/"); strings.Contains(rec.Body.String(), "It works") || !strings.Contains(rec.Body.String(), "app.js") {
+		t.Errorf("with a listing: got %d %.60q, want the listing", rec.Code, rec.Body)
+	}
+
+	if _, err := New(Config{Root: writeSite(t, map[string]string{"index.html": "x"}) + "/index.html", RootFallback: "welcome"}); err == nil {
+		t.Error("root fallback accepted when serving a single file")
+	}
+}
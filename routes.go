@@ -0,0 +1,46 @@
+package marb
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// buildRoutes lists the paths of snap as a JSON array, for RoutesPath.
+// Directories keying their index aren't listed, the index itself is.
+func buildRoutes(snap *siteSnapshot) ([]byte, error) {
+	routes := make([]string, 0, len(snap.files))
+	for p := range snap.paths() {
+		routes = append(routes, p)
+	}
+	sort.Strings(routes)
+	body, err := json.Marshal(routes)
+	if err != nil {
+		return nil, err
+	}
+	return append(body, '\n'), nil
+}
+
+// serveRoutes answers requests for RoutesPath with the paths being
+// served, as listed when the files were loaded, for clients to
+// prefetch. With RoutesAuth, it requires an admin token, whatever the
+// method, for responses not to tell it exists, CORS preflights aside.
+func (s *Server) serveRoutes(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.adminAuthorized(r); s.RoutesAuth && !ok && !isPreflight(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="marb"`)
+		adminError(w, r, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	switch r.Method {
+	case http.MethodOptions:
+		s.serveOptions(w)
+		return
+	case http.MethodGet, http.MethodHead:
+	default:
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	writeDynamic(w, r, http.StatusOK, "application/json", s.current().routes)
+}
@@ -0,0 +1,90 @@
+package marb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRoutes(t *testing.T) {
+	files := map[string]string{"index.html": "home", "docs/index.html": "docs", "app.js": "js"}
+	s := newTestServer(t, Config{RoutesPath: "/_routes.json"}, files)
+
+	rec := get(s, "/_routes.json")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var routes []string
+	if err := json.Unmarshal(rec.Body.Bytes(), &routes); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/app.js", "/docs/index.html", "/index.html"}; !reflect.DeepEqual(routes, want) {
+		t.Errorf("routes %q, want %q", routes, want)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("POST", "/_routes.json", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got %d, want 405", rec.Code)
+	}
+
+	s = newTestServer(t, Config{RoutesPath: "/_routes.json", RoutesAuth: true, AdminToken: "secret"}, files)
+	if rec := get(s, "/_routes.json"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("without a token: got %d, want 401", rec.Code)
+	}
+	// which methods it takes doesn't tell it exists
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("POST", "/_routes.json", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("POST without a token: got %d, want 401", rec.Code)
+	}
+	r := httptest.NewRequest("GET", "/_routes.json", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Errorf("with a token: got %d, want 200", rec.Code)
+	}
+}
+
+func TestOptionsAuth(t *testing.T) {
+	s := newTestServer(t, Config{RoutesPath: "/_routes.json", RoutesAuth: true, AdminToken: "secret"}, map[string]string{"index.html": "home"})
+
+	for _, tt := range []struct {
+		handler   http.Handler
+		path      string
+		token     bool
+		preflight bool
+		status    int
+	}{
+		{s, "/_routes.json", false, false, http.StatusUnauthorized},
+		{s, "/_routes.json", true, false, http.StatusNoContent},
+		{s, "/_routes.json", false, true, http.StatusNoContent},
+		{s.AdminHandler(), "/info", false, false, http.StatusUnauthorized},
+		{s.AdminHandler(), "/info", false, true, http.StatusNoContent},
+		// unprotected paths are none of its business
+		{s, "/", false, false, http.StatusNoContent},
+	} {
+		r := httptest.NewRequest("OPTIONS", tt.path, nil)
+		if tt.token {
+			r.Header.Set("Authorization", "Bearer secret")
+		}
+		if tt.preflight {
+			r.Header.Set("Origin", "https://elsewhere.example")
+			r.Header.Set("Access-Control-Request-Method", "GET")
+		}
+		rec := httptest.NewRecorder()
+		tt.handler.ServeHTTP(rec, r)
+		if rec.Code != tt.status {
+			t.Errorf("OPTIONS %s, token %v, preflight %v: got %d, want %d", tt.path, tt.token, tt.preflight, rec.Code, tt.status)
+		}
+		if tt.preflight && rec.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("OPTIONS %s: preflight allowed from %q", tt.path, rec.Header().Get("Access-Control-Allow-Origin"))
+		}
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get("Allow") != "" {
+			t.Errorf("OPTIONS %s: unauthorized, yet told Allow %q", tt.path, rec.Header().Get("Allow"))
+		}
+	}
+}
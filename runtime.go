@@ -0,0 +1,256 @@
+package marb
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log levels, from the most verbose. Requests are logged at info level,
+// failures at any level.
+const (
+	levelDebug int32 = iota
+	levelInfo
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "error"}
+
+func parseLogLevel(s string) (int32, error) {
+	if s == "" {
+		return levelInfo, nil
+	}
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return int32(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected one of %s", s, strings.Join(levelNames, ", "))
+}
+
+// runtimeSetting is a setting that can be changed through the admin
+// API while serving. Its value is read atomically on the request path.
+type runtimeSetting struct {
+	value   int32
+	startup int32
+	format  func(int32) string
+
+	mu        sync.Mutex
+	changedBy string
+	changedAt time.Time
+}
+
+func newRuntimeSetting(value int32, format func(int32) string) *runtimeSetting {
+	return &runtimeSetting{value: value, startup: value, format: format}
+}
+
+func (rs *runtimeSetting) get() int32 {
+	return atomic.LoadInt32(&rs.value)
+}
+
+func (rs *runtimeSetting) set(value int32, by string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	atomic.StoreInt32(&rs.value, value)
+	rs.changedBy, rs.changedAt = by, time.Now()
+}
+
+// settingInfo shows a runtime setting on the admin API.
+type settingInfo struct {
+	Value     string     `json:"value"`
+	Startup   string     `json:"startup"`
+	ChangedBy string     `json:"changedBy,omitempty"`
+	ChangedAt *time.Time `json:"changedAt,omitempty"`
+}
+
+func (rs *runtimeSetting) info() settingInfo {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	info := settingInfo{Value: rs.format(rs.get()), Startup: rs.format(rs.startup)}
+	if rs.changedBy != "" {
+		changedAt := rs.changedAt
+		info.ChangedBy, info.ChangedAt = rs.changedBy, &changedAt
+	}
+	return info
+}
+
+func formatLevel(v int32) string {
+	return levelNames[v]
+}
+
+func formatSwitch(v int32) string {
+	if v != 0 {
+		return "on"
+	}
+	return "off"
+}
+
+func parseSwitch(s string) (int32, error) {
+	switch strings.ToLower(s) {
+	case "on", "true", "1":
+		return 1, nil
+	case "off", "false", "0":
+		return 0, nil
+	}
+	return 0, fmt.Errorf("expected on or off, got %q", s)
+}
+
+func boolSwitch(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// runtimeSettings are the settings that can be changed through the
+// admin API.
+type runtimeSettings struct {
+	logLevel     *runtimeSetting
+	debugHeaders *runtimeSetting
+	maintenance  *runtimeSetting
+	draining     *runtimeSetting
+
+	retryAfter string // Retry-After header value in maintenance mode
+}
+
+func newRuntimeSettings(cfg Config) (*runtimeSettings, error) {
+	level, err := parseLogLevel(cfg.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	retryAfter, err := parseRetryAfter(cfg.MaintenanceRetryAfter)
+	if err != nil {
+		return nil, fmt.Errorf("maintenance retry after: %w", err)
+	}
+	return &runtimeSettings{
+		logLevel:     newRuntimeSetting(level, formatLevel),
+		debugHeaders: newRuntimeSetting(boolSwitch(cfg.DebugHeaders), formatSwitch),
+		maintenance:  newRuntimeSetting(boolSwitch(cfg.Maintenance), formatSwitch),
+		draining:     newRuntimeSetting(0, formatSwitch),
+		retryAfter:   retryAfter,
+	}, nil
+}
+
+// parseRetryAfter turns a duration into a Retry-After value in seconds,
+// rounded up, and an RFC1123 date into an HTTP date.
+func parseRetryAfter(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		if d <= 0 {
+			return "", fmt.Errorf("duration %s isn't positive", s)
+		}
+		return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10), nil
+	}
+	for _, layout := range []string{time.RFC1123, time.RFC1123Z} {
+		if t, err := time.Parse(layout, s); err == nil {
+			if t.Before(time.Now()) {
+				log.Printf("warning: maintenance retry after %s is in the past", s)
+			}
+			return t.UTC().Format(http.TimeFormat), nil
+		}
+	}
+	return "", fmt.Errorf("%q is neither a duration nor an RFC1123 date", s)
+}
+
+// logEnabled reports whether messages of the given level are logged.
+func (s *Server) logEnabled(level int32) bool {
+	return level >= s.runtime.logLevel.get()
+}
+
+func (s *Server) debugf(format string, v ...interface{}) {
+	if s.logEnabled(levelDebug) {
+		log.Printf("debug: "+format, v...)
+	}
+}
+
+// setDebugHeaders tells, when enabled, which file answered the request
+// and in which encoding.
+func (s *Server) setDebugHeaders(h http.Header, f *siteFile, encoding string) {
+	if s.runtime.debugHeaders.get() == 0 {
+		return
+	}
+	if encoding == "" {
+		encoding = "identity"
+	}
+	h.Set("X-Marb-File", strings.TrimSuffix(f.dir, "/")+"/"+f.name)
+	h.Set("X-Marb-Encoding", encoding)
+}
+
+// serveMaintenance answers 503 to every request while in maintenance
+// mode, reporting whether it did.
+func (s *Server) serveMaintenance(w http.ResponseWriter, r *http.Request) bool {
+	if s.runtime.maintenance.get() == 0 {
+		return false
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if s.runtime.retryAfter != "" {
+		w.Header().Set("Retry-After", s.runtime.retryAfter)
+	}
+	writeDynamic(w, r, http.StatusServiceUnavailable, "text/plain; charset=utf-8", []byte("down for maintenance\n"))
+	return true
+}
+
+// serveSetting gets or sets a runtime setting on the admin API. PUT
+// requests carry the new value as their body.
+func (s *Server) serveSetting(name string, setting *runtimeSetting, parse func(string) (int32, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodPut:
+			body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+			if err != nil {
+				adminError(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			value, err := parse(strings.TrimSpace(string(body)))
+			if err != nil {
+				adminError(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			by := adminID(r)
+			setting.set(value, by)
+			log.Printf("admin: %s set %s to %s", by, name, setting.format(value))
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT")
+			adminError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, r, setting.info())
+	}
+}
+
+// runtimeConfig shows the current runtime settings on the admin API,
+// along with their startup values and who changed them.
+type runtimeConfig struct {
+	LogLevel     settingInfo `json:"logLevel"`
+	DebugHeaders settingInfo `json:"debugHeaders"`
+	Maintenance  settingInfo `json:"maintenance"`
+
+	// Effective is the whole configuration, with where each value came
+	// from.
+	Effective map[string]ConfigValue `json:"effective"`
+}
+
+func (s *Server) serveConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		adminError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, r, runtimeConfig{
+		LogLevel:     s.runtime.logLevel.info(),
+		DebugHeaders: s.runtime.debugHeaders.info(),
+		Maintenance:  s.runtime.maintenance.info(),
+		Effective:    s.configDump(),
+	})
+}
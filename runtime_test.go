@@ -0,0 +1,44 @@
+package marb
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMaintenanceRetryAfter(t *testing.T) {
+	s := newTestServer(t, Config{Maintenance: true, MaintenanceRetryAfter: "90s"}, map[string]string{"index.html": "home"})
+
+	rec := get(s, "/")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "90" || rec.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("in maintenance: got %d with Retry-After %q and Cache-Control %q, want 503 with 90 and no-store", rec.Code, rec.Header().Get("Retry-After"), rec.Header().Get("Cache-Control"))
+	}
+	if rec := get(s, "/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("/healthz in maintenance: got %d, want 200", rec.Code)
+	}
+
+	s.runtime.maintenance.set(0, "test")
+	if rec := get(s, "/"); rec.Code != http.StatusOK || rec.Header().Get("Retry-After") != "" {
+		t.Errorf("out of maintenance: got %d with Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  string // "" for an error
+	}{
+		{"90s", "90"},
+		{"1m30.5s", "91"},
+		{"2h", "7200"},
+		{"Wed, 21 Oct 2037 07:28:00 GMT", "Wed, 21 Oct 2037 07:28:00 GMT"},
+		{"Wed, 21 Oct 2037 09:28:00 +0200", "Wed, 21 Oct 2037 07:28:00 GMT"},
+		{"0s", ""},
+		{"-5m", ""},
+		{"tomorrow", ""},
+	} {
+		got, err := parseRetryAfter(tt.value)
+		if got != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("parseRetryAfter(%q) = %q, %v, want %q", tt.value, got, err, tt.want)
+		}
+	}
+}
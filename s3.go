@@ -0,0 +1,528 @@
+package marb
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3Source reads a site from the objects of an S3 bucket under a prefix.
+// Requests are signed with AWS Signature Version 4, using credentials
+// from the usual places, see awsCredentialChain.
+type s3Source struct {
+	bucket   string
+	prefix   string
+	region   string
+	endpoint *url.URL // custom endpoint, addressed path style; nil for AWS
+	creds    *awsCredentialChain
+	client   *http.Client
+}
+
+func newS3Source(u *url.URL) (*s3Source, error) {
+	src := &s3Source{
+		bucket: u.Host,
+		prefix: strings.TrimPrefix(u.Path, "/"),
+		region: os.Getenv("AWS_REGION"),
+		client: remoteClient,
+	}
+	if src.prefix != "" && !strings.HasSuffix(src.prefix, "/") {
+		src.prefix += "/"
+	}
+	if src.region == "" {
+		src.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if src.region == "" {
+		src.region = "us-east-1"
+	}
+
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_S3")
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if endpoint != "" {
+		var err error
+		if src.endpoint, err = url.Parse(endpoint); err != nil {
+			return nil, fmt.Errorf("S3 endpoint %q: %v", endpoint, err)
+		}
+	}
+
+	src.creds = &awsCredentialChain{region: src.region}
+	return src, nil
+}
+
+// awsEscape percent-encodes s the way Signature Version 4 expects,
+// leaving slashes alone if keepSlash is set.
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && keepSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (src *s3Source) objectURL(key string, query url.Values) *url.URL {
+	u := &url.URL{Scheme: "https", Host: src.bucket + ".s3." + src.region + ".amazonaws.com", Path: "/" + key}
+	if src.endpoint != nil {
+		u.Scheme = src.endpoint.Scheme
+		u.Host = src.endpoint.Host
+		u.Path = strings.TrimSuffix(src.endpoint.Path, "/") + "/" + src.bucket + "/" + key
+	}
+	u.RawPath = awsEscape(u.Path, true)
+
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, awsEscape(k, false)+"="+awsEscape(query.Get(k), false))
+	}
+	u.RawQuery = strings.Join(parts, "&")
+
+	return u
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// emptyPayloadHash is the SHA-256 of an empty body, which is what all
+// requests made to S3 here carry.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// signV4 signs req, which must have an empty body, for the given service.
+func signV4(req *http.Request, creds *awsCredentials, region string, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashedRequest[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.secretAccessKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.accessKeyID, scope, signedHeaders, signature))
+}
+
+func (src *s3Source) get(u *url.URL) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	creds, err := src.creds.get()
+	if err != nil {
+		return nil, nil, err
+	}
+	if creds != nil {
+		signV4(req, creds, src.region, "s3", time.Now())
+	}
+
+	return doRequest(src.client, req)
+}
+
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		LastModified time.Time
+		ETag         string
+		Size         int64
+	}
+}
+
+func (src *s3Source) list() ([]*sourceFile, error) {
+	var files []*sourceFile
+	query := url.Values{"list-type": {"2"}, "prefix": {src.prefix}}
+
+	for {
+		var result s3ListResult
+		err := withRetry("s3://"+src.bucket+"/"+src.prefix, func() error {
+			_, body, err := src.get(src.objectURL("", query))
+			if err != nil {
+				return err
+			}
+			result = s3ListResult{}
+			return xml.Unmarshal(body, &result)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range result.Contents {
+			if strings.HasSuffix(obj.Key, "/") {
+				// folder placeholder
+				continue
+			}
+			files = append(files, &sourceFile{
+				name:     "/" + strings.TrimPrefix(obj.Key, src.prefix),
+				size:     obj.Size,
+				modTime:  obj.LastModified,
+				etag:     obj.ETag,
+				location: obj.Key,
+			})
+		}
+
+		if !result.IsTruncated {
+			return files, nil
+		}
+		if result.NextContinuationToken == "" {
+			return nil, errors.New("s3: truncated listing without a continuation token")
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (src *s3Source) read(sf *sourceFile) ([]byte, string, error) {
+	var contents []byte
+	var contentType string
+	err := withRetry("s3://"+src.bucket+"/"+sf.location, func() error {
+		resp, body, err := src.get(src.objectURL(sf.location, nil))
+		if err != nil {
+			return err
+		}
+		contents, contentType = body, resp.Header.Get("Content-Type")
+		return nil
+	})
+	return contents, contentType, err
+}
+
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	expires         time.Time // zero for long-lived credentials
+}
+
+// awsCredentialRefresh is how long before expiring credentials are
+// fetched again.
+const awsCredentialRefresh = 5 * time.Minute
+
+// awsCredentialChain looks up AWS credentials, in order, from the
+// environment, a web identity token (as on EKS), the shared credentials
+// file, the ECS container endpoint and the EC2 instance metadata
+// service. Without any, requests are sent unsigned, which works for
+// public buckets.
+type awsCredentialChain struct {
+	region string
+
+	mu     sync.Mutex
+	cached *awsCredentials
+	tried  bool
+}
+
+func (c *awsCredentialChain) get() (*awsCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tried && (c.cached == nil || c.cached.expires.IsZero() || time.Until(c.cached.expires) > awsCredentialRefresh) {
+		return c.cached, nil
+	}
+
+	providers := []func() (*awsCredentials, error){
+		envCredentials,
+		c.webIdentityCredentials,
+		sharedFileCredentials,
+		containerCredentials,
+		instanceCredentials,
+	}
+	for _, provider := range providers {
+		creds, err := provider()
+		if err != nil {
+			return nil, err
+		}
+		if creds != nil {
+			c.cached, c.tried = creds, true
+			return creds, nil
+		}
+	}
+
+	if !c.tried {
+		log.Printf("s3: no AWS credentials found, sending unsigned requests")
+	}
+	c.cached, c.tried = nil, true
+	return nil, nil
+}
+
+func envCredentials() (*awsCredentials, error) {
+	id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return nil, nil
+	}
+	return &awsCredentials{accessKeyID: id, secretAccessKey: secret, sessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+}
+
+func (c *awsCredentialChain) webIdentityCredentials() (*awsCredentials, error) {
+	tokenFile, role := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN")
+	if tokenFile == "" || role == "" {
+		return nil, nil
+	}
+
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	session := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = "marb"
+	}
+
+	query := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {role},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	u := "https://sts." + c.region + ".amazonaws.com/?" + query.Encode()
+
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string `xml:"AccessKeyId"`
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	err = withRetry("sts", func() error {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return err
+		}
+		_, body, err := doRequest(remoteClient, req)
+		if err != nil {
+			return err
+		}
+		return xml.Unmarshal(body, &result)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("assuming role %s: %v", role, err)
+	}
+
+	return &awsCredentials{
+		accessKeyID:     result.Credentials.AccessKeyID,
+		secretAccessKey: result.Credentials.SecretAccessKey,
+		sessionToken:    result.Credentials.SessionToken,
+		expires:         result.Credentials.Expiration,
+	}, nil
+}
+
+func sharedFileCredentials() (*awsCredentials, error) {
+	name := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if name == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		name = filepath.Join(home, ".aws", "credentials")
+	}
+
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	creds := &awsCredentials{}
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.accessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.secretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.sessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if creds.accessKeyID == "" || creds.secretAccessKey == "" {
+		return nil, nil
+	}
+	return creds, nil
+}
+
+// metadataCredentials is the JSON document served by both the ECS
+// container endpoint and the EC2 instance metadata service.
+type metadataCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+func (m *metadataCredentials) credentials() *awsCredentials {
+	return &awsCredentials{
+		accessKeyID:     m.AccessKeyID,
+		secretAccessKey: m.SecretAccessKey,
+		sessionToken:    m.Token,
+		expires:         m.Expiration,
+	}
+}
+
+// metadataClient talks to link-local credential endpoints, which either
+// answer right away or aren't there at all.
+var metadataClient = &http.Client{Timeout: 2 * time.Second}
+
+func containerCredentials() (*awsCredentials, error) {
+	u := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		u = "http://169.254.170.2" + rel
+	}
+	if u == "" {
+		return nil, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	var m metadataCredentials
+	err = withRetry("container credentials", func() error {
+		_, body, err := doRequest(metadataClient, req)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(body, &m)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m.credentials(), nil
+}
+
+const imdsEndpoint = "http://169.254.169.254/latest"
+
+func instanceCredentials() (*awsCredentials, error) {
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return nil, nil
+	}
+
+	req, err := http.NewRequest(http.MethodPut, imdsEndpoint+"/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+	_, token, err := doRequest(metadataClient, req)
+	if err != nil {
+		// not running on EC2
+		return nil, nil
+	}
+
+	get := func(p string) ([]byte, error) {
+		req, err := http.NewRequest(http.MethodGet, imdsEndpoint+"/meta-data/iam/security-credentials/"+p, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Aws-Ec2-Metadata-Token", string(token))
+		_, body, err := doRequest(metadataClient, req)
+		return body, err
+	}
+
+	role, err := get("")
+	if err != nil {
+		return nil, fmt.Errorf("instance metadata: %v", err)
+	}
+	body, err := get(strings.TrimSpace(strings.SplitN(string(role), "\n", 2)[0]))
+	if err != nil {
+		return nil, fmt.Errorf("instance metadata: %v", err)
+	}
+
+	var m metadataCredentials
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("instance metadata: %v", err)
+	}
+	return m.credentials(), nil
+}
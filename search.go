@@ -0,0 +1,306 @@
+package marb
+
+import (
+	"bytes"
+	"encoding/json"
+	"html"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The search index keeps at most searchPageText bytes of text per page,
+// and searchMaxPostings (term, page) pairs overall, pages beyond that
+// being left out. Queries return up to searchResults pages.
+const (
+	searchPageText    = 64 << 10
+	searchMaxPostings = 1 << 20
+	searchResults     = 20
+	searchSnippet     = 160
+)
+
+// searchIndex is a full-text index over the HTML pages of a snapshot,
+// built at load time so that it's swapped along with the files.
+type searchIndex struct {
+	pages    []searchPage
+	terms    map[string][]searchPosting // by stem, pages in index order
+	postings int
+	size     int64 // rough memory footprint, for the log
+}
+
+type searchPage struct {
+	path  string
+	title string
+	text  string // tags stripped, for snippets
+}
+
+type searchPosting struct {
+	page int32
+	hits int32
+}
+
+// searchTerm normalizes a word for indexing and lookups: lowercased,
+// and stemmed lightly enough that "pages" finds "page", "caching"
+// finds "cache" and "reloading" finds "reload", without a dictionary.
+// A final e goes too, for "page" and "pages" to both become "pag".
+func searchTerm(word string) string {
+	w := strings.ToLower(word)
+	for _, suffix := range []string{"ing", "ed", "es", "s"} {
+		if strings.HasSuffix(w, suffix) && len(w)-len(suffix) >= 3 {
+			w = w[:len(w)-len(suffix)]
+			break
+		}
+	}
+	if strings.HasSuffix(w, "e") && len(w) > 3 {
+		w = w[:len(w)-1]
+	}
+	return w
+}
+
+// searchWords splits text into words, returning their byte offsets.
+func searchWords(text string) [][2]int {
+	var words [][2]int
+	start := -1
+	for i, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case word && start < 0:
+			start = i
+		case !word && start >= 0:
+			words = append(words, [2]int{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		words = append(words, [2]int{start, len(text)})
+	}
+	return words
+}
+
+// htmlText returns the title of an HTML page and its text, tags,
+// scripts and styles stripped, entities decoded and whitespace
+// collapsed.
+func htmlText(page []byte) (title, text string) {
+	var b strings.Builder
+	lower := bytes.ToLower(page)
+	for i := 0; i < len(page); {
+		if page[i] != '<' {
+			end := bytes.IndexByte(page[i:], '<')
+			if end < 0 {
+				end = len(page) - i
+			}
+			b.Write(page[i : i+end])
+			i += end
+			continue
+		}
+
+		for _, skip := range []string{"script", "style", "title"} {
+			if bytes.HasPrefix(lower[i+1:], []byte(skip)) {
+				end := bytes.Index(lower[i:], []byte("</"+skip))
+				if end < 0 {
+					end = len(page) - i
+				}
+				if skip == "title" && title == "" {
+					if open := bytes.IndexByte(page[i:i+end], '>'); open >= 0 {
+						title = strings.Join(strings.Fields(html.UnescapeString(string(page[i+open+1:i+end]))), " ")
+					}
+				}
+				i += end
+				break
+			}
+		}
+		end := bytes.IndexByte(page[i:], '>')
+		if end < 0 {
+			break
+		}
+		i += end + 1
+		b.WriteByte(' ')
+	}
+	return title, strings.Join(strings.Fields(html.UnescapeString(b.String())), " ")
+}
+
+// buildSearchIndex indexes the HTML pages of snap, the 404 page and
+// hidden files excepted. Index files are listed under their directory.
+func (s *Server) buildSearchIndex(snap *siteSnapshot) *searchIndex {
+	idx := &searchIndex{terms: make(map[string][]searchPosting)}
+	files := snap.paths()
+	names := make([]string, 0, len(files))
+	for name, f := range files {
+		if isHTML(f) && f != snap.error404 && !hiddenPath(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	skipped := 0
+	for _, name := range names {
+		f := files[name]
+		contents, err := f.identity()
+		if err != nil {
+			log.Printf("search: %s: %v", name, err)
+			continue
+		}
+		title, text := htmlText(contents)
+		if len(text) > searchPageText {
+			n := searchPageText
+			for !utf8.RuneStart(text[n]) {
+				n--
+			}
+			text = text[:n]
+		}
+
+		hits := make(map[string]int32)
+		words := text + " " + title
+		for _, w := range searchWords(words) {
+			hits[searchTerm(words[w[0]:w[1]])]++
+		}
+		if idx.postings+len(hits) > searchMaxPostings {
+			skipped++
+			continue
+		}
+
+		if f.isIndex {
+			name = strings.TrimSuffix(f.dir, "/") + "/"
+		}
+		page := int32(len(idx.pages))
+		idx.pages = append(idx.pages, searchPage{path: name, title: title, text: text})
+		idx.size += int64(len(name) + len(title) + len(text))
+		for term, n := range hits {
+			if _, ok := idx.terms[term]; !ok {
+				idx.size += int64(len(term))
+			}
+			idx.terms[term] = append(idx.terms[term], searchPosting{page, n})
+			idx.size += 8
+		}
+		idx.postings += len(hits)
+	}
+
+	if skipped > 0 {
+		snap.warn(warnSearchFull, "search index full, %d pages left out", skipped)
+	}
+	log.Printf("search index: %d pages, %d terms, %s", len(idx.pages), len(idx.terms), formatSize(idx.size))
+	return idx
+}
+
+// searchResult is a page matching a query.
+type searchResult struct {
+	Path    string `json:"path"`
+	Title   string `json:"title"`
+	Snippet string `json:"snippet"` // HTML, matches in <mark>
+}
+
+// search returns the pages holding all the words of query, those with
+// the most occurrences first, words in titles counting more.
+func (idx *searchIndex) search(query string) []searchResult {
+	stems := make(map[string]bool)
+	for _, w := range searchWords(query) {
+		stems[searchTerm(query[w[0]:w[1]])] = true
+	}
+	if len(stems) == 0 {
+		return []searchResult{}
+	}
+
+	scores := make(map[int32]int)
+	first := true
+	for stem := range stems {
+		next := make(map[int32]int)
+		for _, p := range idx.terms[stem] {
+			if score, ok := scores[p.page]; first || ok {
+				next[p.page] = score + int(p.hits)
+			}
+		}
+		scores, first = next, false
+	}
+
+	pages := make([]int32, 0, len(scores))
+	for page := range scores {
+		for _, w := range searchWords(idx.pages[page].title) {
+			if stems[searchTerm(idx.pages[page].title[w[0]:w[1]])] {
+				scores[page] += 10
+			}
+		}
+		pages = append(pages, page)
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		if scores[pages[i]] != scores[pages[j]] {
+			return scores[pages[i]] > scores[pages[j]]
+		}
+		return pages[i] < pages[j]
+	})
+	if len(pages) > searchResults {
+		pages = pages[:searchResults]
+	}
+
+	results := make([]searchResult, len(pages))
+	for i, page := range pages {
+		p := idx.pages[page]
+		results[i] = searchResult{Path: p.path, Title: p.title, Snippet: snippet(p.text, stems)}
+	}
+	return results
+}
+
+// snippet returns about searchSnippet bytes of text around the first
+// word matching stems, HTML-escaped, matching words in <mark>.
+func snippet(text string, stems map[string]bool) string {
+	words := searchWords(text)
+	start := 0
+	for _, w := range words {
+		if stems[searchTerm(text[w[0]:w[1]])] {
+			start = w[0] - searchSnippet/4
+			break
+		}
+	}
+	if start < 0 {
+		start = 0
+	}
+	end := start + searchSnippet
+	if end > len(text) {
+		end = len(text)
+	}
+	// keep whole words
+	for start > 0 && text[start-1] != ' ' {
+		start--
+	}
+	for end < len(text) && text[end] != ' ' {
+		end++
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	last := start
+	for _, w := range words {
+		if w[0] < start || w[1] > end || !stems[searchTerm(text[w[0]:w[1]])] {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[last:w[0]]))
+		b.WriteString("<mark>" + html.EscapeString(text[w[0]:w[1]]) + "</mark>")
+		last = w[1]
+	}
+	b.WriteString(html.EscapeString(text[last:end]))
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// serveSearch answers SearchPath?q=words with the pages holding all of
+// them, in JSON.
+func (s *Server) serveSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query().Get("q")
+	body, _ := json.Marshal(struct {
+		Query   string         `json:"query"`
+		Results []searchResult `json:"results"`
+	}{query, s.current().search.search(query)})
+	w.Header().Set("Cache-Control", "no-cache")
+	writeDynamic(w, r, http.StatusOK, "application/json", append(body, '\n'))
+}
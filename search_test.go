@@ -0,0 +1,163 @@
+package marb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// searchPaths returns the paths of the results of searching s for q.
+func searchPaths(t *testing.T, s http.Handler, q string) []string {
+	t.Helper()
+	rec := get(s, "/_search?q="+url.QueryEscape(q))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%q: got %d", q, rec.Code)
+	}
+	var resp struct {
+		Query   string
+		Results []searchResult
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%q: %v", q, err)
+	}
+	if resp.Query != q {
+		t.Errorf("query %q, want %q", resp.Query, q)
+	}
+	paths := []string{}
+	for _, r := range resp.Results {
+		paths = append(paths, r.Path)
+	}
+	return paths
+}
+
+func TestSearch(t *testing.T) {
+	s := newTestServer(t, Config{SearchPath: "/_search", NotFound: "404.html"}, map[string]string{
+		"index.html":   "<title>Home</title><p>Reloading the server without downtime.</p>",
+		"caching.html": "<p>Server pages and caching headers.</p>",
+		"guide/index.html": "<title>Caching guide</title><p>Everything about caching, and more caching.</p>" +
+			"<script>var server = 1</script><style>.server {}</style>",
+		"404.html":     "<p>No server page here, caching or not.</p>",
+		".drafts.html": "<p>Server caching drafts.</p>",
+		"notes.txt":    "server caching",
+	})
+
+	for _, tt := range []struct {
+		q    string
+		want []string
+	}{
+		// every word must be found, the title counting more
+		{"server", []string{"/caching.html", "/"}},
+		{"caching", []string{"/guide/", "/caching.html"}},
+		{"server caching", []string{"/caching.html"}},
+		{"caching server", []string{"/caching.html"}},
+		{"server downtime caching", []string{}},
+		// words are lowercased and stemmed
+		{"SERVER", []string{"/caching.html", "/"}},
+		{"page", []string{"/caching.html"}},
+		{"pages", []string{"/caching.html"}},
+		{"cache", []string{"/guide/", "/caching.html"}},
+		{"cached", []string{"/guide/", "/caching.html"}},
+		{"reloads", []string{"/"}},
+		{"reload", []string{"/"}},
+		{"header", []string{"/caching.html"}},
+		// scripts and styles aren't text
+		{"var", []string{}},
+		{"", []string{}},
+		{"!?", []string{}},
+	} {
+		if got := searchPaths(t, s, tt.q); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.q, got, tt.want)
+		}
+	}
+
+	if rec := serveRequest(s, "POST", "/_search?q=server", nil); rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("POST: got %d, Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	stems := map[string]bool{searchTerm("reload"): true}
+	for _, tt := range []struct {
+		text, want string
+	}{
+		{"Use <script> tags & reload", "Use &lt;script&gt; tags &amp; <mark>reload</mark>"},
+		{`Reloading "quoted" <b>`, `<mark>Reloading</mark> &#34;quoted&#34; &lt;b&gt;`},
+		{"<mark>reloads</mark>", "&lt;mark&gt;<mark>reloads</mark>&lt;/mark&gt;"},
+	} {
+		if got := snippet(tt.text, stems); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.text, got, tt.want)
+		}
+	}
+
+	// entities of pages are decoded once, and escaped again in snippets
+	s := newTestServer(t, Config{SearchPath: "/_search"}, map[string]string{
+		"index.html": "<p>Use &lt;script&gt; tags &amp; reload</p>",
+	})
+	rec := get(s, "/_search?q=reload")
+	var resp struct{ Results []searchResult }
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || len(resp.Results) != 1 {
+		t.Fatalf("%s, %v", rec.Body, err)
+	}
+	if got, want := resp.Results[0].Snippet, "Use &lt;script&gt; tags &amp; <mark>reload</mark>"; got != want {
+		t.Errorf("snippet %q, want %q", got, want)
+	}
+}
+
+// Searches running while the site reloads see either the old index or
+// the new one, never one in between.
+func TestSearchReload(t *testing.T) {
+	root := writeSite(t, map[string]string{"index.html": "home"})
+	s, err := New(Config{Root: root, SearchPath: "/_search"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	captureLog(t)
+
+	const pages = 5
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if n := len(s.current().search.search("zebra")); n != 0 && n != pages {
+				t.Errorf("%d results, want 0 or %d", n, pages)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		for p := 0; p < pages; p++ {
+			name := filepath.Join(root, fmt.Sprintf("zebra%d.html", p))
+			if i%2 == 0 {
+				err = os.WriteFile(name, []byte("<p>A zebra.</p>"), 0o644)
+			} else {
+				err = os.Remove(name)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		if n, want := len(searchPaths(t, s, "zebra")), pages*(1-i%2); n != want {
+			t.Fatalf("after reload %d: %d results, want %d", i, n, want)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
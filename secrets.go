@@ -0,0 +1,96 @@
+package marb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// secretScanBytes is how much of each file the secret scan looks at.
+const secretScanBytes = 8 << 10
+
+// secretNames are names of files that have no business being served,
+// as path.Match patterns matched against base names.
+var secretNames = []string{
+	".env", ".env.*", "*.env",
+	"id_rsa", "id_dsa", "id_ecdsa", "id_ed25519",
+	"*.key", "*.p12", "*.pfx", "*.keystore", "*.jks",
+	".htpasswd", ".netrc", ".npmrc", ".pypirc", ".pgpass",
+	"wp-config.php*",
+	"*.bak", "*.old", "*.orig", "*.swp", "*~",
+	"*.sql", "*.sql.gz", "*.sqlite", "*.sqlite3", "*.db",
+	"credentials", "credentials.json", "*.tfstate",
+}
+
+// secretDirs are directories whose contents have no business being
+// served.
+var secretDirs = map[string]bool{".git": true, ".svn": true, ".hg": true, ".aws": true, ".ssh": true}
+
+// secretMarkers are found in files holding secrets.
+var secretMarkers = []string{
+	"PRIVATE KEY-----",
+	"PRIVATE KEY BLOCK-----",
+	"AWS_SECRET_ACCESS_KEY",
+	"aws_secret_access_key",
+}
+
+// scanSecret tells why the file at name looks sensitive, from its name
+// or the first secretScanBytes of its contents, or returns "".
+func scanSecret(name string, head []byte) string {
+	for _, dir := range strings.Split(path.Dir(name), "/") {
+		if secretDirs[dir] {
+			return fmt.Sprintf("inside a %s directory", dir)
+		}
+	}
+	base := path.Base(name)
+	for _, pattern := range secretNames {
+		if ok, _ := path.Match(pattern, base); ok {
+			return fmt.Sprintf("name matches %s", pattern)
+		}
+	}
+	for _, marker := range secretMarkers {
+		if bytes.Contains(head, []byte(marker)) {
+			return fmt.Sprintf("contains %q", marker)
+		}
+	}
+	return ""
+}
+
+// head returns the first n bytes of the identity contents of f, only
+// decompressing that much in compact mode.
+func (f *siteFile) head(n int) []byte {
+	if f.contents != nil || f.gzContents == nil {
+		if len(f.contents) > n {
+			return f.contents[:n]
+		}
+		return f.contents
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(f.gzContents))
+	if err != nil {
+		return nil
+	}
+	head, _ := io.ReadAll(io.LimitReader(zr, int64(n)))
+	return head
+}
+
+// scanSecrets looks for files that likely hold secrets, returning a
+// warning for each. With StrictSecretScan, finding any is an error.
+func (s *Server) scanSecrets(files []*siteFile) ([]string, error) {
+	var warnings []string
+	for _, f := range files {
+		if f == nil {
+			continue
+		}
+		name := path.Join(f.dir, f.name)
+		if reason := scanSecret(name, f.head(secretScanBytes)); reason != "" {
+			warnings = append(warnings, fmt.Sprintf("%s looks sensitive: %s", name, reason))
+		}
+	}
+	if len(warnings) > 0 && s.StrictSecretScan {
+		return nil, fmt.Errorf("refusing to serve sensitive looking files: %s", strings.Join(warnings, "; "))
+	}
+	return warnings, nil
+}
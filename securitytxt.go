@@ -0,0 +1,77 @@
+package marb
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const securityTxtPath = "/.well-known/security.txt"
+
+// securityTxt generates a security.txt file as described in RFC 9116.
+type securityTxt struct {
+	contacts []string
+	expires  time.Time     // fixed expiry, if set
+	validFor time.Duration // otherwise, expiry relative to load time
+}
+
+func newSecurityTxt(contacts []string, expires string) (*securityTxt, error) {
+	if len(contacts) == 0 {
+		return nil, nil
+	}
+	if expires == "" {
+		return nil, errors.New("security.txt: an expiry is required along with contacts")
+	}
+
+	st := &securityTxt{}
+	for _, contact := range contacts {
+		if !strings.Contains(contact, ":") && strings.Contains(contact, "@") {
+			contact = "mailto:" + contact
+		}
+		if u, err := url.Parse(contact); err != nil || u.Scheme == "" {
+			return nil, fmt.Errorf("security.txt: contact %q is not a URI", contact)
+		}
+		st.contacts = append(st.contacts, contact)
+	}
+
+	if t, err := time.Parse(time.RFC3339, expires); err == nil {
+		st.expires = t
+	} else if d, err := time.ParseDuration(expires); err == nil && d > 0 {
+		st.validFor = d
+	} else {
+		return nil, fmt.Errorf("security.txt: expiry %q is neither an RFC 3339 time nor a duration", expires)
+	}
+
+	return st, nil
+}
+
+func (st *securityTxt) generate(now time.Time) []byte {
+	expires := st.expires
+	if expires.IsZero() {
+		// whole days, so reloads don't keep changing the file
+		expires = now.Add(st.validFor).Truncate(24 * time.Hour)
+	}
+
+	var b strings.Builder
+	for _, contact := range st.contacts {
+		fmt.Fprintf(&b, "Contact: %s\n", contact)
+	}
+	fmt.Fprintf(&b, "Expires: %s\n", expires.UTC().Format(time.RFC3339))
+	return []byte(b.String())
+}
+
+// addSecurityTxt adds the generated security.txt to snap, unless the
+// site has its own.
+func (s *Server) addSecurityTxt(snap *siteSnapshot) {
+	if s.securityTxt == nil || snap.files[securityTxtPath] != nil {
+		return
+	}
+
+	now := time.Now()
+	f := newSiteFile(securityTxtPath, s.securityTxt.generate(now), "text/plain; charset=utf-8", "", s.Compact, s.Brotli)
+	f.lastModified = now
+	f.formatHeaders()
+	snap.files[securityTxtPath] = f
+}
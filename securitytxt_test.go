@@ -0,0 +1,48 @@
+package marb
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSecurityTxt(t *testing.T) {
+	s := newTestServer(t, Config{SecurityContacts: []string{"security@example.com", "https://example.com/report"}, SecurityExpires: "2030-01-02T03:04:05Z"}, map[string]string{"index.html": "home"})
+
+	rec := get(s, securityTxtPath)
+	want := "Contact: mailto:security@example.com\nContact: https://example.com/report\nExpires: 2030-01-02T03:04:05Z\n"
+	if rec.Code != http.StatusOK || rec.Body.String() != want || rec.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("got %d %q as %q, want 200 %q as text/plain", rec.Code, rec.Body, rec.Header().Get("Content-Type"), want)
+	}
+
+	// the site's own file wins
+	s = newTestServer(t, Config{SecurityContacts: []string{"security@example.com"}, SecurityExpires: "720h"}, map[string]string{".well-known/security.txt": "Contact: mailto:own@example.com\n"})
+	if body := get(s, securityTxtPath).Body.String(); body != "Contact: mailto:own@example.com\n" {
+		t.Errorf("with a security.txt of its own, the site serves %q", body)
+	}
+}
+
+func TestSecurityTxtExpires(t *testing.T) {
+	st, err := newSecurityTxt([]string{"security@example.com"}, "48h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 3, 4, 15, 0, 0, 0, time.UTC)
+	if got, want := string(st.generate(now)), "Contact: mailto:security@example.com\nExpires: 2026-03-06T00:00:00Z\n"; got != want {
+		t.Errorf("generated %q, want %q", got, want)
+	}
+
+	for _, tt := range []struct {
+		contacts []string
+		expires  string
+	}{
+		{[]string{"security@example.com"}, ""},
+		{[]string{"security@example.com"}, "next year"},
+		{[]string{"security@example.com"}, "-1h"},
+		{[]string{"not a contact"}, "48h"},
+	} {
+		if _, err := newSecurityTxt(tt.contacts, tt.expires); err == nil {
+			t.Errorf("contacts %q expiring %q accepted", tt.contacts, tt.expires)
+		}
+	}
+}
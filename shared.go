@@ -0,0 +1,139 @@
+package marb
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+// Shared is state that servers embedded in one process share when given
+// the same in Config.Shared, while each keeps options of its own: file
+// contents, kept once however many of the sites hold them, and the
+// response and reload counters reported by the admin API of each.
+// Logging goes through the standard log package, which they share
+// anyway.
+type Shared struct {
+	metrics metrics
+
+	mu     sync.Mutex
+	blobs  map[[sha256.Size]byte]*sharedBlob
+	byData map[*byte]*sharedBlob // by first byte, for lookups without hashing
+}
+
+// sharedBlob is file contents held by refs snapshots, or several times
+// by one.
+type sharedBlob struct {
+	data []byte
+	sum  [sha256.Size]byte
+	refs int
+}
+
+// NewShared returns state to share between the servers of a process,
+// holding nothing until they're given it in Config.Shared.
+func NewShared() *Shared {
+	return &Shared{
+		blobs:  make(map[[sha256.Size]byte]*sharedBlob),
+		byData: make(map[*byte]*sharedBlob),
+	}
+}
+
+// SharedStats tells how much memory sharing file contents takes and
+// saves.
+type SharedStats struct {
+	Blobs int   // distinct contents held, compressed versions included
+	Bytes int64 // memory they take
+	Saved int64 // memory the servers would take on top of Bytes without sharing
+}
+
+// Stats tells how many distinct contents the servers sharing sh hold
+// right now, and how much memory that saves them.
+func (sh *Shared) Stats() SharedStats {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	var stats SharedStats
+	for _, b := range sh.blobs {
+		stats.Blobs++
+		stats.Bytes += int64(len(b.data))
+		stats.Saved += int64(len(b.data) * (b.refs - 1))
+	}
+	return stats
+}
+
+// intern returns the shared copy of data, which becomes it if there's
+// none yet.
+func (sh *Shared) intern(data []byte) []byte {
+	if len(data) == 0 {
+		return data
+	}
+	if b := sh.byData[&data[0]]; b != nil && len(b.data) == len(data) {
+		b.refs++
+		return b.data
+	}
+	sum := sha256.Sum256(data)
+	b := sh.blobs[sum]
+	if b == nil {
+		b = &sharedBlob{data: data, sum: sum}
+		sh.blobs[sum] = b
+		sh.byData[&data[0]] = b
+	}
+	b.refs++
+	return b.data
+}
+
+func (sh *Shared) unref(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	b := sh.byData[&data[0]]
+	if b == nil {
+		return
+	}
+	if b.refs--; b.refs == 0 {
+		delete(sh.blobs, b.sum)
+		delete(sh.byData, &b.data[0])
+	}
+}
+
+// hold replaces the contents of the files of snap, about to be swapped
+// in, with their shared copies.
+func (sh *Shared) hold(snap *siteSnapshot) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	for _, f := range snap.paths() {
+		f.contents = sh.intern(f.contents)
+		f.gzContents = sh.intern(f.gzContents)
+		f.brContents = sh.intern(f.brContents)
+	}
+}
+
+// release lets go of the contents of the files of snap, swapped out.
+// Requests still being served from it keep them alive as long as they
+// need.
+func (sh *Shared) release(snap *siteSnapshot) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	for _, f := range snap.paths() {
+		sh.unref(f.contents)
+		sh.unref(f.gzContents)
+		sh.unref(f.brContents)
+	}
+}
+
+// replace lets go of the contents of old, if any, in a snapshot being
+// swapped for a copy holding f in its place, and replaces those of f
+// with their shared copies.
+func (sh *Shared) replace(old, f *siteFile) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if old != nil {
+		sh.unref(old.contents)
+		sh.unref(old.gzContents)
+		sh.unref(old.brContents)
+	}
+	f.contents = sh.intern(f.contents)
+	f.gzContents = sh.intern(f.gzContents)
+	f.brContents = sh.intern(f.brContents)
+}
@@ -0,0 +1,36 @@
+package marb
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"net/http"
+)
+
+// sriDigest returns the Subresource Integrity value of contents, as
+// used in the integrity attribute of script and link tags.
+func sriDigest(contents []byte) string {
+	sum := sha512.Sum384(contents)
+	return "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// serveSRI lists the integrity values of all files on the admin API,
+// by path, for build steps and templates to fetch.
+func (s *Server) serveSRI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		adminError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !s.SRI {
+		adminError(w, r, http.StatusNotFound, "integrity values aren't computed, see -sri")
+		return
+	}
+
+	digests := make(map[string]string)
+	for name, f := range s.current().paths() {
+		if f.sri != "" {
+			digests[name] = f.sri
+		}
+	}
+	writeJSON(w, r, digests)
+}
@@ -0,0 +1,43 @@
+package marb
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestSRI(t *testing.T) {
+	script := "console.log('hello')"
+	sum := sha512.Sum384([]byte(script))
+	want := "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+	files := map[string]string{"index.html": "home", "js/app.js": script}
+
+	s := newTestServer(t, Config{SRIHeader: true}, files)
+	if got := get(s, "/js/app.js").Header().Get("X-SRI"); got != want {
+		t.Errorf("X-SRI %q, want %q", got, want)
+	}
+	rec := get(s.AdminHandler(), "/_sri")
+	var digests map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &digests); err != nil {
+		t.Fatalf("/_sri: %v in %s", err, rec.Body)
+	}
+	if digests["/js/app.js"] != want || len(digests) != 2 {
+		t.Errorf("/_sri listed %v, want /js/app.js with %q among 2 files", digests, want)
+	}
+
+	// without SRIHeader, values are only listed
+	s = newTestServer(t, Config{SRI: true}, files)
+	if got := get(s, "/js/app.js").Header().Get("X-SRI"); got != "" {
+		t.Errorf("X-SRI %q sent without SRIHeader", got)
+	}
+	if rec := get(s.AdminHandler(), "/_sri"); rec.Code != http.StatusOK {
+		t.Errorf("/_sri with SRI: got %d", rec.Code)
+	}
+
+	s = newTestServer(t, Config{}, files)
+	if rec := get(s.AdminHandler(), "/_sri"); rec.Code != http.StatusNotFound {
+		t.Errorf("/_sri without SRI: got %d, want 404", rec.Code)
+	}
+}
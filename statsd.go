@@ -0,0 +1,99 @@
+package marb
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// StatsD packets are kept below the usual Ethernet MTU, and flushed at
+// least every statsdFlushInterval. Up to statsdQueue metrics wait to be
+// sent, further ones being dropped.
+const (
+	statsdMaxPacket     = 1432
+	statsdFlushInterval = time.Second
+	statsdQueue         = 4096
+)
+
+// statsd emits per request metrics to a StatsD or DogStatsD agent over
+// UDP. Requests only queue their metrics, a goroutine batching them into
+// packets, so that serving never waits on the socket.
+type statsd struct {
+	conn    net.Conn
+	prefix  string
+	tags    string // "|#a:b,c:d", or empty
+	queue   chan string
+	dropped int64 // metrics lost to a full queue or failed writes
+}
+
+func newStatsd(cfg Config) (*statsd, error) {
+	conn, err := net.Dial("udp", cfg.StatsdAddr)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: %v", err)
+	}
+	c := &statsd{conn: conn, prefix: cfg.StatsdPrefix, queue: make(chan string, statsdQueue)}
+	if len(cfg.StatsdTags) > 0 {
+		c.tags = "|#" + strings.Join(cfg.StatsdTags, ",")
+	}
+	return c, nil
+}
+
+func (c *statsd) emit(name string, value float64, kind string) {
+	select {
+	case c.queue <- c.prefix + name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + kind + c.tags:
+	default:
+		atomic.AddInt64(&c.dropped, 1)
+	}
+}
+
+// countRequest emits the metrics of a request.
+func (c *statsd) countRequest(status int, bytes int64, elapsed time.Duration) {
+	c.emit("requests", 1, "c")
+	if class := status / 100; class >= 1 && class <= 5 {
+		c.emit(fmt.Sprintf("responses.%dxx", class), 1, "c")
+	}
+	c.emit("response_bytes", float64(bytes), "c")
+	c.emit("request_time", float64(elapsed.Microseconds())/1000, "ms")
+}
+
+func (c *statsd) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(statsdFlushInterval)
+	defer ticker.Stop()
+
+	var packet bytes.Buffer
+	var lines int64
+	flush := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, err := c.conn.Write(packet.Bytes()); err != nil {
+			atomic.AddInt64(&c.dropped, lines)
+		}
+		packet.Reset()
+		lines = 0
+	}
+
+	for {
+		select {
+		case line := <-c.queue:
+			if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+				flush()
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+			lines++
+		case <-ticker.C:
+			flush()
+		case <-stop:
+			flush()
+			c.conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package marb
+
+import (
+	"bytes"
+	"encoding/json"
+	"html"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// suggestionsPlaceholder is replaced, in the custom 404 page, with links
+// to the paths closest to the one that wasn't found.
+const suggestionsPlaceholder = "<!--marb:suggestions-->"
+
+// maxSuggestions is the number of paths suggested on 404s, and
+// maxSuggestionDistance how many edits a name may be off by, fewer for
+// short names.
+const (
+	maxSuggestions        = 3
+	maxSuggestionDistance = 2
+)
+
+// suggester finds the paths of a snapshot that are close to a missing
+// one. Names are compared lowercased and without .html, sibling by
+// sibling, so that a lookup only costs a few edit distances.
+type suggester struct {
+	byKey map[string][]string      // normalized path to paths
+	byDir map[string][]suggestName // normalized directory to its entries
+}
+
+type suggestName struct {
+	name string // normalized base name
+	path string
+}
+
+func suggestKey(p string) string {
+	p = strings.ToLower(strings.Trim(p, "/"))
+	p = strings.TrimSuffix(p, "/index.html")
+	return strings.TrimSuffix(p, ".html")
+}
+
+// newSuggester returns the suggester of snap's paths, the 404 page and
+// hidden files excepted.
+func newSuggester(snap *siteSnapshot) *suggester {
+	sg := &suggester{byKey: make(map[string][]string), byDir: make(map[string][]suggestName)}
+	for p, f := range snap.paths() {
+		if f == snap.error404 || hiddenPath(p) {
+			continue
+		}
+		key := suggestKey(p)
+		sg.byKey[key] = append(sg.byKey[key], p)
+		dir, name := path.Split(key)
+		sg.byDir[dir] = append(sg.byDir[dir], suggestName{name: name, path: p})
+	}
+	for _, paths := range sg.byKey {
+		sort.Strings(paths)
+	}
+	return sg
+}
+
+// suggest returns up to maxSuggestions existing paths close to p, the
+// closest first.
+func (sg *suggester) suggest(p string) []string {
+	type candidate struct {
+		path     string
+		distance int
+	}
+	var candidates []candidate
+	seen := make(map[string]bool)
+	add := func(p string, distance int) {
+		if !seen[p] {
+			seen[p] = true
+			candidates = append(candidates, candidate{p, distance})
+		}
+	}
+
+	key := suggestKey(p)
+	for _, p := range sg.byKey[key] {
+		add(p, 0)
+	}
+	dir, name := path.Split(key)
+	if name == "" {
+		return nil
+	}
+	bound := (len(name) + 1) / 3
+	if bound > maxSuggestionDistance {
+		bound = maxSuggestionDistance
+	}
+	for _, sibling := range sg.byDir[dir] {
+		switch {
+		case len(name) >= 3 && strings.HasPrefix(sibling.name, name),
+			len(sibling.name) >= 3 && strings.HasPrefix(name, sibling.name):
+			add(sibling.path, 1)
+		default:
+			if d := editDistance(name, sibling.name, bound); d <= bound {
+				add(sibling.path, d)
+			}
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].path < candidates[j].path
+	})
+	var paths []string
+	for i := 0; i < len(candidates) && i < maxSuggestions; i++ {
+		paths = append(paths, candidates[i].path)
+	}
+	return paths
+}
+
+// editDistance returns the number of insertions, deletions,
+// substitutions and transpositions turning a into b, or bound+1 as soon
+// as it's known to exceed bound.
+func editDistance(a, b string, bound int) int {
+	if d := len(a) - len(b); d > bound || -d > bound {
+		return bound + 1
+	}
+	// the three rows live on the stack for the usual short names
+	var buf [3 * 64]int
+	rows := buf[:]
+	if n := 3 * (len(b) + 1); n > len(rows) {
+		rows = make([]int, n)
+	}
+	prev2, prev, cur := rows[:len(b)+1], rows[len(b)+1:2*(len(b)+1)], rows[2*(len(b)+1):3*(len(b)+1)]
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		best := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && prev2[j-2]+1 < cur[j] {
+				cur[j] = prev2[j-2] + 1
+			}
+			if cur[j] < best {
+				best = cur[j]
+			}
+		}
+		if best > bound {
+			return bound + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+// suggestions returns the paths to suggest on a 404 for r, if any:
+// only GET requests for HTML-looking paths get some, and HEAD ones to
+// match.
+func (s *Server) suggestions(r *http.Request, snap *siteSnapshot) []string {
+	if snap.suggester == nil || r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return nil
+	}
+	switch strings.ToLower(path.Ext(r.URL.Path)) {
+	case "", ".html", ".htm":
+		return snap.suggester.suggest(r.URL.Path)
+	}
+	return nil
+}
+
+// suggestionsHTML renders suggestions as a list of links.
+func suggestionsHTML(paths []string) []byte {
+	if len(paths) == 0 {
+		return nil
+	}
+	var b bytes.Buffer
+	b.WriteString("<ul>")
+	for _, p := range paths {
+		href := (&url.URL{Path: p}).String()
+		b.WriteString(`<li><a href="` + html.EscapeString(href) + `">` + html.EscapeString(p) + "</a></li>")
+	}
+	b.WriteString("</ul>")
+	return b.Bytes()
+}
+
+// notFoundBody is the 404 body sent without a custom page, in JSON to
+// clients preferring it.
+func notFoundBody(r *http.Request, suggestions []string) (string, []byte) {
+	if prefersJSON(r.Header.Get("Accept")) {
+		body, _ := json.Marshal(struct {
+			Error       string   `json:"error"`
+			Suggestions []string `json:"suggestions,omitempty"`
+		}{"not found", suggestions})
+		return "application/json", append(body, '\n')
+	}
+
+	body := "404 page not found\n"
+	if len(suggestions) > 0 {
+		body += "\nDid you mean:\n"
+		for _, p := range suggestions {
+			body += "  " + p + "\n"
+		}
+	}
+	return "text/plain; charset=utf-8", []byte(body)
+}
@@ -0,0 +1,102 @@
+package marb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var suggestSite = map[string]string{
+	"index.html":           "home",
+	"about.html":           "about",
+	"Contact.html":         "contact",
+	"blog/first-post.html": "first",
+	"a&b.html":             "ampersand",
+	"style.css":            "body {}",
+	".secret.html":         "hidden",
+	".git/config":          "[core]",
+	"404.html":             "<h1>Lost</h1><!--marb:suggestions-->",
+}
+
+func TestSuggestions(t *testing.T) {
+	s := newTestServer(t, Config{}, suggestSite)
+	for _, tt := range []struct {
+		path string
+		want []string
+	}{
+		{"/abuot", []string{"/about.html"}},
+		{"/abot.html", []string{"/about.html"}},
+		{"/ABOUT", []string{"/about.html"}},
+		{"/about.htm", []string{"/about.html"}},
+		{"/contact", []string{"/Contact.html"}},
+		{"/blog/frist-post", []string{"/blog/first-post.html"}},
+		{"/nothing-like-it", nil},
+		{"/styel.css", nil},
+		// hidden files are never suggested
+		{"/secret", nil},
+		{"/.secret", nil},
+		{"/.git/confg", nil},
+		// 404.html is a page like others without NotFound
+		{"/405", []string{"/404.html"}},
+	} {
+		rec := get(s, tt.path)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: got %d, want 404", tt.path, rec.Code)
+			continue
+		}
+		want := "404 page not found\n"
+		if len(tt.want) > 0 {
+			want += "\nDid you mean:\n  " + strings.Join(tt.want, "\n  ") + "\n"
+		}
+		if rec.Body.String() != want {
+			t.Errorf("%s: body %q, want %q", tt.path, rec.Body, want)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/abuot", nil)
+	r.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+	if rec.Header().Get("Content-Type") != "application/json" || rec.Body.String() != `{"error":"not found","suggestions":["/about.html"]}`+"\n" {
+		t.Errorf("JSON: %q %q", rec.Header().Get("Content-Type"), rec.Body)
+	}
+	r = httptest.NewRequest("GET", "/nothing-like-it", nil)
+	r.Header.Set("Accept", "application/json")
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+	if rec.Body.String() != `{"error":"not found"}`+"\n" {
+		t.Errorf("JSON without suggestions: %q", rec.Body)
+	}
+}
+
+func TestSuggestionsPlaceholder(t *testing.T) {
+	s := newTestServer(t, Config{NotFound: "404.html"}, suggestSite)
+	for _, tt := range []struct {
+		path, want string
+	}{
+		{"/abuot", `<h1>Lost</h1><ul><li><a href="/about.html">/about.html</a></li></ul>`},
+		{"/a&c", `<h1>Lost</h1><ul><li><a href="/a&amp;b.html">/a&amp;b.html</a></li></ul>`},
+		{"/nothing-like-it", `<h1>Lost</h1>`},
+		// the 404 page isn't suggested
+		{"/405", `<h1>Lost</h1>`},
+	} {
+		rec := get(s, tt.path)
+		if rec.Code != http.StatusNotFound || rec.Body.String() != tt.want {
+			t.Errorf("%s: %d %q, want 404 %q", tt.path, rec.Code, rec.Body, tt.want)
+		}
+	}
+}
+
+func TestNoSuggestions(t *testing.T) {
+	s := newTestServer(t, Config{NoSuggestions: true}, suggestSite)
+	if rec := get(s, "/abuot"); rec.Body.String() != "404 page not found\n" {
+		t.Errorf("body %q", rec.Body)
+	}
+
+	// the placeholder is left as is
+	s = newTestServer(t, Config{NoSuggestions: true, NotFound: "404.html"}, suggestSite)
+	if rec := get(s, "/abuot"); rec.Body.String() != suggestSite["404.html"] {
+		t.Errorf("custom page %q", rec.Body)
+	}
+}
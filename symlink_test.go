@@ -0,0 +1,62 @@
+package marb
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSymlinksOutOfRoot(t *testing.T) {
+	outside := writeSite(t, map[string]string{"secret.txt": "secret"})
+	site := writeSite(t, map[string]string{"index.html": "home", "docs/page.txt": "page"})
+	for link, target := range map[string]string{
+		"inside.txt": filepath.Join(site, "docs", "page.txt"),
+		"relative":   "docs/page.txt",
+		"leak.txt":   filepath.Join(outside, "secret.txt"),
+		"docs/up":    "../../" + filepath.Base(outside) + "/secret.txt",
+	} {
+		if err := os.Symlink(target, filepath.Join(site, link)); err != nil {
+			t.Skip(err)
+		}
+	}
+
+	logs := captureLog(t)
+	s, err := New(Config{Root: site})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for path, status := range map[string]int{
+		"/inside.txt": http.StatusOK,
+		"/relative":   http.StatusOK,
+		"/leak.txt":   http.StatusNotFound,
+		"/docs/up":    http.StatusNotFound,
+	} {
+		if rec := get(s, path); rec.Code != status {
+			t.Errorf("%s: got %d, want %d", path, rec.Code, status)
+		}
+	}
+	if n := strings.Count(logs.String(), "outside the root, skipped"); n != 2 {
+		t.Errorf("%d links skipped with a warning, want 2:\n%s", n, logs)
+	}
+
+	if _, err := New(Config{Root: site, Strict: true}); err == nil || !strings.Contains(err.Error(), "outside the root") {
+		t.Errorf("strict: got %v, want an error about links out of the root", err)
+	}
+
+	// the root itself may be a link to anywhere
+	linked := filepath.Join(t.TempDir(), "site")
+	if err := os.Symlink(site, linked); err != nil {
+		t.Fatal(err)
+	}
+	s, err = New(Config{Root: linked})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if rec := get(s, "/inside.txt"); rec.Code != http.StatusOK {
+		t.Errorf("root reached through a link: /inside.txt got %d", rec.Code)
+	}
+}
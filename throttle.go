@@ -0,0 +1,224 @@
+package marb
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttleWriteSlack is how long a paced write may take beyond its
+// pacing delay before the connection's write deadline kills it.
+const throttleWriteSlack = 30 * time.Second
+
+// parseRate parses a rate in bytes per second like "2MB/s", "512KB" or
+// "1000", with decimal units.
+func parseRate(s string) (int64, error) {
+	rate, err := parseSize(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return rate, nil
+}
+
+// sizeUnits are the decimal units of sizes, largest first.
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{{"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3}, {"B", 1}}
+
+// parseSize parses a positive number of bytes like "1GB", "1.5MB" or
+// "1000".
+func parseSize(s string) (int64, error) {
+	num := strings.TrimSpace(s)
+	unit := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(strings.ToUpper(num), u.suffix) {
+			num, unit = num[:len(num)-len(u.suffix)], u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || n*float64(unit) < 1 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// formatSize spells out a number of bytes in the largest unit it
+// reaches, like "1.2GB".
+func formatSize(n int64) string {
+	for _, u := range sizeUnits {
+		if n >= u.size && u.size > 1 {
+			return strconv.FormatFloat(float64(n)/float64(u.size), 'f', 1, 64) + u.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
+
+// egressLimiter hands out time slots for sending bytes at rate bytes
+// per second. It's safe for concurrent use, so that one can be shared
+// by all throttled responses.
+type egressLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time
+}
+
+// reserve books n bytes and returns how long to wait before sending
+// them.
+func (l *egressLimiter) reserve(n int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	return wait
+}
+
+// throttledWriter paces the body at most rate bytes per second, and
+// within the shared limit if there's one.
+type throttledWriter struct {
+	http.ResponseWriter
+	own    *egressLimiter
+	shared *egressLimiter
+	chunk  int
+
+	written int64
+	paced   time.Duration
+}
+
+func newThrottledWriter(w http.ResponseWriter, rate int64, shared *egressLimiter) *throttledWriter {
+	t := &throttledWriter{ResponseWriter: w, own: &egressLimiter{rate: rate}, shared: shared}
+	if shared != nil && shared.rate < rate {
+		rate = shared.rate
+	}
+	// write in tenths of a second worth of bytes
+	if t.chunk = int(rate / 10); t.chunk < 1 {
+		t.chunk = 1
+	}
+	return t
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := t.chunk
+		if n > len(p) {
+			n = len(p)
+		}
+
+		now := time.Now()
+		wait := t.own.reserve(n, now)
+		if t.shared != nil {
+			if shared := t.shared.reserve(n, now); shared > wait {
+				wait = shared
+			}
+		}
+		if wait > 0 {
+			time.Sleep(wait)
+			t.paced += wait
+		}
+		t.extendDeadline()
+
+		m, err := t.ResponseWriter.Write(p[:n])
+		written += m
+		t.written += int64(m)
+		if err != nil {
+			return written, err
+		}
+		if f, ok := t.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// extendDeadline pushes the write deadline back, so that a response
+// slowed down on purpose isn't killed by the server's WriteTimeout.
+// Response writers only allow this from Go 1.20 on.
+func (t *throttledWriter) extendDeadline() {
+	if d, ok := t.ResponseWriter.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		d.SetWriteDeadline(time.Now().Add(throttleWriteSlack))
+	}
+}
+
+func (t *throttledWriter) Flush() {
+	if f, ok := t.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// throttleRule paces responses for paths matching pattern, written as
+// PATTERN=RATE, e.g. "/downloads/*=2MB/s".
+type throttleRule struct {
+	pattern string
+	rate    int64
+	spec    string
+}
+
+type throttle struct {
+	rules  []throttleRule
+	global *egressLimiter
+}
+
+// newThrottle returns the throttle applying rules, sharing the global
+// rate among throttled responses if set, or nil if there are no rules.
+func newThrottle(rules []string, global string) (*throttle, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	t := &throttle{}
+	for _, rule := range rules {
+		pattern, spec, ok := strings.Cut(rule, "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("throttle rule %q: expected PATTERN=RATE", rule)
+		}
+		pattern = normalizePattern(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("throttle rule %q: %v", rule, err)
+		}
+		rate, err := parseRate(spec)
+		if err != nil {
+			return nil, fmt.Errorf("throttle rule %q: %v", rule, err)
+		}
+		t.rules = append(t.rules, throttleRule{pattern, rate, spec})
+	}
+
+	if global != "" {
+		rate, err := parseRate(global)
+		if err != nil {
+			return nil, fmt.Errorf("global throttle: %v", err)
+		}
+		t.global = &egressLimiter{rate: rate}
+	}
+	return t, nil
+}
+
+// wrap paces the responses of next matching a rule, the most specific
+// matching rule applying, and records for the access log how much of
+// their duration was spent pacing, telling throttling apart from slow
+// clients.
+func (t *throttle) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := mostSpecific(len(t.rules), func(i int) string { return t.rules[i].pattern }, r.URL.Path)
+		if i < 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rule := t.rules[i]
+		tw := newThrottledWriter(w, rule.rate, t.global)
+		next.ServeHTTP(tw, r)
+		setThrottled(r, rule.spec, tw.paced)
+	})
+}
@@ -0,0 +1,144 @@
+package marb
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sniffTimeout bounds how long a new connection has to send its first
+// bytes, telling TLS and plain HTTP apart.
+const sniffTimeout = 10 * time.Second
+
+// recordTypeHandshake starts every TLS connection.
+const recordTypeHandshake = 0x16
+
+const plaintextMessage = "This port only speaks HTTPS, use an https:// URL instead.\n"
+
+// NewTLSListener returns a listener serving TLS with config on the
+// connections accepted by l. Clients speaking plain HTTP to it get a
+// readable 400 Bad Request or, if redirect is set, a redirect to the
+// same URL over HTTPS, instead of a handshake error.
+func NewTLSListener(l net.Listener, config *tls.Config, redirect bool) net.Listener {
+	return &tlsListener{
+		Listener: l,
+		config:   config,
+		redirect: redirect,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+}
+
+// tlsListener sniffs each connection in its own goroutine, so that
+// slow clients don't hold up Accept, and hands out the TLS ones as
+// *tls.Conn for http.Server to recognize them.
+type tlsListener struct {
+	net.Listener
+	config   *tls.Config
+	redirect bool
+
+	start sync.Once
+	stop  sync.Once
+	conns chan net.Conn
+	errs  chan error
+	done  chan struct{}
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	l.start.Do(func() { go l.acceptLoop() })
+
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *tlsListener) Close() error {
+	l.stop.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+func (l *tlsListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		go l.sniff(c)
+	}
+}
+
+func (l *tlsListener) sniff(c net.Conn) {
+	br := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(sniffTimeout))
+	first, err := br.Peek(1)
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	if first[0] != recordTypeHandshake {
+		l.servePlaintext(c, br)
+		return
+	}
+
+	c.SetReadDeadline(time.Time{})
+	select {
+	case l.conns <- tls.Server(&peekedConn{c, br}, l.config):
+	case <-l.done:
+		c.Close()
+	}
+}
+
+// servePlaintext answers a plain HTTP request and hangs up.
+func (l *tlsListener) servePlaintext(c net.Conn, br *bufio.Reader) {
+	defer c.Close()
+	c.SetWriteDeadline(time.Now().Add(sniffTimeout))
+
+	r, err := http.ReadRequest(br)
+	if err == nil && l.redirect && r.Host != "" {
+		log.Printf("%s %s %s: plain HTTP on the TLS port, redirecting", c.RemoteAddr(), r.Method, r.RequestURI)
+		code := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			code = http.StatusPermanentRedirect
+		}
+		fmt.Fprintf(c, "HTTP/1.1 %d %s\r\nLocation: https://%s%s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+			code, http.StatusText(code), r.Host, r.URL.RequestURI())
+		return
+	}
+
+	log.Printf("%s: plain HTTP on the TLS port, refusing", c.RemoteAddr())
+	fmt.Fprintf(c, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		http.StatusBadRequest, http.StatusText(http.StatusBadRequest), len(plaintextMessage), plaintextMessage)
+}
+
+// peekedConn reads through the buffer the first bytes were peeked
+// into.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,55 @@
+package marb
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTLSListenerPlaintext(t *testing.T) {
+	s := newTestServer(t, Config{}, map[string]string{"index.html": "home"})
+	// borrow the certificate and trusting client of a test server
+	base := httptest.NewTLSServer(s)
+	config, client := base.TLS.Clone(), base.Client()
+	base.Close()
+	plain := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	for _, redirect := range []bool{false, true} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := &http.Server{Handler: s}
+		go srv.Serve(NewTLSListener(l, config, redirect))
+		defer srv.Close()
+		addr := l.Addr().String()
+
+		resp, err := client.Get("https://" + addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "home" {
+			t.Errorf("redirect %v, over TLS: got %d %q, want 200 home", redirect, resp.StatusCode, body)
+		}
+
+		resp, err = plain.Get("http://" + addr + "/docs?q=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if redirect {
+			if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "https://"+addr+"/docs?q=1" {
+				t.Errorf("plain HTTP: got %d to %q, want a redirect to HTTPS", resp.StatusCode, resp.Header.Get("Location"))
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusBadRequest || string(body) != plaintextMessage {
+			t.Errorf("plain HTTP: got %d %q, want 400 %q", resp.StatusCode, body, plaintextMessage)
+		}
+	}
+}
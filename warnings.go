@@ -0,0 +1,62 @@
+package marb
+
+import (
+	"fmt"
+	"log"
+)
+
+// Warning is a problem found while loading the files being served,
+// which didn't prevent serving them. Its code tells the kind of
+// problem, and doesn't change from one version to the next, for
+// deployments to pick out the ones they care about:
+//
+//   - meta-orphan: a metadata sidecar without a file to apply it to
+//   - secret: a file that looks like it holds secrets
+//   - over-budget: the files take more memory than MaxTotalSize
+//   - too-deep: files skipped for being deeper than MaxPathDepth
+//   - manifest-missing: an asset manifest entry without its file
+//   - search-full: pages left out of the full search index
+//   - path-collision: a file and a directory with an index at one path
+//   - health-shadowed: a file at a health check path, never served
+type Warning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	warnMetaOrphan      = "meta-orphan"
+	warnSecret          = "secret"
+	warnOverBudget      = "over-budget"
+	warnTooDeep         = "too-deep"
+	warnManifestMissing = "manifest-missing"
+	warnSearchFull      = "search-full"
+	warnPathCollision   = "path-collision"
+	warnHealthShadowed  = "health-shadowed"
+)
+
+func (w Warning) String() string {
+	return w.Message + " [" + w.Code + "]"
+}
+
+// Warnings returns the problems found while loading the files being
+// served, in the order they were found.
+func (s *Server) Warnings() []Warning {
+	return s.current().warnings
+}
+
+// newWarnings logs messages as warnings of kind code, and returns them
+// added to warnings.
+func newWarnings(warnings []Warning, code string, messages ...string) []Warning {
+	for _, m := range messages {
+		w := Warning{Code: code, Message: m}
+		log.Printf("warning: %s", w)
+		warnings = append(warnings, w)
+	}
+	return warnings
+}
+
+// warn logs a problem found while loading snap, and keeps it for
+// Warnings.
+func (snap *siteSnapshot) warn(code string, format string, args ...interface{}) {
+	snap.warnings = newWarnings(snap.warnings, code, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,164 @@
+package marb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWatchInterval = time.Second
+
+	liveReloadPath      = "/_marb/reload"
+	liveReloadHeartbeat = 30 * time.Second
+)
+
+// liveReloadScript is injected into HTML pages in live reload mode, to
+// reload them whenever the watcher picks up a change.
+const liveReloadScript = `<script>new EventSource("` + liveReloadPath + `").onmessage = function() { location.reload() }</script>`
+
+// checkDevMode makes sure watching is only asked for on local roots,
+// and live reloading only along with watching, so that the live reload
+// script can't end up in production pages by accident.
+func checkDevMode(cfg Config, src source) error {
+	if cfg.LiveReload && !cfg.Watch {
+		return errors.New("live reloading requires watching the root")
+	}
+	if _, ok := src.(*fsSource); cfg.Watch && !ok {
+		return errors.New("only local roots can be watched")
+	}
+	return nil
+}
+
+// fingerprint sums up the names, sizes and modification times of the
+// files of src, cheaply telling whether any changed.
+func fingerprint(src source) ([]byte, error) {
+	list, err := src.list()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	for _, f := range list {
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00", f.name, f.size, f.modTime.UnixNano())
+	}
+	return h.Sum(nil), nil
+}
+
+func (s *Server) fingerprint() ([]byte, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	return fingerprint(s.source)
+}
+
+// watchLoop polls the root for changes and reloads it when it sees
+// some, notifying live reload clients.
+func (s *Server) watchLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	last, _ := s.fingerprint()
+	for {
+		select {
+		case <-t.C:
+		case <-s.stop:
+			return
+		}
+
+		sum, err := s.fingerprint()
+		if err != nil || bytes.Equal(sum, last) {
+			continue
+		}
+		last = sum
+
+		if diff, err := s.reload("watch"); err == nil && diff.size() > 0 && s.liveReload != nil {
+			s.liveReload.broadcast()
+		}
+	}
+}
+
+// injectLiveReload adds the live reload script to an HTML page, at the
+// end of its body if it has one.
+func injectLiveReload(page []byte) []byte {
+	i := bytes.LastIndex(bytes.ToLower(page), []byte("</body>"))
+	if i < 0 {
+		i = len(page)
+	}
+
+	out := make([]byte, 0, len(page)+len(liveReloadScript))
+	out = append(out, page[:i]...)
+	out = append(out, liveReloadScript...)
+	return append(out, page[i:]...)
+}
+
+// liveReloader tells the pages listening on its server-sent events
+// endpoint to reload. Waiting clients only hold a channel, which is
+// closed to wake them all at once.
+type liveReloader struct {
+	mu      sync.Mutex
+	changed chan struct{}
+}
+
+func newLiveReloader() *liveReloader {
+	return &liveReloader{changed: make(chan struct{})}
+}
+
+func (l *liveReloader) broadcast() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *liveReloader) wait() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.changed
+}
+
+func (s *Server) serveLiveReload(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	changed := s.liveReload.wait()
+	heartbeat := time.NewTicker(liveReloadHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-changed:
+			fmt.Fprint(w, "data: reload\n\n")
+			flusher.Flush()
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func logDevMode(cfg Config) {
+	if cfg.LiveReload {
+		log.Printf("DEV MODE: watching %s and injecting the live reload script into HTML pages", cfg.Root)
+	} else if cfg.Watch {
+		log.Printf("DEV MODE: watching %s", cfg.Root)
+	}
+}
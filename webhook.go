@@ -0,0 +1,234 @@
+package marb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookBurst is how many webhook requests can arrive back to
+	// back before the rate limit kicks in.
+	webhookBurst = 3
+
+	defaultWebhookMaxBody  = 1 << 20
+	defaultWebhookInterval = 10 * time.Second
+	defaultWebhookWindow   = 10 * time.Minute
+)
+
+// rateLimiter is a token bucket refilled with one token per interval.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	burst    float64
+	tokens   float64
+	last     time.Time
+}
+
+func newRateLimiter(interval time.Duration, burst int) *rateLimiter {
+	return &rateLimiter{interval: interval, burst: float64(burst), tokens: float64(burst)}
+}
+
+// allow takes a token if there is one. Otherwise it returns how long to
+// wait until the next one.
+func (l *rateLimiter) allow(now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.interval <= 0 {
+		return true, 0
+	}
+
+	if !l.last.IsZero() {
+		l.tokens += float64(now.Sub(l.last)) / float64(l.interval)
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false, time.Duration((1 - l.tokens) * float64(l.interval))
+	}
+	l.tokens--
+	return true, 0
+}
+
+// webhook verifies deploy notifications signed the way GitHub does it:
+// an X-Hub-Signature-256 header holding the HMAC-SHA256 of the body.
+//
+// Replays are refused by remembering signatures and delivery IDs for a
+// while. A top-level "timestamp" field in the body, being covered by the
+// signature, additionally bounds how old a delivery may be.
+type webhook struct {
+	secret  []byte
+	maxBody int64
+	window  time.Duration
+	limiter *rateLimiter
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func newWebhook(cfg Config) *webhook {
+	if cfg.WebhookMaxBody <= 0 {
+		cfg.WebhookMaxBody = defaultWebhookMaxBody
+	}
+	if cfg.WebhookInterval <= 0 {
+		cfg.WebhookInterval = defaultWebhookInterval
+	}
+	if cfg.WebhookWindow <= 0 {
+		cfg.WebhookWindow = defaultWebhookWindow
+	}
+
+	return &webhook{
+		secret:  []byte(cfg.WebhookSecret),
+		maxBody: cfg.WebhookMaxBody,
+		window:  cfg.WebhookWindow,
+		limiter: newRateLimiter(cfg.WebhookInterval, webhookBurst),
+		seen:    make(map[string]time.Time),
+	}
+}
+
+func (h *webhook) verifySignature(body []byte, header string) bool {
+	if !strings.HasPrefix(header, "sha256=") {
+		return false
+	}
+
+	sig, err := hex.DecodeString(header[len("sha256="):])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// remember records the given delivery keys, returning false if any of
+// them was already seen within the replay window.
+func (h *webhook) remember(now time.Time, keys ...string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for key, at := range h.seen {
+		if now.Sub(at) > h.window {
+			delete(h.seen, key)
+		}
+	}
+
+	for _, key := range keys {
+		if _, ok := h.seen[key]; ok && key != "" {
+			return false
+		}
+	}
+	for _, key := range keys {
+		if key != "" {
+			h.seen[key] = now
+		}
+	}
+	return true
+}
+
+// checkTimestamp rejects bodies carrying a timestamp outside the replay
+// window. Bodies without one, or that aren't JSON objects, pass.
+func (h *webhook) checkTimestamp(now time.Time, body []byte) error {
+	var payload struct {
+		Timestamp json.RawMessage `json:"timestamp"`
+	}
+	if json.Unmarshal(body, &payload) != nil || payload.Timestamp == nil {
+		return nil
+	}
+
+	var t time.Time
+	var unix int64
+	var text string
+	if err := json.Unmarshal(payload.Timestamp, &unix); err == nil {
+		t = time.Unix(unix, 0)
+	} else if err := json.Unmarshal(payload.Timestamp, &text); err == nil {
+		if t, err = time.Parse(time.RFC3339, text); err != nil {
+			return fmt.Errorf("invalid timestamp %q", text)
+		}
+	} else {
+		return fmt.Errorf("invalid timestamp %s", payload.Timestamp)
+	}
+
+	if d := now.Sub(t); d > h.window || d < -h.window {
+		return fmt.Errorf("timestamp %s is outside the replay window", t.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func deliveryID(r *http.Request) string {
+	if id := r.Header.Get("X-GitHub-Delivery"); id != "" {
+		return "delivery:" + id
+	}
+	if id := r.Header.Get("X-Gitlab-Event-UUID"); id != "" {
+		return "delivery:" + id
+	}
+	return ""
+}
+
+func (s *Server) serveWebhook(w http.ResponseWriter, r *http.Request) {
+	h := s.webhook
+	now := time.Now()
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		adminError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	if r.ContentLength > h.maxBody {
+		adminError(w, r, http.StatusRequestEntityTooLarge, "body too large")
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.maxBody))
+	if err != nil {
+		adminError(w, r, http.StatusRequestEntityTooLarge, "body too large")
+		return
+	}
+
+	signature := r.Header.Get("X-Hub-Signature-256")
+	if !h.verifySignature(body, signature) {
+		log.Printf("webhook: bad signature from %s", r.RemoteAddr)
+		adminError(w, r, http.StatusUnauthorized, "bad signature")
+		return
+	}
+
+	// only signed requests take a token, so that forged ones can't
+	// hold off the sender's
+	if ok, wait := h.limiter.allow(now); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+		adminError(w, r, http.StatusTooManyRequests, "too many requests")
+		return
+	}
+
+	if err := h.checkTimestamp(now, body); err != nil {
+		adminError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !h.remember(now, "signature:"+signature, deliveryID(r)) {
+		adminError(w, r, http.StatusConflict, "delivery already processed")
+		return
+	}
+
+	diff, err := s.reload("webhook")
+	if err != nil {
+		adminError(w, r, http.StatusInternalServerError, "reload failed")
+		return
+	}
+
+	resp, _ := json.Marshal(diff)
+	writeDynamic(w, r, http.StatusOK, "application/json", resp)
+}
@@ -0,0 +1,168 @@
+package marb
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testWebhookPath   = "/_hooks/deploy"
+	testWebhookSecret = "s3cret"
+)
+
+func signWebhook(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook posts body to s's webhook with the given signature and
+// delivery ID, if any.
+func postWebhook(s http.Handler, body, signature, delivery string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", testWebhookPath, strings.NewReader(body))
+	if signature != "" {
+		r.Header.Set("X-Hub-Signature-256", signature)
+	}
+	if delivery != "" {
+		r.Header.Set("X-GitHub-Delivery", delivery)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+	return rec
+}
+
+func newWebhookServer(t *testing.T, cfg Config) *Server {
+	cfg.WebhookPath = testWebhookPath
+	cfg.WebhookSecret = testWebhookSecret
+	return newTestServer(t, cfg, map[string]string{"index.html": "home"})
+}
+
+func TestWebhook(t *testing.T) {
+	s := newWebhookServer(t, Config{WebhookInterval: time.Nanosecond})
+	now := time.Now()
+
+	for _, tt := range []struct {
+		name                      string
+		body, signature, delivery string
+		status                    int
+	}{
+		{"valid", `{"ref":"main"}`, signWebhook(testWebhookSecret, `{"ref":"main"}`), "1", http.StatusOK},
+		{"missing signature", `{"ref":"main"}`, "", "", http.StatusUnauthorized},
+		{"other key", `{"ref":"dev"}`, signWebhook("guess", `{"ref":"dev"}`), "", http.StatusUnauthorized},
+		{"other body", `{"ref":"dev"}`, signWebhook(testWebhookSecret, `{"ref":"main"}`), "", http.StatusUnauthorized},
+		{"not hex", `{"ref":"dev"}`, "sha256=zz", "", http.StatusUnauthorized},
+		{"SHA-1", `{"ref":"dev"}`, "sha1=" + strings.TrimPrefix(signWebhook(testWebhookSecret, `{"ref":"dev"}`), "sha256="), "", http.StatusUnauthorized},
+		{"replayed signature", `{"ref":"main"}`, signWebhook(testWebhookSecret, `{"ref":"main"}`), "2", http.StatusConflict},
+		{"replayed delivery", `{"ref":"next"}`, signWebhook(testWebhookSecret, `{"ref":"next"}`), "1", http.StatusConflict},
+		{"new delivery", `{"ref":"next"}`, signWebhook(testWebhookSecret, `{"ref":"next"}`), "3", http.StatusOK},
+		{"recent timestamp", fmt.Sprintf(`{"timestamp":%d}`, now.Unix()), signWebhook(testWebhookSecret, fmt.Sprintf(`{"timestamp":%d}`, now.Unix())), "", http.StatusOK},
+		{"old timestamp", fmt.Sprintf(`{"timestamp":%d}`, now.Add(-time.Hour).Unix()), signWebhook(testWebhookSecret, fmt.Sprintf(`{"timestamp":%d}`, now.Add(-time.Hour).Unix())), "", http.StatusBadRequest},
+		{"future timestamp", fmt.Sprintf(`{"timestamp":%q}`, now.Add(time.Hour).Format(time.RFC3339)), signWebhook(testWebhookSecret, fmt.Sprintf(`{"timestamp":%q}`, now.Add(time.Hour).Format(time.RFC3339))), "", http.StatusBadRequest},
+		{"invalid timestamp", `{"timestamp":"yesterday"}`, signWebhook(testWebhookSecret, `{"timestamp":"yesterday"}`), "", http.StatusBadRequest},
+	} {
+		rec := postWebhook(s, tt.body, tt.signature, tt.delivery)
+		if rec.Code != tt.status {
+			t.Errorf("%s: got %d %s, want %d", tt.name, rec.Code, rec.Body, tt.status)
+		}
+		if tt.status == http.StatusOK && !strings.Contains(rec.Body.String(), `"added"`) {
+			t.Errorf("%s: body %s isn't the reload's diff", tt.name, rec.Body)
+		}
+	}
+
+	rec := get(s, testWebhookPath)
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "POST" {
+		t.Errorf("GET: got %d, Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+
+	if _, err := New(Config{Root: writeSite(t, smallSite), WebhookPath: testWebhookPath}); err == nil {
+		t.Error("webhook accepted without a secret")
+	}
+}
+
+func TestWebhookMaxBody(t *testing.T) {
+	s := newWebhookServer(t, Config{WebhookMaxBody: 16, WebhookInterval: time.Nanosecond})
+	body := `{"ref":"a-long-branch-name"}`
+
+	if rec := postWebhook(s, body, signWebhook(testWebhookSecret, body), ""); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("with Content-Length: got %d, want 413", rec.Code)
+	}
+
+	// a chunked body is cut at the limit
+	r := httptest.NewRequest("POST", testWebhookPath, io.MultiReader(strings.NewReader(body)))
+	r.ContentLength = -1
+	r.Header.Set("X-Hub-Signature-256", signWebhook(testWebhookSecret, body))
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("without Content-Length: got %d, want 413", rec.Code)
+	}
+
+	if rec := postWebhook(s, `{"ref":"main"}`, signWebhook(testWebhookSecret, `{"ref":"main"}`), ""); rec.Code != http.StatusOK {
+		t.Errorf("within the limit: got %d, want 200", rec.Code)
+	}
+}
+
+func TestWebhookRateLimit(t *testing.T) {
+	if got := newWebhook(Config{}).limiter.interval; got != defaultWebhookInterval {
+		t.Errorf("default interval %v, want %v", got, defaultWebhookInterval)
+	}
+
+	s := newWebhookServer(t, Config{WebhookInterval: time.Hour})
+
+	// bad signatures don't take the tokens of signed requests
+	for i := 0; i < 2*webhookBurst; i++ {
+		if rec := postWebhook(s, "{}", "sha256=00", ""); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("bad signature: got %d, want 401", rec.Code)
+		}
+	}
+	for i := 0; i < webhookBurst; i++ {
+		body := fmt.Sprintf(`{"n":%d}`, i)
+		if rec := postWebhook(s, body, signWebhook(testWebhookSecret, body), ""); rec.Code != http.StatusOK {
+			t.Errorf("signed request %d: got %d, want 200", i, rec.Code)
+		}
+	}
+	rec := postWebhook(s, `{"n":-1}`, signWebhook(testWebhookSecret, `{"n":-1}`), "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("past the burst: got %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "3600" {
+		t.Errorf("Retry-After %q, want 3600", got)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(time.Second, 2)
+	now := time.Unix(0, 0)
+	for i, tt := range []struct {
+		after time.Duration
+		ok    bool
+		wait  time.Duration
+	}{
+		{0, true, 0},
+		{0, true, 0},
+		{0, false, time.Second},
+		{250 * time.Millisecond, false, 750 * time.Millisecond},
+		{750 * time.Millisecond, true, 0},
+		// refilling stops at the burst
+		{time.Hour, true, 0},
+		{0, true, 0},
+		{0, false, time.Second},
+	} {
+		now = now.Add(tt.after)
+		if ok, wait := l.allow(now); ok != tt.ok || wait != tt.wait {
+			t.Errorf("%d: got %v, %v, want %v, %v", i, ok, wait, tt.ok, tt.wait)
+		}
+	}
+
+	if ok, _ := newRateLimiter(0, 1).allow(now); !ok {
+		t.Error("a zero interval limits")
+	}
+}